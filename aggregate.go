@@ -16,6 +16,18 @@ type AggregateSample struct {
 	Min         float64   // Minimum value
 	Max         float64   // Maximum value
 	LastUpdated time.Time `json:"-"` // When value was last updated
+
+	// quantiles is set by InmemSink.WithQuantiles
+	quantiles *quantileSketch
+}
+
+// Quantile returns the approximate value at the quantile q in [0, 1],
+// for example 0.95, or NaN if the quantiles are not tracked
+func (a *AggregateSample) Quantile(q float64) float64 {
+	if a.quantiles == nil {
+		return math.NaN()
+	}
+	return a.quantiles.quantile(q)
 }
 
 // Stddev computes a Stddev of the values
@@ -38,17 +50,29 @@ func (a *AggregateSample) Mean() float64 {
 
 // Ingest is used to update a sample
 func (a *AggregateSample) Ingest(v float64, rateDenom float64) {
-	a.Count++
-	a.Sum += v
-	a.SumSq += (v * v)
-	if v < a.Min || a.Count == 1 {
+	a.IngestN(v, 1, rateDenom)
+}
+
+// IngestN is used to update a sample with the value observed weight times
+func (a *AggregateSample) IngestN(v float64, weight int, rateDenom float64) {
+	if weight <= 0 {
+		return
+	}
+	first := a.Count == 0
+	a.Count += weight
+	a.Sum += v * float64(weight)
+	a.SumSq += (v * v) * float64(weight)
+	if v < a.Min || first {
 		a.Min = v
 	}
-	if v > a.Max || a.Count == 1 {
+	if v > a.Max || first {
 		a.Max = v
 	}
 	a.Rate = float64(a.Sum) / rateDenom
 	a.LastUpdated = time.Now()
+	if a.quantiles != nil {
+		a.quantiles.add(v, weight)
+	}
 }
 
 func (a *AggregateSample) String() string {
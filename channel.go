@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Measurement is a single emission sent by ChannelSink
+type Measurement struct {
+	// Type of the metric: counter|gauge|sample
+	Type  string
+	Key   string
+	Value float64
+	Tags  []Tag
+	Time  time.Time
+}
+
+// ChannelSink sends each emission to a buffered channel,
+// to be processed by a custom pipeline.
+// The emissions are dropped when the channel is full.
+type ChannelSink struct {
+	events  chan Measurement
+	dropped atomic.Uint64
+}
+
+// NewChannelSink creates channel sink with the buffer size
+func NewChannelSink(buffer int) *ChannelSink {
+	return &ChannelSink{
+		events: make(chan Measurement, buffer),
+	}
+}
+
+// Events returns the channel of the emissions
+func (s *ChannelSink) Events() <-chan Measurement {
+	return s.events
+}
+
+// SetGauge should retain the last value it is set to
+func (s *ChannelSink) SetGauge(key string, val float64, tags []Tag) {
+	s.send(TypeGauge, key, val, tags)
+}
+
+// IncrCounter should accumulate values
+func (s *ChannelSink) IncrCounter(key string, val float64, tags []Tag) {
+	s.send(TypeCounter, key, val, tags)
+}
+
+// AddSample is for timing information, where quantiles are used
+func (s *ChannelSink) AddSample(key string, val float64, tags []Tag) {
+	s.send(TypeSample, key, val, tags)
+}
+
+// Dropped returns the number of emissions dropped when the channel is full
+func (s *ChannelSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *ChannelSink) send(typ, key string, val float64, tags []Tag) {
+	select {
+	case s.events <- Measurement{Type: typ, Key: key, Value: val, Tags: tags, Time: time.Now()}:
+	default:
+		s.dropped.Add(1)
+	}
+}
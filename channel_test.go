@@ -0,0 +1,41 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ChannelSink(t *testing.T) {
+	cs := metrics.NewChannelSink(3)
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, cs)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "method", Value: "GET"}}
+	prov.SetGauge("test_gauge", 1)
+	prov.IncrCounter("test_counter", 2, tags...)
+	prov.AddSample("test_sample", 3)
+	// the channel is full
+	prov.IncrCounter("test_counter", 4)
+	assert.Equal(t, uint64(1), cs.Dropped())
+
+	var list []metrics.Measurement
+	for i := 0; i < 3; i++ {
+		m := <-cs.Events()
+		assert.False(t, m.Time.IsZero())
+		list = append(list, metrics.Measurement{Type: m.Type, Key: m.Key, Value: m.Value, Tags: m.Tags})
+	}
+	assert.Equal(t, []metrics.Measurement{
+		{Type: metrics.TypeGauge, Key: "test_gauge", Value: 1},
+		{Type: metrics.TypeCounter, Key: "test_counter", Value: 2, Tags: tags},
+		{Type: metrics.TypeSample, Key: "test_sample", Value: 3},
+	}, list)
+
+	// the channel has room again
+	prov.IncrCounter("test_counter", 5)
+	m := <-cs.Events()
+	assert.Equal(t, float64(5), m.Value)
+	assert.Equal(t, uint64(1), cs.Dropped())
+}
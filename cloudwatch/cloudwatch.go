@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -27,17 +30,42 @@ type Publisher interface {
 	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
 }
 
+// metricsLister is implemented by the CloudWatch client,
+// and used for HealthCheck
+type metricsLister interface {
+	ListMetrics(ctx context.Context, params *cloudwatch.ListMetricsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListMetricsOutput, error)
+}
+
 // Config defines configuration options
 type Config struct {
-	// AwsRegion is the required AWS Region to use
+	// AwsRegion is the AWS Region to use.
+	// If not set, AWS_REGION or AWS_DEFAULT_REGION environment variables are used,
+	// otherwise the region is resolved from the shared config or EC2 IMDS.
 	AwsRegion string
 
+	// RequireExplicitRegion specifies to fail if the region is not provided
+	// in the config or environment variables
+	RequireExplicitRegion bool
+
 	// AwsEndpoint is the optional AWS endpoint to use
 	AwsEndpoint string
 
+	// ConfigOptions are the optional AWS config loader options,
+	// applied after the options derived from this Config,
+	// for example to configure a retryer or a custom HTTP client
+	ConfigOptions []func(*awsconfig.LoadOptions) error
+
+	// ClientOptions are the optional CloudWatch client options,
+	// for example to add a middleware
+	ClientOptions []func(*cloudwatch.Options)
+
 	// Namespace specifies the namespace under which metrics should be published.
 	Namespace string
 
+	// NamespaceFn is an optional function to resolve the namespace for a metric,
+	// if it returns empty string, then the default Namespace is used
+	NamespaceFn func(key string, tags []metrics.Tag) string
+
 	// PublishInterval specifies the frequency with which metrics should be published to Cloudwatch.
 	PublishInterval time.Duration
 
@@ -52,8 +80,65 @@ type Config struct {
 
 	// WithCleanup specifies to clean up published metrics
 	WithCleanup bool
+
+	// DimensionOverflow specifies the handling of the metrics with more than 10 tags,
+	// by default the tags over the limit are dropped
+	DimensionOverflow DimensionOverflow
+
+	// FoldDimensionOverflow specifies to append the tags over the limit of 10 dimensions
+	// to the metric name, instead of dropping them, with DimensionOverflowTruncate.
+	// The tags are sorted by name, and the first 10 are kept as dimensions.
+	FoldDimensionOverflow bool
+
+	// DimensionOverflowSeparator is the separator of the folded tags in the metric name,
+	// by default "."
+	DimensionOverflowSeparator string
+
+	// FlushThreshold specifies the number of accumulated metrics to trigger
+	// an immediate Flush, without waiting for PublishInterval.
+	// It should be used with WithCleanup, otherwise the published metrics are retained
+	// and each new metric triggers a Flush. 0 means no threshold.
+	FlushThreshold int
+
+	// StampAtPublish specifies to set the timestamp of the published metrics
+	// to the flush time, instead of the time of the last update
+	StampAtPublish bool
+
+	// GaugeAsStatistic specifies to publish gauges as a single sample StatisticSet,
+	// so any statistic in CloudWatch (Min, Max, Average, Sum) shows the value
+	GaugeAsStatistic bool
+
+	// SampleDistributionBins specifies to publish the samples as a distribution
+	// of up to the number of Values and Counts, instead of a StatisticSet.
+	// The closest values are merged to fit the bins, up to the CloudWatch limit of 150.
+	// 0 means the distribution is not published.
+	SampleDistributionBins int
+
+	// Transport specifies how the metrics are delivered,
+	// by default PutMetricData API is used
+	Transport Transport
+
+	// FirehoseClient is the client of the Firehose delivery stream,
+	// required with TransportFirehose
+	FirehoseClient FirehoseClient
+
+	// FirehoseStream is the name of the Firehose delivery stream,
+	// required with TransportFirehose
+	FirehoseStream string
 }
 
+// DimensionOverflow specifies the handling of the metrics over the dimensions limit
+type DimensionOverflow int
+
+const (
+	// DimensionOverflowTruncate keeps the first 10 tags sorted by name, the default
+	DimensionOverflowTruncate DimensionOverflow = iota
+	// DimensionOverflowPanic panics, to catch the metrics in development
+	DimensionOverflowPanic
+	// DimensionOverflowDrop drops the metric
+	DimensionOverflowDrop
+)
+
 // Sink provides a MetricSink that can be used
 // with a prometheus server.
 type Sink struct {
@@ -62,28 +147,56 @@ type Sink struct {
 	mu                        sync.Mutex
 	cloudWatchPublishInterval time.Duration
 	cloudWatchNamespace       string
+	namespaceFn               func(key string, tags []metrics.Tag) string
 	expiration                time.Duration
 	withSampleCount           bool
 	withCleanup               bool
+	stampAtPublish            bool
+	gaugeAsStatistic          bool
+	distributionBins          int
+	flushThreshold            int
+	overflow                  DimensionOverflow
+	foldOverflow              bool
+	overflowSeparator         string
+	flushing                  atomic.Bool
 	gauges                    map[string]*types.MetricDatum
 	samples                   map[string]*types.MetricDatum
+	sampleNames               map[string]*sampleNames
+	distributions             map[string]*distribution
 	counters                  map[string]*types.MetricDatum
 	updates                   map[string]time.Time
 }
 
+var (
+	_ metrics.Sink            = (*Sink)(nil)
+	_ metrics.FlushableSink   = (*Sink)(nil)
+	_ metrics.HealthChecker   = (*Sink)(nil)
+	_ metrics.TimestampedSink = (*Sink)(nil)
+)
+
 // NewSink initializes and returns a pointer to a CloudWatch Sink using the
 // supplied configuration, or an error if there is a problem with the configuration
 func NewSink(c *Config) (*Sink, error) {
 	sink := &Sink{
 		gauges:                    make(map[string]*types.MetricDatum),
 		samples:                   make(map[string]*types.MetricDatum),
+		sampleNames:               make(map[string]*sampleNames),
+		distributions:             make(map[string]*distribution),
 		counters:                  make(map[string]*types.MetricDatum),
 		updates:                   make(map[string]time.Time),
 		expiration:                c.MetricsExpiry,
 		cloudWatchPublishInterval: c.PublishInterval,
 		cloudWatchNamespace:       c.Namespace,
+		namespaceFn:               c.NamespaceFn,
 		withSampleCount:           c.WithSampleCount,
 		withCleanup:               c.WithCleanup,
+		stampAtPublish:            c.StampAtPublish,
+		gaugeAsStatistic:          c.GaugeAsStatistic,
+		distributionBins:          min(c.SampleDistributionBins, maxDistributionValues),
+		flushThreshold:            c.FlushThreshold,
+		overflow:                  c.DimensionOverflow,
+		foldOverflow:              c.FoldDimensionOverflow,
+		overflowSeparator:         values.Coalesce(c.DimensionOverflowSeparator, "."),
 	}
 
 	if sink.cloudWatchPublishInterval == 0 {
@@ -136,24 +249,24 @@ func (p *Sink) Run(ctx context.Context) {
 
 // Flush the data to CloudWatch
 func (p *Sink) Flush(ctx context.Context) error {
-	data := p.Data()
-	total := len(data)
+	c := collectedPool.Get().(*collected)
+	defer c.release()
 
-	// 1000 is the max metrics per request
-	for len(data) > 1000 {
-		put := data[0:1000]
-		err := p.Publish(ctx, put)
-		if err != nil {
-			return err
+	p.collect(c)
+	total := len(c.data)
+
+	for start := 0; start < total; {
+		ns := c.namespace(start, p.cloudWatchNamespace)
+		end := start + 1
+		for end < total && c.namespace(end, p.cloudWatchNamespace) == ns {
+			end++
 		}
-		data = data[1000:]
-	}
 
-	if len(data) > 0 {
-		err := p.Publish(ctx, data)
+		err := publishBatches(ctx, p.Publisher, ns, c.data[start:end])
 		if err != nil {
 			return err
 		}
+		start = end
 	}
 	if total > 0 {
 		logger.KV(xlog.DEBUG, "status", "published", "count", total)
@@ -162,16 +275,52 @@ func (p *Sink) Flush(ctx context.Context) error {
 	return nil
 }
 
-func (p *Sink) flattenKey(key string, labels []metrics.Tag) (string, string) {
-	hash := key
-	for _, label := range labels {
-		hash += fmt.Sprintf(";%s=%s", label.Name, label.Value)
-	}
+// maxDimensions is the max number of dimensions supported by CloudWatch
+const maxDimensions = 10
 
-	return key, hash
+// overflowDropped returns true if the metric is over the dimensions limit,
+// and must be dropped with DimensionOverflowDrop, or panics with DimensionOverflowPanic
+func (p *Sink) overflowDropped(key string, tags []metrics.Tag) bool {
+	if len(tags) <= maxDimensions {
+		return false
+	}
+	switch p.overflow {
+	case DimensionOverflowPanic:
+		panic(fmt.Sprintf("metric %s has %d tags, over the limit of %d dimensions", key, len(tags), maxDimensions))
+	case DimensionOverflowDrop:
+		logger.KV(xlog.WARNING, "reason", "dimensions_overflow", "metric", key, "tags", len(tags))
+		return true
+	}
+	return false
 }
 
-func dimensions(labels []metrics.Tag) []types.Dimension {
+// dimensions returns the metric name and dimensions for the tags.
+// The tags are sorted by name, and only the first 10 are kept as dimensions,
+// the rest are dropped, or folded into the metric name with FoldDimensionOverflow.
+func (p *Sink) dimensions(key string, labels []metrics.Tag) (string, []types.Dimension) {
+	if len(labels) > maxDimensions {
+		labels = slices.Clone(labels)
+		slices.SortStableFunc(labels, func(a, b metrics.Tag) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		overflow := labels[maxDimensions:]
+		labels = labels[:maxDimensions]
+		if p.foldOverflow {
+			var sb strings.Builder
+			sb.WriteString(key)
+			for _, t := range overflow {
+				sb.WriteString(p.overflowSeparator)
+				sb.WriteString(t.Name)
+				sb.WriteString(p.overflowSeparator)
+				sb.WriteString(t.Value)
+			}
+			key = sb.String()
+		} else {
+			logger.KV(xlog.WARNING, "reason", "dimensions_overflow", "metric", key, "dropped", overflow)
+		}
+	}
+
 	ds := make([]types.Dimension, len(labels))
 	for idx, v := range labels {
 		ds[idx] = types.Dimension{
@@ -179,11 +328,7 @@ func dimensions(labels []metrics.Tag) []types.Dimension {
 			Value: aws.String(v.Value),
 		}
 	}
-
-	if len(ds) > 10 {
-		logger.Panicf("AWS does not support more than 10 dimentions: %v", ds)
-	}
-	return ds
+	return key, ds
 }
 
 const (
@@ -193,44 +338,73 @@ const (
 
 // SetGauge should retain the last value it is set to
 func (p *Sink) SetGauge(key string, val float64, tags []metrics.Tag) {
+	p.SetGaugeAt(key, val, time.Now(), tags)
+}
+
+// SetGaugeAt should retain the value with the provided timestamp.
+// The timestamp is replaced with the publish time, if StampAtPublish is set.
+func (p *Sink) SetGaugeAt(key string, val float64, ts time.Time, tags []metrics.Tag) {
+	if p.overflowDropped(key, tags) {
+		return
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	now := time.Now()
-	key, hash := p.flattenKey(key, tags)
-	p.updates[hash] = now
+	key, hash := metrics.FlattenKey(key, tags)
+	p.updates[hash] = time.Now()
 	g, ok := p.gauges[hash]
 	if !ok {
+		name, dims := p.dimensions(key, tags)
 		g = &types.MetricDatum{
 			Unit:              types.StandardUnitCount,
-			MetricName:        &key,
-			Timestamp:         aws.Time(now),
-			Dimensions:        dimensions(tags),
-			Value:             aws.Float64(float64(val)),
+			MetricName:        aws.String(name),
+			Timestamp:         aws.Time(ts),
+			Dimensions:        dims,
 			StorageResolution: aws.Int32(storageResolutionVal),
 		}
+		p.setGaugeValue(g, val)
 		p.gauges[hash] = g
+		p.checkThreshold()
 	} else {
-		g.Value = aws.Float64(float64(val))
-		g.Timestamp = aws.Time(now)
+		p.setGaugeValue(g, val)
+		g.Timestamp = aws.Time(ts)
 	}
 }
 
+// setGaugeValue sets the value of the gauge datum,
+// or the single sample StatisticSet with GaugeAsStatistic
+func (p *Sink) setGaugeValue(g *types.MetricDatum, val float64) {
+	if p.gaugeAsStatistic {
+		g.StatisticValues = &types.StatisticSet{
+			SampleCount: aws.Float64(oneVal),
+			Sum:         aws.Float64(val),
+			Minimum:     aws.Float64(val),
+			Maximum:     aws.Float64(val),
+		}
+		return
+	}
+	g.Value = aws.Float64(val)
+}
+
 // AddSample is for timing information, where quantiles are used
 func (p *Sink) AddSample(key string, val float64, tags []metrics.Tag) {
+	if p.overflowDropped(key, tags) {
+		return
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	now := time.Now()
 	val64 := float64(val)
 	valPtr := aws.Float64(val64)
-	key, hash := p.flattenKey(key, tags)
+	key, hash := metrics.FlattenKey(key, tags)
 	p.updates[hash] = now
 	g, ok := p.samples[hash]
 	if !ok {
+		name, dims := p.dimensions(key, tags)
 		g = &types.MetricDatum{
 			Unit:              types.StandardUnitCount,
-			MetricName:        aws.String(key),
+			MetricName:        aws.String(name),
 			Timestamp:         aws.Time(now),
-			Dimensions:        dimensions(tags),
+			Dimensions:        dims,
 			StorageResolution: aws.Int32(storageResolutionVal),
 			StatisticValues: &types.StatisticSet{
 				Minimum:     valPtr,
@@ -240,6 +414,7 @@ func (p *Sink) AddSample(key string, val float64, tags []metrics.Tag) {
 			},
 		}
 		p.samples[hash] = g
+		p.checkThreshold()
 	} else {
 		if val64 < *g.StatisticValues.Minimum {
 			g.StatisticValues.Minimum = valPtr
@@ -251,40 +426,147 @@ func (p *Sink) AddSample(key string, val float64, tags []metrics.Tag) {
 		g.StatisticValues.Sum = aws.Float64(*g.StatisticValues.Sum + val64)
 		g.Timestamp = aws.Time(now)
 	}
+	if p.distributionBins > 0 {
+		d := p.distributions[hash]
+		if d == nil {
+			d = &distribution{}
+			p.distributions[hash] = d
+		}
+		d.add(val64, p.distributionBins)
+	}
 }
 
 // IncrCounter should accumulate values
 func (p *Sink) IncrCounter(key string, val float64, tags []metrics.Tag) {
+	if p.overflowDropped(key, tags) {
+		return
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	now := time.Now()
-	key, hash := p.flattenKey(key, tags)
+	key, hash := metrics.FlattenKey(key, tags)
 	p.updates[hash] = now
 	g, ok := p.counters[hash]
 	if !ok {
+		name, dims := p.dimensions(key, tags)
 		g = &types.MetricDatum{
 			Unit:              types.StandardUnitCount,
-			MetricName:        aws.String(key),
+			MetricName:        aws.String(name),
 			Timestamp:         aws.Time(now),
-			Dimensions:        dimensions(tags),
+			Dimensions:        dims,
 			StorageResolution: aws.Int32(storageResolutionVal),
 			Value:             aws.Float64(float64(val)),
 		}
 		p.counters[hash] = g
+		p.checkThreshold()
 	} else {
 		g.Value = aws.Float64(*g.Value + float64(val))
 		g.Timestamp = aws.Time(now)
 	}
 }
 
+// checkThreshold starts Flush in background if FlushThreshold is reached,
+// must be called with the lock held
+func (p *Sink) checkThreshold() {
+	if p.flushThreshold <= 0 ||
+		len(p.counters)+len(p.gauges)+len(p.samples) < p.flushThreshold ||
+		!p.flushing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer p.flushing.Store(false)
+		logger.KV(xlog.DEBUG, "status", "flush_threshold")
+		err := p.Flush(context.Background())
+		if err != nil {
+			logger.KV(xlog.ERROR, "reason", "flush_threshold", "err", err)
+		}
+	}()
+}
+
 // Data returns collected metrics and allows us to enforce our expiration
 // logic to clean up ephemeral metrics if their value haven't been set for a
 // duration exceeding our allowed expiration time.
 func (p *Sink) Data() []types.MetricDatum {
+	c := &collected{}
+	p.collect(c)
+	return c.data
+}
+
+// DataByNamespace returns collected metrics grouped by the resolved namespace,
+// see Data for the expiration logic.
+func (p *Sink) DataByNamespace() map[string][]types.MetricDatum {
+	c := &collected{}
+	p.collect(c)
+
+	groups := make(map[string][]types.MetricDatum)
+	for idx, d := range c.data {
+		ns := c.namespace(idx, p.cloudWatchNamespace)
+		groups[ns] = append(groups[ns], d)
+	}
+	return groups
+}
+
+// collected is a buffer of the collected metrics,
+// it is reused by Flush to reduce allocations
+type collected struct {
+	data []types.MetricDatum
+	// namespaces is set only with NamespaceFn, parallel to data
+	namespaces []string
+}
+
+var collectedPool = sync.Pool{
+	New: func() any { return &collected{} },
+}
+
+// namespace returns the namespace of the datum at idx
+func (c *collected) namespace(idx int, def string) string {
+	if len(c.namespaces) == 0 {
+		return def
+	}
+	return c.namespaces[idx]
+}
+
+// release clears the references to the metrics and returns the buffer to the pool
+func (c *collected) release() {
+	clear(c.data)
+	c.data = c.data[:0]
+	c.namespaces = c.namespaces[:0]
+	collectedPool.Put(c)
+}
+
+func (c *collected) Len() int           { return len(c.data) }
+func (c *collected) Less(i, j int) bool { return c.namespaces[i] < c.namespaces[j] }
+func (c *collected) Swap(i, j int) {
+	c.data[i], c.data[j] = c.data[j], c.data[i]
+	c.namespaces[i], c.namespaces[j] = c.namespaces[j], c.namespaces[i]
+}
+
+// sampleNames are the names of the _count, _sum and _avg metrics,
+// created once per sample to not allocate on each Flush
+type sampleNames struct {
+	count *string
+	sum   *string
+	avg   *string
+}
+
+// collect appends the metrics to c, sorted by namespace
+func (p *Sink) collect(c *collected) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	data := make([]types.MetricDatum, 0, len(p.counters)+len(p.gauges)+len(p.samples))
+	size := len(c.data) + len(p.counters) + len(p.gauges) + len(p.samples)
+	if p.withSampleCount {
+		size += 3 * len(p.samples)
+	}
+	c.data = slices.Grow(c.data, size)
+
+	add := func(v *types.MetricDatum, ns string) {
+		c.data = append(c.data, *v)
+		if p.namespaceFn != nil {
+			c.namespaces = append(c.namespaces, ns)
+		}
+	}
 
 	expire := p.expiration != 0
 	now := time.Now()
@@ -294,7 +576,7 @@ func (p *Sink) Data() []types.MetricDatum {
 			delete(p.updates, k)
 			delete(p.gauges, k)
 		} else {
-			data = append(data, *v)
+			add(v, p.namespace(v))
 			if p.withCleanup {
 				delete(p.updates, k)
 				delete(p.gauges, k)
@@ -306,37 +588,55 @@ func (p *Sink) Data() []types.MetricDatum {
 		if expire && last.Add(p.expiration).Before(now) {
 			delete(p.updates, k)
 			delete(p.samples, k)
+			delete(p.sampleNames, k)
+			delete(p.distributions, k)
 		} else {
-			data = append(data, *v)
-			if p.withCleanup {
-				delete(p.updates, k)
-				delete(p.samples, k)
+			ns := p.namespace(v)
+			if d := p.distributions[k]; d != nil {
+				add(d.datum(v), ns)
+			} else {
+				add(v, ns)
 			}
 			if p.withSampleCount {
-				data = append(data, types.MetricDatum{
+				names := p.sampleNames[k]
+				if names == nil {
+					names = &sampleNames{
+						count: aws.String(*v.MetricName + "_count"),
+						sum:   aws.String(*v.MetricName + "_sum"),
+						avg:   aws.String(*v.MetricName + "_avg"),
+					}
+					p.sampleNames[k] = names
+				}
+				add(&types.MetricDatum{
 					Unit:              v.Unit,
-					MetricName:        aws.String(*v.MetricName + "_count"),
+					MetricName:        names.count,
 					Timestamp:         v.Timestamp,
 					Dimensions:        v.Dimensions,
 					StorageResolution: v.StorageResolution,
 					Value:             v.StatisticValues.SampleCount,
-				})
-				data = append(data, types.MetricDatum{
+				}, ns)
+				add(&types.MetricDatum{
 					Unit:              v.Unit,
-					MetricName:        aws.String(*v.MetricName + "_sum"),
+					MetricName:        names.sum,
 					Timestamp:         v.Timestamp,
 					Dimensions:        v.Dimensions,
 					StorageResolution: v.StorageResolution,
 					Value:             v.StatisticValues.Sum,
-				})
-				data = append(data, types.MetricDatum{
+				}, ns)
+				add(&types.MetricDatum{
 					Unit:              v.Unit,
-					MetricName:        aws.String(*v.MetricName + "_avg"),
+					MetricName:        names.avg,
 					Timestamp:         v.Timestamp,
 					Dimensions:        v.Dimensions,
 					StorageResolution: v.StorageResolution,
 					Value:             aws.Float64(*v.StatisticValues.Sum / *v.StatisticValues.SampleCount),
-				})
+				}, ns)
+			}
+			if p.withCleanup {
+				delete(p.updates, k)
+				delete(p.samples, k)
+				delete(p.sampleNames, k)
+				delete(p.distributions, k)
 			}
 		}
 	}
@@ -346,27 +646,98 @@ func (p *Sink) Data() []types.MetricDatum {
 			delete(p.updates, k)
 			delete(p.counters, k)
 		} else {
-			data = append(data, *v)
+			add(v, p.namespace(v))
 			if p.withCleanup {
 				delete(p.updates, k)
 				delete(p.counters, k)
 			}
 		}
 	}
-	return data
+
+	if p.stampAtPublish {
+		ts := aws.Time(now)
+		for idx := range c.data {
+			c.data[idx].Timestamp = ts
+		}
+	}
+	if p.namespaceFn != nil {
+		sort.Stable(c)
+	}
 }
 
-// Publish metrics
+// namespace returns the namespace for the datum
+func (p *Sink) namespace(v *types.MetricDatum) string {
+	if p.namespaceFn == nil {
+		return p.cloudWatchNamespace
+	}
+	tags := make([]metrics.Tag, len(v.Dimensions))
+	for idx, d := range v.Dimensions {
+		tags[idx] = metrics.Tag{Name: aws.ToString(d.Name), Value: aws.ToString(d.Value)}
+	}
+	return values.Coalesce(p.namespaceFn(aws.ToString(v.MetricName), tags), p.cloudWatchNamespace)
+}
+
+// Publish metrics to the default namespace
 func (p *Sink) Publish(ctx context.Context, data []types.MetricDatum) error {
+	return publish(ctx, p.Publisher, p.cloudWatchNamespace, data)
+}
+
+const (
+	// maxPublishCount is the max metrics per request
+	maxPublishCount = 1000
+	// maxPublishPayload is the estimated payload size to split the batches at,
+	// below the limit of 1MB per request to leave room for the estimation error
+	maxPublishPayload = 900 * 1024
+	// datumOverhead is the estimated size of the field names and the values of a datum
+	datumOverhead = 400
+	// dimensionOverhead is the estimated size of the field names of a dimension
+	dimensionOverhead = 100
+	// distributionValueSize is the estimated size of a value and count of a distribution
+	distributionValueSize = 100
+)
+
+// publishBatches publishes the metrics in batches of the max count and payload size per request
+func publishBatches(ctx context.Context, pub Publisher, namespace string, data []types.MetricDatum) error {
+	for len(data) > 0 {
+		count := 1
+		size := datumSize(&data[0])
+		for count < len(data) && count < maxPublishCount {
+			next := datumSize(&data[count])
+			if size+next > maxPublishPayload {
+				break
+			}
+			size += next
+			count++
+		}
+		err := publish(ctx, pub, namespace, data[:count])
+		if err != nil {
+			return err
+		}
+		data = data[count:]
+	}
+	return nil
+}
+
+// datumSize returns the estimated size of the datum in the request payload
+func datumSize(d *types.MetricDatum) int {
+	size := datumOverhead + len(aws.ToString(d.MetricName))
+	for _, dim := range d.Dimensions {
+		size += dimensionOverhead + len(aws.ToString(dim.Name)) + len(aws.ToString(dim.Value))
+	}
+	return size + distributionValueSize*len(d.Values)
+}
+
+func publish(ctx context.Context, pub Publisher, namespace string, data []types.MetricDatum) error {
 	if len(data) > 0 {
 		in := &cloudwatch.PutMetricDataInput{
 			MetricData: data,
-			Namespace:  &p.cloudWatchNamespace,
+			Namespace:  aws.String(namespace),
 		}
-		_, err := p.Publisher.PutMetricData(ctx, in)
+		_, err := pub.PutMetricData(ctx, in)
 		if err != nil {
 			logger.KV(xlog.ERROR,
 				"reason", "publish",
+				"namespace", namespace,
 				"data", data,
 				"err", err.Error())
 			return errors.Wrap(err, "failed to publish metrics")
@@ -375,28 +746,55 @@ func (p *Sink) Publish(ctx context.Context, data []types.MetricDatum) error {
 	return nil
 }
 
+// HealthCheck returns an error if CloudWatch is not reachable.
+// It is no-op if the Publisher does not support ListMetrics.
+func (p *Sink) HealthCheck(ctx context.Context) error {
+	lister, ok := p.Publisher.(metricsLister)
+	if !ok {
+		return nil
+	}
+	_, err := lister.ListMetrics(ctx, &cloudwatch.ListMetricsInput{
+		Namespace: aws.String(p.cloudWatchNamespace),
+	})
+	if err != nil {
+		return errors.Wrap(err, "cloudwatch health check failed")
+	}
+	return nil
+}
+
 func newPublisher(c *Config) (Publisher, error) {
 	if c.Namespace == "" {
 		return nil, errors.New("CloudWatchNamespace required")
 	}
 
+	if c.Transport == TransportFirehose {
+		if c.FirehoseClient == nil || c.FirehoseStream == "" {
+			return nil, errors.New("FirehoseClient and FirehoseStream required")
+		}
+		return NewFirehosePublisher(c.FirehoseClient, c.FirehoseStream), nil
+	}
+
 	region := values.Coalesce(c.AwsRegion, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
-	if region == "" {
+	if region == "" && c.RequireExplicitRegion {
 		return nil, errors.New("CloudWatchRegion required")
 	}
 
-	awsops := []func(*awsconfig.LoadOptions) error{
-		awsconfig.WithRegion(region),
+	var awsops []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		awsops = append(awsops, awsconfig.WithRegion(region))
+	} else {
+		// let the default config to resolve the region from the shared config or EC2 IMDS
+		awsops = append(awsops, awsconfig.WithEC2IMDSRegion())
 	}
 
 	if c.AwsEndpoint != "" {
 		// https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/endpoints/
 		customResolver := aws.EndpointResolverWithOptionsFunc(func(svc, reg string, _ ...any) (aws.Endpoint, error) {
-			if svc == cloudwatch.ServiceID && reg == region {
+			if svc == cloudwatch.ServiceID && (region == "" || reg == region) {
 				ep := aws.Endpoint{
 					PartitionID:   "aws",
 					URL:           c.AwsEndpoint,
-					SigningRegion: region,
+					SigningRegion: reg,
 				}
 				return ep, nil
 			}
@@ -413,12 +811,17 @@ func newPublisher(c *Config) (Publisher, error) {
 		awsops = append(awsops, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(id, secret, token)))
 	}
 
+	awsops = append(awsops, c.ConfigOptions...)
+
 	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsops...)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if cfg.Region == "" {
+		return nil, errors.New("CloudWatchRegion required")
+	}
 
-	p := cloudwatch.NewFromConfig(cfg)
+	p := cloudwatch.NewFromConfig(cfg, c.ClientOptions...)
 
 	return p, nil
 }
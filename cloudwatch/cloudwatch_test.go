@@ -2,23 +2,43 @@ package cloudwatch_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	awscloudwatch "github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
 	"github.com/effective-security/metrics"
 	"github.com/effective-security/metrics/cloudwatch"
+	"github.com/effective-security/metrics/metricstest"
 	"github.com/effective-security/xlog"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestSinkInterface(t *testing.T) {
-	var ps *cloudwatch.Sink
-	_ = metrics.Sink(ps)
+func TestSinkConformance(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	metricstest.SinkConformance(t, s)
+
+	require.NoError(t, s.Flush(context.Background()))
+	assert.NotEmpty(t, mock.data)
 }
 
 func Test_Sink(t *testing.T) {
@@ -30,7 +50,8 @@ func Test_Sink(t *testing.T) {
 	assert.EqualError(t, err, "CloudWatchNamespace required")
 
 	cfg = cloudwatch.Config{
-		Namespace: "es",
+		Namespace:             "es",
+		RequireExplicitRegion: true,
 	}
 	_, err = cloudwatch.NewSink(&cfg)
 	assert.EqualError(t, err, "CloudWatchRegion required")
@@ -69,16 +90,693 @@ func Test_Sink(t *testing.T) {
 	assert.NoError(t, err)
 
 	cancel()
+	assert.NotEmpty(t, mock.data)
+}
+
+func Test_SinkRegionFromSharedConfig(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	cfgFile := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(cfgFile, []byte("[default]\nregion = us-east-2\n"), 0600))
+	t.Setenv("AWS_CONFIG_FILE", cfgFile)
+
+	cfg := cloudwatch.Config{
+		Namespace: "es",
+	}
+	s, err := cloudwatch.NewSink(&cfg)
+	require.NoError(t, err)
+	assert.NotNil(t, s.Publisher)
+
+	cfg.RequireExplicitRegion = true
+	_, err = cloudwatch.NewSink(&cfg)
+	assert.EqualError(t, err, "CloudWatchRegion required")
+}
+
+func Test_SinkNamespaceFn(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:       "us-west-2",
+		Namespace:       "app",
+		WithSampleCount: true,
+		NamespaceFn: func(key string, tags []metrics.Tag) string {
+			if strings.HasPrefix(key, "infra_") {
+				return "infra"
+			}
+			return ""
+		},
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	s.IncrCounter("app_counter", 1, tags)
+	s.SetGauge("infra_gauge", 1, tags)
+	s.AddSample("infra_sample", 1, nil)
+
+	groups := s.DataByNamespace()
+	require.Len(t, groups, 2)
+	assert.Len(t, groups["app"], 1)
+	assert.Len(t, groups["infra"], 5)
+
+	require.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, []string{"app", "infra"}, mock.namespaces)
 	assert.Len(t, mock.data, 6)
 }
 
+func Test_SinkStampAtPublish(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:       "us-west-2",
+		Namespace:       "es",
+		WithSampleCount: true,
+		StampAtPublish:  true,
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	s.SetGauge("test_gauge", 1, nil)
+	s.IncrCounter("test_counter", 1, nil)
+	s.AddSample("test_sample", 1, nil)
+
+	time.Sleep(50 * time.Millisecond)
+	flushed := time.Now()
+	require.NoError(t, s.Flush(context.Background()))
+	require.Len(t, mock.data, 6)
+	for _, d := range mock.data {
+		require.NotNil(t, d.Timestamp)
+		assert.False(t, d.Timestamp.Before(flushed), "%s: %v", *d.MetricName, *d.Timestamp)
+	}
+}
+
+func Test_SinkSetGaugeAt(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, s)
+	require.NoError(t, err)
+
+	ts := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	prov.SetGaugeAt("test_backfill", 3, ts)
+	prov.SetGauge("test_gauge", 1)
+
+	require.NoError(t, s.Flush(context.Background()))
+	require.Len(t, mock.data, 2)
+	for _, d := range mock.data {
+		require.NotNil(t, d.Timestamp)
+		if *d.MetricName == "test_backfill" {
+			assert.Equal(t, ts, *d.Timestamp)
+			assert.Equal(t, float64(3), *d.Value)
+		} else {
+			assert.True(t, d.Timestamp.After(ts))
+		}
+	}
+}
+
+func Test_SinkGaugeAsStatistic(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:        "us-west-2",
+		Namespace:        "es",
+		GaugeAsStatistic: true,
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, s)
+	require.NoError(t, err)
+
+	prov.SetGauge("test_gauge", 1)
+	prov.SetGauge("test_gauge", 5)
+
+	require.NoError(t, s.Flush(context.Background()))
+	require.Len(t, mock.data, 1)
+	d := mock.data[0]
+	assert.Nil(t, d.Value)
+	require.NotNil(t, d.StatisticValues)
+	assert.Equal(t, float64(1), *d.StatisticValues.SampleCount)
+	assert.Equal(t, float64(5), *d.StatisticValues.Sum)
+	assert.Equal(t, float64(5), *d.StatisticValues.Minimum)
+	assert.Equal(t, float64(5), *d.StatisticValues.Maximum)
+}
+
+func Test_SinkFlushThreshold(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:       "us-west-2",
+		Namespace:       "es",
+		PublishInterval: time.Hour,
+		WithCleanup:     true,
+		FlushThreshold:  5,
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	for i := 0; i < 4; i++ {
+		s.SetGauge(fmt.Sprintf("test_gauge_%d", i), 1, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mock.published())
+
+	s.IncrCounter("test_counter", 1, nil)
+	assert.Eventually(t, func() bool {
+		return len(mock.published()) == 5
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, s.Data())
+}
+
+func Test_SinkSDKOptions(t *testing.T) {
+	loaded := false
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+		ConfigOptions: []func(*awsconfig.LoadOptions) error{
+			func(o *awsconfig.LoadOptions) error {
+				loaded = true
+				o.Region = "eu-west-1"
+				return nil
+			},
+		},
+		ClientOptions: []func(*awscloudwatch.Options){
+			func(o *awscloudwatch.Options) {
+				o.BaseEndpoint = aws.String("http://localhost:4566")
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, loaded)
+
+	client, ok := s.Publisher.(*awscloudwatch.Client)
+	require.True(t, ok)
+	opts := client.Options()
+	assert.Equal(t, "eu-west-1", opts.Region)
+	assert.Equal(t, "http://localhost:4566", aws.ToString(opts.BaseEndpoint))
+}
+
 type mockPublisher struct {
-	data []types.MetricDatum
-	t    *testing.T
+	lock       sync.Mutex
+	data       []types.MetricDatum
+	namespaces []string
+	t          *testing.T
+}
+
+func (m *mockPublisher) published() []types.MetricDatum {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.data
 }
 
 func (m *mockPublisher) PutMetricData(ctx context.Context, in *awscloudwatch.PutMetricDataInput, optFns ...func(*awscloudwatch.Options)) (*awscloudwatch.PutMetricDataOutput, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.t.Logf("received %d", len(in.MetricData))
 	m.data = append(m.data, in.MetricData...)
+	m.namespaces = append(m.namespaces, *in.Namespace)
+	return &awscloudwatch.PutMetricDataOutput{}, nil
+}
+
+type listerPublisher struct {
+	*mockPublisher
+	err error
+}
+
+func (m *listerPublisher) ListMetrics(ctx context.Context, in *awscloudwatch.ListMetricsInput, optFns ...func(*awscloudwatch.Options)) (*awscloudwatch.ListMetricsOutput, error) {
+	return &awscloudwatch.ListMetricsOutput{}, m.err
+}
+
+func Test_SinkHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+	})
+	require.NoError(t, err)
+
+	// the mock does not support ListMetrics
+	s.Publisher = &mockPublisher{t: t}
+	assert.NoError(t, s.HealthCheck(ctx))
+
+	lister := &listerPublisher{mockPublisher: &mockPublisher{t: t}}
+	s.Publisher = lister
+	assert.NoError(t, s.HealthCheck(ctx))
+
+	prov, err := metrics.New(&metrics.Config{}, s)
+	require.NoError(t, err)
+	assert.NoError(t, prov.HealthCheck(ctx))
+
+	lister.err = errors.New("dial tcp: connection refused")
+	assert.EqualError(t, s.HealthCheck(ctx), "cloudwatch health check failed: dial tcp: connection refused")
+	assert.Error(t, prov.HealthCheck(ctx))
+}
+
+func Test_SinkDimensionsOverflow(t *testing.T) {
+	var tags []metrics.Tag
+	// reversed order to check sorting
+	for i := 12; i > 0; i-- {
+		tags = append(tags, metrics.Tag{Name: fmt.Sprintf("tag%02d", i), Value: fmt.Sprintf("val%d", i)})
+	}
+
+	dimensionNames := func(d types.MetricDatum) []string {
+		var names []string
+		for _, dim := range d.Dimensions {
+			names = append(names, *dim.Name)
+		}
+		return names
+	}
+	expected := []string{"tag01", "tag02", "tag03", "tag04", "tag05", "tag06", "tag07", "tag08", "tag09", "tag10"}
+
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+	})
+	require.NoError(t, err)
+	s.IncrCounter("test_counter", 1, tags)
+	data := s.Data()
+	require.Len(t, data, 1)
+	assert.Equal(t, "test_counter", *data[0].MetricName)
+	assert.Equal(t, expected, dimensionNames(data[0]))
+	// the provided tags are not modified
+	assert.Equal(t, "tag12", tags[0].Name)
+
+	s, err = cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:             "us-west-2",
+		Namespace:             "es",
+		FoldDimensionOverflow: true,
+	})
+	require.NoError(t, err)
+	s.SetGauge("test_gauge", 1, tags)
+	data = s.Data()
+	require.Len(t, data, 1)
+	assert.Equal(t, "test_gauge.tag11.val11.tag12.val12", *data[0].MetricName)
+	assert.Equal(t, expected, dimensionNames(data[0]))
+
+	s, err = cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:         "us-west-2",
+		Namespace:         "es",
+		DimensionOverflow: cloudwatch.DimensionOverflowTruncate,
+	})
+	require.NoError(t, err)
+	s.AddSample("test_sample", 1, tags)
+	data = s.Data()
+	require.Len(t, data, 1)
+	assert.Equal(t, "test_sample", *data[0].MetricName)
+	assert.Equal(t, expected, dimensionNames(data[0]))
+
+	s, err = cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:         "us-west-2",
+		Namespace:         "es",
+		DimensionOverflow: cloudwatch.DimensionOverflowDrop,
+	})
+	require.NoError(t, err)
+	s.IncrCounter("test_counter", 1, tags)
+	s.SetGauge("test_gauge", 1, tags)
+	s.AddSample("test_sample", 1, tags)
+	assert.Empty(t, s.Data())
+	s.IncrCounter("test_counter", 1, tags[:10])
+	assert.Len(t, s.Data(), 1)
+
+	s, err = cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:         "us-west-2",
+		Namespace:         "es",
+		DimensionOverflow: cloudwatch.DimensionOverflowPanic,
+	})
+	require.NoError(t, err)
+	assert.Panics(t, func() {
+		s.SetGauge("test_gauge", 1, tags)
+	})
+	assert.NotPanics(t, func() {
+		s.SetGauge("test_gauge", 1, tags[:10])
+	})
+}
+
+func Test_SinkSampleDistribution(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:              "us-west-2",
+		Namespace:              "es",
+		SampleDistributionBins: 2,
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	// bimodal distribution around 10 and 1000
+	for i := 0; i < 50; i++ {
+		s.AddSample("test_latency", 9.5+float64(i%3)*0.5, nil)
+		s.AddSample("test_latency", 990+float64(i%5)*5, nil)
+	}
+
+	require.NoError(t, s.Flush(context.Background()))
+	require.Len(t, mock.data, 1)
+	d := mock.data[0]
+	assert.Nil(t, d.StatisticValues)
+	assert.Nil(t, d.Value)
+	require.Len(t, d.Values, 2)
+	assert.Equal(t, []float64{50, 50}, d.Counts)
+	assert.InDelta(t, 10, d.Values[0], 0.5)
+	assert.InDelta(t, 1000, d.Values[1], 5)
+
+	// the bins are limited by CloudWatch
+	s, err = cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:              "us-west-2",
+		Namespace:              "es",
+		SampleDistributionBins: 1000,
+	})
+	require.NoError(t, err)
+	mock = &mockPublisher{t: t}
+	s.Publisher = mock
+	for i := 0; i < 200; i++ {
+		s.AddSample("test_latency", float64(i), nil)
+	}
+	require.NoError(t, s.Flush(context.Background()))
+	require.Len(t, mock.data, 1)
+	assert.Len(t, mock.data[0].Values, 150)
+	assert.Len(t, mock.data[0].Counts, 150)
+}
+
+func Test_SinkSampleCount(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:       "us-west-2",
+		Namespace:       "es",
+		WithSampleCount: true,
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	s.Publisher = mock
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	s.AddSample("test_sample", 1, tags)
+	s.AddSample("test_sample", 3, tags)
+
+	values := func(data []types.MetricDatum) map[string]float64 {
+		res := map[string]float64{}
+		for _, d := range data {
+			assert.Len(t, d.Dimensions, 1)
+			if d.StatisticValues != nil {
+				res[*d.MetricName] = *d.StatisticValues.Sum
+			} else {
+				res[*d.MetricName] = *d.Value
+			}
+		}
+		return res
+	}
+	expected := map[string]float64{
+		"test_sample":       4,
+		"test_sample_count": 2,
+		"test_sample_sum":   4,
+		"test_sample_avg":   2,
+	}
+
+	// the output does not change on the next flush with the cached names
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, expected, values(s.Data()))
+
+		mock.data = nil
+		require.NoError(t, s.Flush(context.Background()))
+		assert.Equal(t, expected, values(mock.data))
+	}
+}
+
+type nopPublisher struct{}
+
+func (nopPublisher) PutMetricData(ctx context.Context, in *awscloudwatch.PutMetricDataInput, optFns ...func(*awscloudwatch.Options)) (*awscloudwatch.PutMetricDataOutput, error) {
 	return &awscloudwatch.PutMetricDataOutput{}, nil
 }
+
+func BenchmarkSink_Flush(b *testing.B) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion:       "us-west-2",
+		Namespace:       "es",
+		WithSampleCount: true,
+	})
+	require.NoError(b, err)
+	s.Publisher = nopPublisher{}
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	for i := 0; i < 1000; i++ {
+		s.SetGauge(fmt.Sprintf("test_gauge_%d", i), 1, tags)
+		s.IncrCounter(fmt.Sprintf("test_counter_%d", i), 1, tags)
+		s.AddSample(fmt.Sprintf("test_sample_%d", i), 1, tags)
+	}
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = s.Flush(ctx)
+	}
+}
+
+func Test_FromInmem(t *testing.T) {
+	inm := metrics.NewInmemSink(100*time.Millisecond, time.Minute)
+
+	_, err := cloudwatch.FromInmem(inm, &cloudwatch.Config{})
+	assert.EqualError(t, err, "CloudWatchNamespace required")
+
+	b, err := cloudwatch.FromInmem(inm, &cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	b.Publisher = mock
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	inm.SetGauge("test_gauge", 42, tags)
+	inm.IncrCounter("test_counter", 1, tags)
+	inm.IncrCounter("test_counter", 2, tags)
+	inm.AddSample("test_sample", 1, tags)
+	inm.AddSample("test_sample", 5, tags)
+
+	// the current interval is not published
+	require.NoError(t, b.Flush(context.Background()))
+	assert.Empty(t, mock.published())
+
+	time.Sleep(250 * time.Millisecond)
+	require.NoError(t, b.Flush(context.Background()))
+
+	// the metrics may be split between two intervals
+	totals := map[string]float64{}
+	for _, d := range mock.published() {
+		require.Len(t, d.Dimensions, 1)
+		assert.Equal(t, "tag1", *d.Dimensions[0].Name)
+		if d.StatisticValues != nil {
+			totals[*d.MetricName+"_count"] += *d.StatisticValues.SampleCount
+			totals[*d.MetricName+"_sum"] += *d.StatisticValues.Sum
+		} else {
+			totals[*d.MetricName] += *d.Value
+		}
+	}
+	assert.Equal(t, float64(3), totals["test_counter"])
+	assert.Equal(t, float64(2), totals["test_sample_count"])
+	assert.Equal(t, float64(6), totals["test_sample_sum"])
+	assert.Contains(t, totals, "test_gauge")
+
+	// already published intervals are skipped
+	count := len(mock.published())
+	require.NoError(t, b.Flush(context.Background()))
+	assert.Len(t, mock.published(), count)
+}
+
+func Test_FromInmemStop(t *testing.T) {
+	inm := metrics.NewInmemSink(time.Minute, time.Hour)
+	b, err := cloudwatch.FromInmem(inm, &cloudwatch.Config{
+		AwsRegion:       "us-west-2",
+		Namespace:       "es",
+		PublishInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	mock := &mockPublisher{t: t}
+	b.Publisher = mock
+
+	inm.IncrCounter("test_counter", 3, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	// the current interval is published on stop
+	published := mock.published()
+	require.Len(t, published, 1)
+	assert.Equal(t, "test_counter", *published[0].MetricName)
+	assert.Equal(t, float64(3), *published[0].Value)
+}
+
+type mockFirehose struct {
+	lock    sync.Mutex
+	stream  string
+	batches [][][]byte
+	// failures is the number of calls to fail the first record in
+	failures int
+}
+
+func (m *mockFirehose) PutRecordBatch(ctx context.Context, in *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stream = aws.ToString(in.DeliveryStreamName)
+
+	res := &firehose.PutRecordBatchOutput{
+		FailedPutCount:   aws.Int32(0),
+		RequestResponses: make([]fhtypes.PutRecordBatchResponseEntry, len(in.Records)),
+	}
+	var batch [][]byte
+	for i, r := range in.Records {
+		if i == 0 && m.failures > 0 {
+			m.failures--
+			res.FailedPutCount = aws.Int32(1)
+			res.RequestResponses[i].ErrorCode = aws.String("ServiceUnavailableException")
+			continue
+		}
+		batch = append(batch, r.Data)
+	}
+	m.batches = append(m.batches, batch)
+	return res, nil
+}
+
+func Test_SinkFirehose(t *testing.T) {
+	_, err := cloudwatch.NewSink(&cloudwatch.Config{
+		Namespace: "es",
+		Transport: cloudwatch.TransportFirehose,
+	})
+	assert.EqualError(t, err, "FirehoseClient and FirehoseStream required")
+
+	fh := &mockFirehose{}
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		Namespace:      "es",
+		Transport:      cloudwatch.TransportFirehose,
+		FirehoseClient: fh,
+		FirehoseStream: "metrics",
+	})
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	for i := 0; i < 1200; i++ {
+		s.IncrCounter(fmt.Sprintf("test_counter_%d", i), 1, tags)
+	}
+	s.AddSample("test_sample", 1, tags)
+	s.AddSample("test_sample", 3, tags)
+	require.NoError(t, s.Flush(context.Background()))
+
+	assert.Equal(t, "metrics", fh.stream)
+	records := 0
+	var sample map[string]any
+	for _, b := range fh.batches {
+		assert.LessOrEqual(t, len(b), 500)
+		records += len(b)
+		for _, rec := range b {
+			require.True(t, strings.HasSuffix(string(rec), "\n"))
+			var m map[string]any
+			require.NoError(t, json.Unmarshal(rec, &m))
+			assert.Equal(t, "es", m["namespace"])
+			assert.Equal(t, map[string]any{"tag1": "val1"}, m["dimensions"])
+			if m["metric_name"] == "test_sample" {
+				sample = m
+			}
+		}
+	}
+	assert.Equal(t, 1201, records)
+	require.NotNil(t, sample)
+	assert.Equal(t, map[string]any{"max": 3.0, "min": 1.0, "sum": 4.0, "count": 2.0}, sample["value"])
+}
+
+func Test_FirehosePublisherFailedRecords(t *testing.T) {
+	in := &awscloudwatch.PutMetricDataInput{
+		Namespace: aws.String("es"),
+		MetricData: []types.MetricDatum{
+			{MetricName: aws.String("m1"), Value: aws.Float64(1)},
+			{MetricName: aws.String("m2"), Value: aws.Float64(2)},
+		},
+	}
+
+	// the failed record is retried
+	fh := &mockFirehose{failures: 2}
+	p := cloudwatch.NewFirehosePublisher(fh, "metrics")
+	_, err := p.PutMetricData(context.Background(), in)
+	require.NoError(t, err)
+	assert.Len(t, fh.batches, 3)
+	records := 0
+	for _, b := range fh.batches {
+		records += len(b)
+	}
+	assert.Equal(t, 2, records)
+	assert.Equal(t, uint64(0), p.Failed())
+
+	// the record is counted as failed after the retries
+	fh = &mockFirehose{failures: 10}
+	p = cloudwatch.NewFirehosePublisher(fh, "metrics")
+	_, err = p.PutMetricData(context.Background(), in)
+	require.NoError(t, err)
+	assert.Len(t, fh.batches, 3)
+	assert.Equal(t, uint64(1), p.Failed())
+}
+
+// batchPublisher records the size of each published batch
+type batchPublisher struct {
+	batches [][]types.MetricDatum
+}
+
+func (m *batchPublisher) PutMetricData(ctx context.Context, in *awscloudwatch.PutMetricDataInput, optFns ...func(*awscloudwatch.Options)) (*awscloudwatch.PutMetricDataOutput, error) {
+	m.batches = append(m.batches, in.MetricData)
+	return &awscloudwatch.PutMetricDataOutput{}, nil
+}
+
+func Test_SinkFlushPayloadSize(t *testing.T) {
+	s, err := cloudwatch.NewSink(&cloudwatch.Config{
+		AwsRegion: "us-west-2",
+		Namespace: "es",
+	})
+	require.NoError(t, err)
+	pub := &batchPublisher{}
+	s.Publisher = pub
+
+	// each datum has over 10KB of dimensions
+	var tags []metrics.Tag
+	for i := 0; i < 10; i++ {
+		tags = append(tags, metrics.Tag{Name: fmt.Sprintf("tag%d", i), Value: strings.Repeat("v", 1000)})
+	}
+	for i := 0; i < 300; i++ {
+		s.SetGauge(fmt.Sprintf("test_gauge_%d", i), 1, tags)
+	}
+	require.NoError(t, s.Flush(context.Background()))
+
+	require.Greater(t, len(pub.batches), 3)
+	total := 0
+	for _, b := range pub.batches {
+		size := 0
+		for _, d := range b {
+			for _, dim := range d.Dimensions {
+				size += len(aws.ToString(dim.Name)) + len(aws.ToString(dim.Value))
+			}
+		}
+		assert.Less(t, size, 1024*1024)
+		total += len(b)
+	}
+	assert.Equal(t, 300, total)
+
+	// the small datums are batched by count
+	for i := 0; i < 2500; i++ {
+		s.IncrCounter(fmt.Sprintf("test_counter_%d", i), 1, nil)
+	}
+	pub.batches = nil
+	require.NoError(t, s.Flush(context.Background()))
+	total = 0
+	for _, b := range pub.batches {
+		assert.LessOrEqual(t, len(b), 1000)
+		total += len(b)
+	}
+	assert.Equal(t, 2800, total)
+}
@@ -0,0 +1,53 @@
+package cloudwatch
+
+import (
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// maxDistributionValues is the CloudWatch limit of the Values in a datum
+const maxDistributionValues = 150
+
+// distribution is a streaming histogram of the sample values,
+// the closest values are merged when the number of bins is exceeded
+type distribution struct {
+	values []float64 // sorted
+	counts []float64
+}
+
+func (d *distribution) add(v float64, bins int) {
+	i, found := slices.BinarySearch(d.values, v)
+	if found {
+		d.counts[i]++
+		return
+	}
+	d.values = slices.Insert(d.values, i, v)
+	d.counts = slices.Insert(d.counts, i, 1)
+	if len(d.values) <= bins {
+		return
+	}
+
+	// merge the closest adjacent values into their weighted mean
+	m := 0
+	for j := 1; j < len(d.values)-1; j++ {
+		if d.values[j+1]-d.values[j] < d.values[m+1]-d.values[m] {
+			m = j
+		}
+	}
+	count := d.counts[m] + d.counts[m+1]
+	d.values[m] = (d.values[m]*d.counts[m] + d.values[m+1]*d.counts[m+1]) / count
+	d.counts[m] = count
+	d.values = slices.Delete(d.values, m+1, m+2)
+	d.counts = slices.Delete(d.counts, m+1, m+2)
+}
+
+// datum returns the copy of the sample datum with the Values and Counts,
+// as CloudWatch does not accept them with StatisticValues
+func (d *distribution) datum(sample *types.MetricDatum) *types.MetricDatum {
+	dd := *sample
+	dd.StatisticValues = nil
+	dd.Values = slices.Clone(d.values)
+	dd.Counts = slices.Clone(d.counts)
+	return &dd
+}
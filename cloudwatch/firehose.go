@@ -0,0 +1,202 @@
+package cloudwatch
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/effective-security/xlog"
+	"github.com/pkg/errors"
+)
+
+// Transport specifies how the metrics are delivered to CloudWatch
+type Transport int
+
+const (
+	// TransportPutMetricData calls the CloudWatch PutMetricData API, the default
+	TransportPutMetricData Transport = iota
+	// TransportFirehose writes the metrics as JSON records to a Kinesis Firehose delivery stream,
+	// in the format of CloudWatch metric streams
+	TransportFirehose
+)
+
+const (
+	// maxFirehoseRecords is the max number of records per PutRecordBatch request
+	maxFirehoseRecords = 500
+	// maxFirehoseBatchSize is the max size in bytes of PutRecordBatch request
+	maxFirehoseBatchSize = 4 * 1024 * 1024
+	// maxFirehoseRetries is the max number of retries of the records failed in PutRecordBatch
+	maxFirehoseRetries = 2
+)
+
+// FirehoseClient provides interface to write records to a Firehose delivery stream,
+// it is implemented by the Firehose client from the AWS SDK
+type FirehoseClient interface {
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+}
+
+// FirehosePublisher is a Publisher that writes the metrics to a Firehose delivery stream,
+// instead of calling PutMetricData, to not be limited by the PutMetricData rate.
+type FirehosePublisher struct {
+	client FirehoseClient
+	stream string
+	failed atomic.Uint64
+}
+
+// NewFirehosePublisher returns a Publisher that writes to the stream
+func NewFirehosePublisher(client FirehoseClient, stream string) *FirehosePublisher {
+	return &FirehosePublisher{
+		client: client,
+		stream: stream,
+	}
+}
+
+// firehoseRecord is the JSON record of a metric in the format of CloudWatch metric streams
+type firehoseRecord struct {
+	Namespace  string            `json:"namespace"`
+	MetricName string            `json:"metric_name"`
+	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  int64             `json:"timestamp"`
+	Value      firehoseValue     `json:"value"`
+	Unit       string            `json:"unit"`
+}
+
+type firehoseValue struct {
+	Max   float64 `json:"max"`
+	Min   float64 `json:"min"`
+	Sum   float64 `json:"sum"`
+	Count float64 `json:"count"`
+}
+
+// PutMetricData writes the metrics to the Firehose stream,
+// in batches of the max size per request
+func (p *FirehosePublisher) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	ns := aws.ToString(params.Namespace)
+
+	var batch [][]byte
+	size := 0
+	for idx := range params.MetricData {
+		rec, err := json.Marshal(newFirehoseRecord(ns, &params.MetricData[idx]))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		// the records are delimited by new line for the destination
+		rec = append(rec, '\n')
+
+		if len(batch) == maxFirehoseRecords || size+len(rec) > maxFirehoseBatchSize {
+			if err = p.put(ctx, batch); err != nil {
+				return nil, err
+			}
+			batch = nil
+			size = 0
+		}
+		batch = append(batch, rec)
+		size += len(rec)
+	}
+	if err := p.put(ctx, batch); err != nil {
+		return nil, err
+	}
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// Failed returns the number of the records that failed to be written after the retries
+func (p *FirehosePublisher) Failed() uint64 {
+	return p.failed.Load()
+}
+
+// put writes the batch, and retries the records failed in the response
+func (p *FirehosePublisher) put(ctx context.Context, batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	records := make([]fhtypes.Record, len(batch))
+	for idx, rec := range batch {
+		records[idx] = fhtypes.Record{Data: rec}
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := p.client.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(p.stream),
+			Records:            records,
+		})
+		if err != nil {
+			logger.KV(xlog.ERROR,
+				"reason", "put_records",
+				"stream", p.stream,
+				"count", len(records),
+				"err", err.Error())
+			return errors.Wrap(err, "failed to put records")
+		}
+		if aws.ToInt32(res.FailedPutCount) == 0 {
+			return nil
+		}
+
+		records = failedRecords(records, res.RequestResponses)
+		if attempt == maxFirehoseRetries {
+			p.failed.Add(uint64(len(records)))
+			logger.KV(xlog.ERROR,
+				"reason", "failed_records",
+				"stream", p.stream,
+				"count", len(records))
+			return nil
+		}
+	}
+}
+
+// failedRecords returns the records with an error code in the responses
+func failedRecords(records []fhtypes.Record, responses []fhtypes.PutRecordBatchResponseEntry) []fhtypes.Record {
+	var failed []fhtypes.Record
+	for idx, r := range responses {
+		if r.ErrorCode != nil && idx < len(records) {
+			failed = append(failed, records[idx])
+		}
+	}
+	return failed
+}
+
+// newFirehoseRecord converts the datum to the record,
+// the value is always a StatisticSet as in CloudWatch metric streams
+func newFirehoseRecord(ns string, d *types.MetricDatum) *firehoseRecord {
+	rec := &firehoseRecord{
+		Namespace:  ns,
+		MetricName: aws.ToString(d.MetricName),
+		Dimensions: make(map[string]string, len(d.Dimensions)),
+		Timestamp:  aws.ToTime(d.Timestamp).UnixMilli(),
+		Unit:       string(d.Unit),
+	}
+	for _, dim := range d.Dimensions {
+		rec.Dimensions[aws.ToString(dim.Name)] = aws.ToString(dim.Value)
+	}
+
+	switch {
+	case d.StatisticValues != nil:
+		rec.Value = firehoseValue{
+			Max:   aws.ToFloat64(d.StatisticValues.Maximum),
+			Min:   aws.ToFloat64(d.StatisticValues.Minimum),
+			Sum:   aws.ToFloat64(d.StatisticValues.Sum),
+			Count: aws.ToFloat64(d.StatisticValues.SampleCount),
+		}
+	case len(d.Values) > 0:
+		rec.Value = firehoseValue{Max: math.Inf(-1), Min: math.Inf(1)}
+		for idx, v := range d.Values {
+			c := oneVal
+			if idx < len(d.Counts) {
+				c = d.Counts[idx]
+			}
+			rec.Value.Max = max(rec.Value.Max, v)
+			rec.Value.Min = min(rec.Value.Min, v)
+			rec.Value.Sum += v * c
+			rec.Value.Count += c
+		}
+	default:
+		val := aws.ToFloat64(d.Value)
+		rec.Value = firehoseValue{Max: val, Min: val, Sum: val, Count: oneVal}
+	}
+	return rec
+}
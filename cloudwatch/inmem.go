@@ -0,0 +1,142 @@
+package cloudwatch
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/xlog"
+)
+
+// InmemBridge publishes the completed intervals of InmemSink to CloudWatch,
+// to not emit the same metrics to both sinks.
+type InmemBridge struct {
+	Publisher
+
+	// sink provides the configuration of the published metrics
+	sink  *Sink
+	inmem *metrics.InmemSink
+
+	lock sync.Mutex
+	// last is the start of the last published interval
+	last time.Time
+}
+
+// FromInmem creates a bridge from InmemSink to CloudWatch,
+// the Namespace, PublishInterval and dimensions options of the Config are used.
+func FromInmem(inmem *metrics.InmemSink, cfg *Config) (*InmemBridge, error) {
+	sink, err := NewSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &InmemBridge{
+		Publisher: sink.Publisher,
+		sink:      sink,
+		inmem:     inmem,
+	}, nil
+}
+
+// Run starts a loop that will push metrics to Cloudwatch at the configured interval.
+// Accepts a context.Context to support cancellation,
+// on cancellation the current interval is published as well.
+func (b *InmemBridge) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.sink.cloudWatchPublishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.KV(xlog.DEBUG, "reason", "stopping")
+			err := b.flush(context.Background(), true)
+			if err != nil {
+				logger.KV(xlog.ERROR, "reason", "Flush", "err", err)
+			}
+			return
+		case <-ticker.C:
+			err := b.Flush(ctx)
+			if err != nil {
+				logger.KV(xlog.ERROR, "reason", "flush", "err", err)
+			}
+		}
+	}
+}
+
+// Flush publishes the intervals completed since the last Flush
+func (b *InmemBridge) Flush(ctx context.Context) error {
+	return b.flush(ctx, false)
+}
+
+// flush publishes the intervals since the last flush,
+// including the current one if the bridge is stopping
+func (b *InmemBridge) flush(ctx context.Context, current bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	intervals := b.inmem.Data()
+	if !current {
+		// the last interval is the current one
+		intervals = intervals[:len(intervals)-1]
+	}
+	var data []types.MetricDatum
+	last := b.last
+	for _, intv := range intervals {
+		if !intv.Interval.After(b.last) {
+			continue
+		}
+		data = b.appendInterval(data, intv)
+		last = intv.Interval
+	}
+
+	err := publishBatches(ctx, b.Publisher, b.sink.cloudWatchNamespace, data)
+	if err != nil {
+		return err
+	}
+	b.last = last
+	if len(data) > 0 {
+		logger.KV(xlog.DEBUG, "status", "published", "count", len(data))
+	}
+	return nil
+}
+
+// appendInterval appends the metrics of the interval to data
+func (b *InmemBridge) appendInterval(data []types.MetricDatum, intv *metrics.IntervalMetrics) []types.MetricDatum {
+	intv.RLock()
+	defer intv.RUnlock()
+
+	ts := aws.Time(intv.Interval)
+	datum := func(key string, tags []metrics.Tag) types.MetricDatum {
+		name, dims := b.sink.dimensions(key, tags)
+		return types.MetricDatum{
+			Unit:              types.StandardUnitCount,
+			MetricName:        aws.String(name),
+			Timestamp:         ts,
+			Dimensions:        dims,
+			StorageResolution: aws.Int32(storageResolutionVal),
+		}
+	}
+
+	for _, g := range intv.Gauges {
+		d := datum(g.Name, g.Labels)
+		d.Value = aws.Float64(g.Value)
+		data = append(data, d)
+	}
+	for _, c := range intv.Counters {
+		d := datum(c.Name, c.Labels)
+		d.Value = aws.Float64(c.Sum)
+		data = append(data, d)
+	}
+	for _, s := range intv.Samples {
+		d := datum(s.Name, s.Labels)
+		d.StatisticValues = &types.StatisticSet{
+			Minimum:     aws.Float64(s.Min),
+			Maximum:     aws.Float64(s.Max),
+			Sum:         aws.Float64(s.Sum),
+			SampleCount: aws.Float64(float64(s.Count)),
+		}
+		data = append(data, d)
+	}
+	return data
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Validate checks the config for contradictory settings and out of range values,
+// all found problems are returned in one error
+func (m *Config) Validate() error {
+	var problems []string
+	if m.EnableHostname && m.EnableHostnameLabel {
+		problems = append(problems, "EnableHostname and EnableHostnameLabel are mutually exclusive")
+	}
+	if m.EnableServiceLabel && m.ServiceName == "" {
+		problems = append(problems, "EnableServiceLabel requires ServiceName")
+	}
+	if m.DropLongTagValues && m.MaxTagValueLength <= 0 {
+		problems = append(problems, "DropLongTagValues requires MaxTagValueLength")
+	}
+	if m.TimerGranularity < 0 {
+		problems = append(problems, "TimerGranularity must not be negative: "+m.TimerGranularity.String())
+	}
+	if m.ProfileInterval < 0 {
+		problems = append(problems, "ProfileInterval must not be negative: "+m.ProfileInterval.String())
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid metrics config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes the config, the durations can be provided
+// as strings, for example "1s", or as number of nanoseconds
+func (m *Config) UnmarshalJSON(b []byte) error {
+	type config Config
+	aux := struct {
+		*config
+		TimerGranularity configDuration `json:"timer_granularity,omitempty"`
+		ProfileInterval  configDuration `json:"profile_interval,omitempty"`
+	}{
+		config:           (*config)(m),
+		TimerGranularity: configDuration(m.TimerGranularity),
+		ProfileInterval:  configDuration(m.ProfileInterval),
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return errors.WithStack(err)
+	}
+	m.TimerGranularity = time.Duration(aux.TimerGranularity)
+	m.ProfileInterval = time.Duration(aux.ProfileInterval)
+	return nil
+}
+
+// UnmarshalYAML decodes the config, see UnmarshalJSON
+func (m *Config) UnmarshalYAML(unmarshal func(any) error) error {
+	var raw map[string]any
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return m.UnmarshalJSON(b)
+}
+
+// configDuration is time.Duration that can be decoded from a string
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return errors.Errorf("invalid duration: %s", b)
+		}
+		*d = configDuration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*d = configDuration(v)
+	return nil
+}
@@ -0,0 +1,129 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const configYAML = `
+service_name: es
+enable_service_label: true
+enable_runtime_metrics: false
+timer_granularity: 1us
+profile_interval: 10s
+filter_default: true
+global_tags:
+  - name: env
+    value: test
+blocked_prefixes:
+  - debug_
+metric_labels:
+  http_requests:
+    - method
+`
+
+func Test_ConfigUnmarshal(t *testing.T) {
+	expected := metrics.Config{
+		ServiceName:        "es",
+		EnableServiceLabel: true,
+		TimerGranularity:   time.Microsecond,
+		ProfileInterval:    10 * time.Second,
+		FilterDefault:      true,
+		GlobalTags:         []metrics.Tag{{Name: "env", Value: "test"}},
+		BlockedPrefixes:    []string{"debug_"},
+		MetricLabels:       map[string][]string{"http_requests": {"method"}},
+	}
+
+	var cfg metrics.Config
+	require.NoError(t, yaml.Unmarshal([]byte(configYAML), &cfg))
+	assert.Equal(t, expected, cfg)
+
+	// the durations are marshaled as nanoseconds
+	js, err := json.Marshal(&cfg)
+	require.NoError(t, err)
+	var fromJSON metrics.Config
+	require.NoError(t, json.Unmarshal(js, &fromJSON))
+	assert.Equal(t, expected, fromJSON)
+
+	require.NoError(t, json.Unmarshal([]byte(`{"service_name":"svc","profile_interval":"1m"}`), &fromJSON))
+	assert.Equal(t, "svc", fromJSON.ServiceName)
+	assert.Equal(t, time.Minute, fromJSON.ProfileInterval)
+	assert.Equal(t, time.Microsecond, fromJSON.TimerGranularity)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"profile_interval":"1 minute"}`), &fromJSON))
+	assert.Error(t, json.Unmarshal([]byte(`{"profile_interval":true}`), &fromJSON))
+	assert.Error(t, yaml.Unmarshal([]byte("profile_interval: [1]"), &fromJSON))
+
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&cfg, rec)
+	require.NoError(t, err)
+	prov.IncrCounter("http_requests", 1, metrics.Tag{Name: "method", Value: "get"}, metrics.Tag{Name: "user", Value: "u1"})
+	prov.IncrCounter("debug_requests", 1)
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{
+			Type:  metrics.TypeCounter,
+			Key:   "http_requests",
+			Value: 1,
+			Tags: []metrics.Tag{
+				{Name: "method", Value: "get"},
+				{Name: "env", Value: "test"},
+				{Name: "service", Value: "es"},
+			},
+		},
+	)
+	assert.Len(t, rec.Calls(), 1)
+}
+
+func Test_ConfigValidate(t *testing.T) {
+	require.NoError(t, metrics.DefaultConfig("es").Validate())
+	require.NoError(t, (&metrics.Config{
+		ServiceName:         "es",
+		HostName:            "host1",
+		EnableHostnameLabel: true,
+		EnableServiceLabel:  true,
+		MaxTagValueLength:   64,
+		DropLongTagValues:   true,
+		TimerGranularity:    time.Microsecond,
+	}).Validate())
+
+	for _, tc := range []struct {
+		cfg    metrics.Config
+		expErr string
+	}{
+		{
+			cfg:    metrics.Config{EnableHostname: true, EnableHostnameLabel: true},
+			expErr: "invalid metrics config: EnableHostname and EnableHostnameLabel are mutually exclusive",
+		},
+		{
+			cfg:    metrics.Config{EnableServiceLabel: true},
+			expErr: "invalid metrics config: EnableServiceLabel requires ServiceName",
+		},
+		{
+			cfg:    metrics.Config{DropLongTagValues: true},
+			expErr: "invalid metrics config: DropLongTagValues requires MaxTagValueLength",
+		},
+		{
+			cfg:    metrics.Config{TimerGranularity: -time.Millisecond},
+			expErr: "invalid metrics config: TimerGranularity must not be negative: -1ms",
+		},
+		{
+			cfg:    metrics.Config{ProfileInterval: -time.Second},
+			expErr: "invalid metrics config: ProfileInterval must not be negative: -1s",
+		},
+		{
+			cfg:    metrics.Config{EnableServiceLabel: true, ProfileInterval: -time.Second},
+			expErr: "invalid metrics config: EnableServiceLabel requires ServiceName; ProfileInterval must not be negative: -1s",
+		},
+	} {
+		assert.EqualError(t, tc.cfg.Validate(), tc.expErr)
+		_, err := metrics.New(&tc.cfg, &metrics.BlackholeSink{})
+		assert.EqualError(t, err, tc.expErr)
+	}
+}
@@ -0,0 +1,91 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockedContextSink struct {
+	mockedSink
+	errs []error
+}
+
+func (m *mockedContextSink) SetGaugeCtx(ctx context.Context, key string, val float64, labels []metrics.Tag) {
+	m.errs = append(m.errs, ctx.Err())
+	m.Called(key, val, labels)
+}
+
+func (m *mockedContextSink) IncrCounterCtx(ctx context.Context, key string, val float64, labels []metrics.Tag) {
+	m.errs = append(m.errs, ctx.Err())
+	m.Called(key, val, labels)
+}
+
+func (m *mockedContextSink) AddSampleCtx(ctx context.Context, key string, val float64, labels []metrics.Tag) {
+	m.errs = append(m.errs, ctx.Err())
+	m.Called(key, val, labels)
+}
+
+func Test_WithContext(t *testing.T) {
+	t.Run("sink", func(t *testing.T) {
+		mocked := &mockedSink{t: t}
+		mocked.On("SetGauge", "test_metrics_gauge", mock.Anything, mock.Anything).Times(1)
+		mocked.On("IncrCounter", "test_metrics_counter", mock.Anything, mock.Anything).Times(1)
+		mocked.On("AddSample", mock.Anything, mock.Anything, mock.Anything).Times(2)
+
+		prov, err := metrics.New(&metrics.Config{FilterDefault: true}, mocked)
+		require.NoError(t, err)
+
+		run(prov.WithContext(context.Background()), 1)
+		mocked.AssertExpectations(t)
+	})
+
+	t.Run("context sink", func(t *testing.T) {
+		mocked := &mockedContextSink{mockedSink: mockedSink{t: t}}
+		mocked.On("SetGaugeCtx", "test_metrics_gauge", mock.Anything, mock.Anything).Times(1)
+		mocked.On("IncrCounterCtx", "test_metrics_counter", mock.Anything, mock.Anything).Times(1)
+		mocked.On("AddSampleCtx", mock.Anything, mock.Anything, mock.Anything).Times(2)
+
+		prov, err := metrics.New(&metrics.Config{FilterDefault: true}, mocked)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		run(prov.WithContext(ctx), 1)
+		mocked.AssertExpectations(t)
+		mocked.AssertNotCalled(t, "SetGauge", mock.Anything, mock.Anything, mock.Anything)
+
+		require.Len(t, mocked.errs, 4)
+		for _, err := range mocked.errs {
+			assert.Equal(t, context.Canceled, err)
+		}
+	})
+
+	t.Run("context sink without context", func(t *testing.T) {
+		mocked := &mockedContextSink{mockedSink: mockedSink{t: t}}
+		mocked.On("SetGauge", "test_metrics_gauge", float64(1), []metrics.Tag(nil)).Times(1)
+
+		prov, err := metrics.New(&metrics.Config{FilterDefault: true}, mocked)
+		require.NoError(t, err)
+
+		prov.SetGauge("test_metrics_gauge", 1)
+		mocked.AssertExpectations(t)
+		assert.Empty(t, mocked.errs)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		mocked := &mockedContextSink{mockedSink: mockedSink{t: t}}
+
+		prov, err := metrics.New(&metrics.Config{FilterDefault: false}, mocked)
+		require.NoError(t, err)
+
+		prov.WithContext(context.Background()).MeasureSince("test_metrics_since", time.Now())
+		assert.Empty(t, mocked.errs)
+	})
+}
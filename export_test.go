@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// SetInmemClock replaces the clock of the sink for tests
+func SetInmemClock(i *InmemSink, now func() time.Time) {
+	i.now = now
+}
+
+// SetMetricsClock replaces the clock of the metrics for tests,
+// the start time is reset to the current time of the clock
+func SetMetricsClock(m *Metrics, now func() time.Time) {
+	m.now = now
+	m.started = now()
+}
+
+// EmitRuntimeStats emits the runtime metrics without waiting for ProfileInterval
+func EmitRuntimeStats(m *Metrics) {
+	m.emitRuntimeStats()
+}
+
+// SetMemStatsSource replaces the source of the runtime memory stats for tests
+func SetMemStatsSource(m *Metrics, read func(*runtime.MemStats)) {
+	m.readMemStats = read
+}
+
+// SampleGaugeSeries returns the number of the series aggregated by the sink
+func SampleGaugeSeries(s *SampleAsGaugeSink) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.samples)
+}
+
+// NewParallelFanoutSinkQueue creates fan-out sink with the queue size for tests
+func NewParallelFanoutSinkQueue(workers, queueSize int, sinks ...Sink) *ParallelFanoutSink {
+	return newParallelFanoutSink(workers, queueSize, sinks...)
+}
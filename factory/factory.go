@@ -2,6 +2,8 @@ package factory
 
 import (
 	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/effective-security/metrics"
 	"github.com/pkg/errors"
@@ -30,7 +32,9 @@ var sinkRegistry = map[string]sinkURLFactoryFunc{
 //
 // "inmem://" - Initializes an InmemSink. The host and port are ignored. The
 // "interval" and "retain" query parameters must be specified with valid
-// durations, see NewInmemSink for details.
+// durations, see NewInmemSink for details. The optional "rateUnit" duration
+// specifies the time unit of the rates, by default 1s. The optional boolean
+// "quantiles" enables the quantiles of the samples.
 func NewMetricSinkFromURL(urlStr string) (metrics.Sink, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
@@ -39,8 +43,19 @@ func NewMetricSinkFromURL(urlStr string) (metrics.Sink, error) {
 
 	sinkURLFactoryFunc := sinkRegistry[u.Scheme]
 	if sinkURLFactoryFunc == nil {
-		return nil, errors.Errorf("unrecognized sink name: %q", u.Scheme)
+		return nil, errors.Errorf("unrecognized sink name: %q, available: %s",
+			u.Scheme, strings.Join(Schemes(), ", "))
 	}
 
 	return sinkURLFactoryFunc(u)
 }
+
+// Schemes returns the sorted list of registered sink schemes
+func Schemes() []string {
+	list := make([]string, 0, len(sinkRegistry))
+	for scheme := range sinkRegistry {
+		list = append(list, scheme)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -1,6 +1,7 @@
 package factory_test
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/effective-security/metrics/factory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func run(p metrics.Provider, times int) {
@@ -43,8 +45,68 @@ func Test_NewMetricSinkFromURL_InMem_InvalidParams(t *testing.T) {
 	assert.EqualError(t, err, "bad 'interval' param: time: invalid duration \"yyy\"")
 
 	_, err = factory.NewMetricSinkFromURL("notsupported://localhost?interval=1s")
-	assert.EqualError(t, err, "unrecognized sink name: \"notsupported\"")
+	assert.EqualError(t, err, "unrecognized sink name: \"notsupported\", available: inmem")
 
 	_, err = factory.NewMetricSinkFromURL("^notURL::://\x7f")
 	assert.EqualError(t, err, "parse \"^notURL::://\\x7f\": net/url: invalid control character in URL")
 }
+
+func Test_Schemes(t *testing.T) {
+	assert.Equal(t, []string{"inmem"}, factory.Schemes())
+}
+
+func Test_NewFromSpec(t *testing.T) {
+	spec := factory.Spec{
+		Config: metrics.Config{
+			ServiceName:   "es",
+			FilterDefault: true,
+		},
+		SinkURLs: []string{"inmem://localhost?interval=1s&retain=1m"},
+	}
+	prov, err := factory.NewFromSpec(spec)
+	require.NoError(t, err)
+	prov.IncrCounter("requests", 1)
+
+	im, ok := prov.Sink().(*metrics.InmemSink)
+	require.True(t, ok)
+	data := im.Data()
+	require.NotEmpty(t, data)
+	assert.Equal(t, float64(1), data[len(data)-1].Counters["es_requests"].Sum)
+
+	spec.SinkURLs = append(spec.SinkURLs, "inmem://localhost?interval=1s&retain=1m")
+	prov, err = factory.NewFromSpec(spec)
+	require.NoError(t, err)
+	fanout, ok := prov.Sink().(metrics.FanoutSink)
+	require.True(t, ok)
+	assert.Len(t, fanout, 2)
+
+	spec.SinkURLs = nil
+	prov, err = factory.NewFromSpec(spec)
+	require.NoError(t, err)
+	assert.IsType(t, &metrics.BlackholeSink{}, prov.Sink())
+
+	spec.SinkURLs = []string{"unknown://localhost"}
+	_, err = factory.NewFromSpec(spec)
+	assert.EqualError(t, err, `unrecognized sink name: "unknown", available: inmem`)
+}
+
+func Test_SpecUnmarshal(t *testing.T) {
+	var spec factory.Spec
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"service_name": "es",
+		"profile_interval": "5s",
+		"sink_urls": ["inmem://localhost?interval=1s&retain=1m"]
+	}`), &spec))
+	assert.Equal(t, "es", spec.ServiceName)
+	assert.Equal(t, 5*time.Second, spec.ProfileInterval)
+	assert.Equal(t, []string{"inmem://localhost?interval=1s&retain=1m"}, spec.SinkURLs)
+
+	var fromYAML factory.Spec
+	require.NoError(t, yaml.Unmarshal([]byte(`
+service_name: es
+profile_interval: 5s
+sink_urls:
+  - inmem://localhost?interval=1s&retain=1m
+`), &fromYAML))
+	assert.Equal(t, spec, fromYAML)
+}
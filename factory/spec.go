@@ -0,0 +1,73 @@
+package factory
+
+import (
+	"encoding/json"
+
+	"github.com/effective-security/metrics"
+	"github.com/pkg/errors"
+)
+
+// Spec is the complete metrics configuration, including the sinks
+type Spec struct {
+	metrics.Config
+	// SinkURLs are the sinks to emit to, see NewMetricSinkFromURL for the supported schemes.
+	// Multiple sinks are combined with FanoutSink.
+	SinkURLs []string `json:"sink_urls,omitempty" yaml:"sink_urls,omitempty"`
+}
+
+// UnmarshalJSON decodes the spec, the Config fields are at the top level
+func (s *Spec) UnmarshalJSON(b []byte) error {
+	if err := s.Config.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	var sinks struct {
+		SinkURLs []string `json:"sink_urls,omitempty"`
+	}
+	if err := json.Unmarshal(b, &sinks); err != nil {
+		return errors.WithStack(err)
+	}
+	s.SinkURLs = sinks.SinkURLs
+	return nil
+}
+
+// UnmarshalYAML decodes the spec, the Config fields are at the top level
+func (s *Spec) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&s.Config); err != nil {
+		return err
+	}
+	var sinks struct {
+		SinkURLs []string `yaml:"sink_urls,omitempty"`
+	}
+	if err := unmarshal(&sinks); err != nil {
+		return err
+	}
+	s.SinkURLs = sinks.SinkURLs
+	return nil
+}
+
+// NewFromSpec creates the sinks from SinkURLs, and returns the provider.
+// If no sinks are specified, then the metrics are sent to BlackholeSink.
+func NewFromSpec(spec Spec) (*metrics.Metrics, error) {
+	var sink metrics.Sink
+	switch len(spec.SinkURLs) {
+	case 0:
+		sink = &metrics.BlackholeSink{}
+	case 1:
+		s, err := NewMetricSinkFromURL(spec.SinkURLs[0])
+		if err != nil {
+			return nil, err
+		}
+		sink = s
+	default:
+		var sinks metrics.FanoutSink
+		for _, u := range spec.SinkURLs {
+			s, err := NewMetricSinkFromURL(u)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		}
+		sink = sinks
+	}
+	return metrics.New(&spec.Config, sink)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"github.com/effective-security/xlog"
+)
+
+// FallbackSink wraps a primary FlushableSink, and replays the recent emissions
+// into the fallback Sink if the primary fails to Flush,
+// so the recent data is not entirely lost when the network sink is unavailable.
+type FallbackSink struct {
+	primary  FlushableSink
+	fallback Sink
+
+	lock sync.Mutex
+	// buffer is a ring of the emissions since the last Flush
+	buffer []emission
+	next   int
+	full   bool
+}
+
+type emission struct {
+	typ  string
+	key  string
+	val  float64
+	tags []Tag
+}
+
+// NewFallbackSink creates a sink that keeps up to size of the most recent emissions
+// since the last Flush, to replay them into fallback if the primary fails to Flush.
+func NewFallbackSink(primary FlushableSink, fallback Sink, size int) *FallbackSink {
+	if size <= 0 {
+		size = 1000
+	}
+	return &FallbackSink{
+		primary:  primary,
+		fallback: fallback,
+		buffer:   make([]emission, size),
+	}
+}
+
+// SetGauge should retain the last value it is set to
+func (s *FallbackSink) SetGauge(key string, val float64, tags []Tag) {
+	s.record(TypeGauge, key, val, tags)
+	s.primary.SetGauge(key, val, tags)
+}
+
+// IncrCounter should accumulate values
+func (s *FallbackSink) IncrCounter(key string, val float64, tags []Tag) {
+	s.record(TypeCounter, key, val, tags)
+	s.primary.IncrCounter(key, val, tags)
+}
+
+// AddSample is for timing information, where quantiles are used
+func (s *FallbackSink) AddSample(key string, val float64, tags []Tag) {
+	s.record(TypeSample, key, val, tags)
+	s.primary.AddSample(key, val, tags)
+}
+
+// Flush flushes the primary sink,
+// and on error replays the recent emissions into the fallback sink.
+func (s *FallbackSink) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	recent := s.recent()
+	s.next = 0
+	s.full = false
+	s.lock.Unlock()
+
+	err := s.primary.Flush(ctx)
+	if err != nil {
+		logger.KV(xlog.ERROR, "reason", "flush", "replayed", len(recent), "err", err)
+		for _, e := range recent {
+			switch e.typ {
+			case TypeGauge:
+				s.fallback.SetGauge(e.key, e.val, e.tags)
+			case TypeCounter:
+				s.fallback.IncrCounter(e.key, e.val, e.tags)
+			case TypeSample:
+				s.fallback.AddSample(e.key, e.val, e.tags)
+			}
+		}
+	}
+	return err
+}
+
+func (s *FallbackSink) record(typ, key string, val float64, tags []Tag) {
+	s.lock.Lock()
+	s.buffer[s.next] = emission{typ: typ, key: key, val: val, tags: tags}
+	s.next++
+	if s.next == len(s.buffer) {
+		s.next = 0
+		s.full = true
+	}
+	s.lock.Unlock()
+}
+
+// recent returns the buffered emissions in order, must be called with the lock held
+func (s *FallbackSink) recent() []emission {
+	if !s.full {
+		return append([]emission(nil), s.buffer[:s.next]...)
+	}
+	list := make([]emission, 0, len(s.buffer))
+	list = append(list, s.buffer[s.next:]...)
+	return append(list, s.buffer[:s.next]...)
+}
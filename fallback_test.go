@@ -0,0 +1,52 @@
+package metrics_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type flushableSink struct {
+	metrics.BlackholeSink
+	err error
+}
+
+func (s *flushableSink) Flush(_ context.Context) error {
+	return s.err
+}
+
+func Test_FallbackSink(t *testing.T) {
+	ctx := context.Background()
+	primary := &flushableSink{}
+	fallback := metricstest.NewOrderedRecorder()
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+
+	s := metrics.NewFallbackSink(primary, fallback, 3)
+	s.IncrCounter("test_counter", 1, tags)
+	assert.NoError(t, s.Flush(ctx))
+	assert.Empty(t, fallback.Calls())
+
+	primary.err = errors.New("network is unavailable")
+	s.SetGauge("test_gauge", 1, tags)
+	s.IncrCounter("test_counter", 2, tags)
+	s.AddSample("test_sample", 3, tags)
+	s.SetGauge("test_gauge", 4, tags)
+	assert.EqualError(t, s.Flush(ctx), "network is unavailable")
+
+	// only the 3 most recent are kept
+	fallback.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "test_counter", Value: 2, Tags: tags},
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "test_sample", Value: 3, Tags: tags},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 4, Tags: tags},
+	)
+	assert.Len(t, fallback.Calls(), 3)
+
+	// the buffer is reset after Flush
+	fallback.Reset()
+	assert.Error(t, s.Flush(ctx))
+	assert.Empty(t, fallback.Calls())
+}
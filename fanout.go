@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultFanoutTimeout is the default time to wait for a place in the queue of a sink
+	DefaultFanoutTimeout = 100 * time.Millisecond
+	// DefaultFanoutQueueSize is the default size of the queue of each sink
+	DefaultFanoutQueueSize = 1000
+
+	// fanoutBatch is the max number of emissions handled for a sink,
+	// before the worker is released to the other sinks
+	fanoutBatch = 64
+)
+
+// ParallelFanoutSink sends the values to multiple sinks concurrently with a bounded worker pool,
+// so slow sinks do not multiply the latency.
+// Each sink has a bounded queue, and is handled by one worker at a time to keep the order,
+// so a blocked sink holds at most one worker.
+// The emission to a sink is dropped if its queue is still full after Timeout.
+// The emissions are handled asynchronously, so the tags must not be modified after the call.
+type ParallelFanoutSink struct {
+	// Timeout is the maximum time to wait for a place in the queue of a blocked sink
+	Timeout time.Duration
+
+	targets []*fanoutTarget
+	// ready has the targets with queued emissions, each target at most once
+	ready    chan *fanoutTarget
+	dropped  atomic.Uint64
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// fanoutTarget is a sink with the queue of its emissions
+type fanoutTarget struct {
+	sink  Sink
+	queue chan func(Sink)
+	// scheduled is set when the target is in ready, or handled by a worker
+	scheduled atomic.Bool
+}
+
+var _ FlushableSink = (*ParallelFanoutSink)(nil)
+
+// NewParallelFanoutSink creates fan-out sink with the pool of workers,
+// if workers is not positive or more than the number of sinks, then a worker per sink is used.
+// The workers are stopped by Close.
+func NewParallelFanoutSink(workers int, sinks ...Sink) *ParallelFanoutSink {
+	return newParallelFanoutSink(workers, DefaultFanoutQueueSize, sinks...)
+}
+
+func newParallelFanoutSink(workers, queueSize int, sinks ...Sink) *ParallelFanoutSink {
+	if workers <= 0 || workers > len(sinks) {
+		workers = len(sinks)
+	}
+	fh := &ParallelFanoutSink{
+		Timeout:  DefaultFanoutTimeout,
+		targets:  make([]*fanoutTarget, len(sinks)),
+		ready:    make(chan *fanoutTarget, len(sinks)),
+		stopChan: make(chan struct{}),
+	}
+	for i, s := range sinks {
+		fh.targets[i] = &fanoutTarget{
+			sink:  s,
+			queue: make(chan func(Sink), queueSize),
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go fh.run()
+	}
+	return fh
+}
+
+// run handles the ready targets until Close
+func (fh *ParallelFanoutSink) run() {
+	for {
+		select {
+		case t := <-fh.ready:
+			fh.drain(t)
+		case <-fh.stopChan:
+			return
+		}
+	}
+}
+
+// drain calls the queued emissions of the target,
+// up to fanoutBatch to not starve the other sinks
+func (fh *ParallelFanoutSink) drain(t *fanoutTarget) {
+	for i := 0; i < fanoutBatch; i++ {
+		select {
+		case fn := <-t.queue:
+			fn(t.sink)
+		default:
+			t.scheduled.Store(false)
+			// an emission may be queued after the queue is found empty
+			if len(t.queue) > 0 {
+				fh.schedule(t)
+			}
+			return
+		}
+	}
+	// still scheduled, the target is put back for the next worker
+	fh.ready <- t
+}
+
+// schedule puts the target to ready, if it is not scheduled yet
+func (fh *ParallelFanoutSink) schedule(t *fanoutTarget) {
+	if t.scheduled.CompareAndSwap(false, true) {
+		fh.ready <- t
+	}
+}
+
+// SetGauge should retain the last value it is set to
+func (fh *ParallelFanoutSink) SetGauge(key string, val float64, tags []Tag) {
+	fh.emit(func(s Sink) {
+		s.SetGauge(key, val, tags)
+	})
+}
+
+// IncrCounter should accumulate values
+func (fh *ParallelFanoutSink) IncrCounter(key string, val float64, tags []Tag) {
+	fh.emit(func(s Sink) {
+		s.IncrCounter(key, val, tags)
+	})
+}
+
+// AddSample is for timing information, where quantiles are used
+func (fh *ParallelFanoutSink) AddSample(key string, val float64, tags []Tag) {
+	fh.emit(func(s Sink) {
+		s.AddSample(key, val, tags)
+	})
+}
+
+// Dropped returns the number of emissions dropped for the sinks
+// with the full queue after the timeout, or after Close
+func (fh *ParallelFanoutSink) Dropped() uint64 {
+	return fh.dropped.Load()
+}
+
+// Flush waits until the emissions queued before the call are handled by the sinks
+func (fh *ParallelFanoutSink) Flush(ctx context.Context) error {
+	if fh.closed() {
+		return errors.New("fanout sink is closed")
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range fh.targets {
+		wg.Add(1)
+		select {
+		case t.queue <- func(Sink) { wg.Done() }:
+			fh.schedule(t)
+		case <-fh.stopChan:
+			return errors.New("fanout sink is closed")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-fh.stopChan:
+		return errors.New("fanout sink is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the workers, the queued emissions are discarded,
+// and the emissions after Close are dropped
+func (fh *ParallelFanoutSink) Close() error {
+	fh.stopOnce.Do(func() {
+		close(fh.stopChan)
+	})
+	return nil
+}
+
+// closed returns true after Close
+func (fh *ParallelFanoutSink) closed() bool {
+	select {
+	case <-fh.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// emit queues fn for each sink, and waits up to Timeout for a full queue
+func (fh *ParallelFanoutSink) emit(fn func(Sink)) {
+	if fh.closed() {
+		fh.dropped.Add(uint64(len(fh.targets)))
+		return
+	}
+
+	var timer *time.Timer
+	expired := false
+	for _, t := range fh.targets {
+		select {
+		case t.queue <- fn:
+			fh.schedule(t)
+			continue
+		default:
+		}
+
+		// the queue is full, wait for the blocked sink up to the timeout of the call
+		if expired {
+			fh.dropped.Add(1)
+			continue
+		}
+		if timer == nil {
+			timer = time.NewTimer(fh.Timeout)
+			defer timer.Stop()
+		}
+		select {
+		case t.queue <- fn:
+			fh.schedule(t)
+		case <-timer.C:
+			expired = true
+			fh.dropped.Add(1)
+		case <-fh.stopChan:
+			expired = true
+			fh.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package metrics_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingSink blocks the emissions until released
+type blockingSink struct {
+	*metricstest.OrderedRecorder
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) SetGauge(key string, val float64, tags []metrics.Tag) {
+	s.entered <- struct{}{}
+	<-s.release
+	s.OrderedRecorder.SetGauge(key, val, tags)
+}
+
+func Test_ParallelFanoutSink(t *testing.T) {
+	r1 := metricstest.NewOrderedRecorder()
+	r2 := metricstest.NewOrderedRecorder()
+	// the workers are shared by the sinks
+	fs := metrics.NewParallelFanoutSink(1, r1, r2)
+	defer fs.Close()
+
+	fs.SetGauge("test_gauge", 1, nil)
+	fs.IncrCounter("test_counter", 2, nil)
+	fs.AddSample("test_sample", 3, nil)
+	require.NoError(t, fs.Flush(context.Background()))
+
+	for _, r := range []*metricstest.OrderedRecorder{r1, r2} {
+		r.AssertSequence(t,
+			metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 1},
+			metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "test_counter", Value: 2},
+			metricstest.RecordedCall{Type: metrics.TypeSample, Key: "test_sample", Value: 3},
+		)
+	}
+	assert.Equal(t, uint64(0), fs.Dropped())
+}
+
+func Test_ParallelFanoutSinkConcurrent(t *testing.T) {
+	rec := metricstest.NewOrderedRecorder()
+	fs := metrics.NewParallelFanoutSink(0, rec)
+	defer fs.Close()
+
+	// the concurrent emissions to a fast sink are not dropped
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				fs.IncrCounter("test_counter", 1, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, fs.Flush(context.Background()))
+
+	assert.Len(t, rec.Calls(), 500)
+	assert.Equal(t, uint64(0), fs.Dropped())
+}
+
+func Test_ParallelFanoutSinkBlocking(t *testing.T) {
+	blocking := &blockingSink{
+		OrderedRecorder: metricstest.NewOrderedRecorder(),
+		entered:         make(chan struct{}, 2),
+		release:         make(chan struct{}),
+	}
+	r1 := metricstest.NewOrderedRecorder()
+	r2 := metricstest.NewOrderedRecorder()
+	// the blocked sink holds one of the workers
+	fs := metrics.NewParallelFanoutSinkQueue(2, 1, blocking, r1, r2)
+	defer fs.Close()
+	fs.Timeout = 20 * time.Millisecond
+
+	started := time.Now()
+	fs.SetGauge("test_gauge", 1, nil)
+	// the worker of the blocked sink takes the first emission from the queue
+	<-blocking.entered
+	fs.SetGauge("test_gauge", 2, nil)
+	fs.SetGauge("test_gauge", 3, nil)
+	assert.Less(t, time.Since(started), time.Second)
+
+	// the queue of the blocked sink is full
+	assert.Equal(t, uint64(1), fs.Dropped())
+
+	// the other sinks are handled by the other worker while the sink is blocked
+	assert.Eventually(t, func() bool {
+		return len(r1.Calls()) == 3 && len(r2.Calls()) == 3
+	}, time.Second, time.Millisecond)
+
+	close(blocking.release)
+	require.NoError(t, fs.Flush(context.Background()))
+	for _, r := range []*metricstest.OrderedRecorder{r1, r2} {
+		r.AssertSequence(t,
+			metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 1},
+			metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 2},
+			metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 3},
+		)
+	}
+	assert.Len(t, blocking.Calls(), 2)
+}
+
+func Test_ParallelFanoutSinkClosed(t *testing.T) {
+	rec := metricstest.NewOrderedRecorder()
+	fs := metrics.NewParallelFanoutSinkQueue(1, 1, rec)
+	fs.Timeout = time.Minute
+	require.NoError(t, fs.Close())
+
+	// the emissions after Close are dropped without waiting for the timeout
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		fs.SetGauge("test_gauge", 1, nil)
+	}
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, uint64(3), fs.Dropped())
+	assert.EqualError(t, fs.Flush(context.Background()), "fanout sink is closed")
+	assert.Empty(t, rec.Calls())
+}
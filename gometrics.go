@@ -0,0 +1,97 @@
+package metrics
+
+import "strings"
+
+// DefaultGoMetricsSeparator is the default separator of the key parts for GoMetricsAdapter
+const DefaultGoMetricsSeparator = "_"
+
+// GoMetricsLabel is the constraint of the label type of github.com/armon/go-metrics,
+// that is `metrics.Label` with Name and Value fields
+type GoMetricsLabel interface {
+	~struct {
+		Name  string
+		Value string
+	}
+}
+
+// GoMetricsSinkOf is the sink of github.com/armon/go-metrics,
+// which uses the key parts, float32 values and the go-metrics labels of type L.
+type GoMetricsSinkOf[L any] interface {
+	SetGaugeWithLabels(key []string, val float32, labels []L)
+	IncrCounterWithLabels(key []string, val float32, labels []L)
+	AddSampleWithLabels(key []string, val float32, labels []L)
+}
+
+// GoMetricsSink is the go-metrics style sink with the labels of Tag type
+type GoMetricsSink interface {
+	GoMetricsSinkOf[Tag]
+}
+
+// GoMetricsAdapter is the Sink that forwards the metrics to GoMetricsSinkOf
+type GoMetricsAdapter[L any] struct {
+	// Separator is used to split the key into parts,
+	// if empty, then the key is not split
+	Separator string
+
+	gm     GoMetricsSinkOf[L]
+	labels func(tags []Tag) []L
+}
+
+// FromGoMetricsSink returns the Sink that forwards the metrics to go-metrics style sink,
+// the key is split into parts with DefaultGoMetricsSeparator.
+// Use NewGoMetricsAdapter for the sinks of github.com/armon/go-metrics.
+func FromGoMetricsSink(gm GoMetricsSink) Sink {
+	return &GoMetricsAdapter[Tag]{
+		Separator: DefaultGoMetricsSeparator,
+		gm:        gm,
+		labels: func(tags []Tag) []Tag {
+			return tags
+		},
+	}
+}
+
+// NewGoMetricsAdapter returns the Sink that forwards the metrics to go-metrics sink,
+// the key is split into parts with DefaultGoMetricsSeparator.
+// The label type must be provided, for example:
+//
+//	sink := metrics.NewGoMetricsAdapter[gometrics.Label](gometrics.NewInmemSink(10*time.Second, time.Minute))
+func NewGoMetricsAdapter[L GoMetricsLabel](gm GoMetricsSinkOf[L]) *GoMetricsAdapter[L] {
+	return &GoMetricsAdapter[L]{
+		Separator: DefaultGoMetricsSeparator,
+		gm:        gm,
+		labels:    goMetricsLabels[L],
+	}
+}
+
+// SetGauge should retain the last value it is set to
+func (a *GoMetricsAdapter[L]) SetGauge(key string, val float64, tags []Tag) {
+	a.gm.SetGaugeWithLabels(a.keyParts(key), float32(val), a.labels(tags))
+}
+
+// IncrCounter should accumulate values
+func (a *GoMetricsAdapter[L]) IncrCounter(key string, val float64, tags []Tag) {
+	a.gm.IncrCounterWithLabels(a.keyParts(key), float32(val), a.labels(tags))
+}
+
+// AddSample is for timing information, where quantiles are used
+func (a *GoMetricsAdapter[L]) AddSample(key string, val float64, tags []Tag) {
+	a.gm.AddSampleWithLabels(a.keyParts(key), float32(val), a.labels(tags))
+}
+
+func (a *GoMetricsAdapter[L]) keyParts(key string) []string {
+	if a.Separator == "" {
+		return []string{key}
+	}
+	return strings.Split(key, a.Separator)
+}
+
+func goMetricsLabels[L GoMetricsLabel](tags []Tag) []L {
+	if len(tags) == 0 {
+		return nil
+	}
+	labels := make([]L, len(tags))
+	for i, t := range tags {
+		labels[i] = L{Name: t.Name, Value: t.Value}
+	}
+	return labels
+}
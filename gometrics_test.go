@@ -0,0 +1,108 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// goMetricsLabel is github.com/armon/go-metrics Label
+type goMetricsLabel struct {
+	Name  string
+	Value string
+}
+
+type goMetricsCall struct {
+	typ    string
+	key    []string
+	val    float32
+	labels []goMetricsLabel
+}
+
+// fakeGoMetricsSink records the calls, with the signatures of go-metrics MetricSink
+type fakeGoMetricsSink struct {
+	calls []goMetricsCall
+}
+
+func (s *fakeGoMetricsSink) SetGauge(key []string, val float32) {}
+
+func (s *fakeGoMetricsSink) SetGaugeWithLabels(key []string, val float32, labels []goMetricsLabel) {
+	s.calls = append(s.calls, goMetricsCall{metrics.TypeGauge, key, val, labels})
+}
+
+func (s *fakeGoMetricsSink) EmitKey(key []string, val float32) {}
+
+func (s *fakeGoMetricsSink) IncrCounter(key []string, val float32) {}
+
+func (s *fakeGoMetricsSink) IncrCounterWithLabels(key []string, val float32, labels []goMetricsLabel) {
+	s.calls = append(s.calls, goMetricsCall{metrics.TypeCounter, key, val, labels})
+}
+
+func (s *fakeGoMetricsSink) AddSample(key []string, val float32) {}
+
+func (s *fakeGoMetricsSink) AddSampleWithLabels(key []string, val float32, labels []goMetricsLabel) {
+	s.calls = append(s.calls, goMetricsCall{metrics.TypeSample, key, val, labels})
+}
+
+func Test_NewGoMetricsAdapter(t *testing.T) {
+	gm := &fakeGoMetricsSink{}
+	var sink metrics.Sink = metrics.NewGoMetricsAdapter[goMetricsLabel](gm)
+
+	sink.SetGauge("http_requests_active", 3, []metrics.Tag{{Name: "method", Value: "GET"}})
+	sink.IncrCounter("http_requests", 1.5, nil)
+	sink.AddSample("http_latency", 0.25, nil)
+
+	assert.Equal(t, []goMetricsCall{
+		{metrics.TypeGauge, []string{"http", "requests", "active"}, 3, []goMetricsLabel{{Name: "method", Value: "GET"}}},
+		{metrics.TypeCounter, []string{"http", "requests"}, 1.5, nil},
+		{metrics.TypeSample, []string{"http", "latency"}, 0.25, nil},
+	}, gm.calls)
+
+	gm.calls = nil
+	a := metrics.NewGoMetricsAdapter[goMetricsLabel](gm)
+	a.Separator = "."
+	a.IncrCounter("es.requests", 1, nil)
+	a.Separator = ""
+	a.IncrCounter("es_requests", 1, nil)
+	assert.Equal(t, []string{"es", "requests"}, gm.calls[0].key)
+	assert.Equal(t, []string{"es_requests"}, gm.calls[1].key)
+}
+
+// fakeTagsSink records the calls of go-metrics style sink with the tags
+type fakeTagsSink struct {
+	calls []goMetricsCall
+	tags  [][]metrics.Tag
+}
+
+func (s *fakeTagsSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Tag) {
+	s.calls = append(s.calls, goMetricsCall{typ: metrics.TypeGauge, key: key, val: val})
+	s.tags = append(s.tags, labels)
+}
+
+func (s *fakeTagsSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Tag) {
+	s.calls = append(s.calls, goMetricsCall{typ: metrics.TypeCounter, key: key, val: val})
+	s.tags = append(s.tags, labels)
+}
+
+func (s *fakeTagsSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Tag) {
+	s.calls = append(s.calls, goMetricsCall{typ: metrics.TypeSample, key: key, val: val})
+	s.tags = append(s.tags, labels)
+}
+
+func Test_FromGoMetricsSink(t *testing.T) {
+	gm := &fakeTagsSink{}
+	sink := metrics.FromGoMetricsSink(gm)
+
+	tags := []metrics.Tag{{Name: "method", Value: "GET"}}
+	sink.SetGauge("http_requests_active", 3, tags)
+	sink.IncrCounter("http_requests", 1.5, nil)
+	sink.AddSample("http_latency", 0.25, nil)
+
+	assert.Equal(t, []goMetricsCall{
+		{metrics.TypeGauge, []string{"http", "requests", "active"}, 3, nil},
+		{metrics.TypeCounter, []string{"http", "requests"}, 1.5, nil},
+		{metrics.TypeSample, []string{"http", "latency"}, 0.25, nil},
+	}, gm.calls)
+	assert.Equal(t, [][]metrics.Tag{tags, nil, nil}, gm.tags)
+}
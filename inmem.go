@@ -2,10 +2,13 @@ package metrics
 
 import (
 	"bytes"
-	"fmt"
+	"maps"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -28,8 +31,38 @@ type InmemSink struct {
 	// intervals is a slice of the retained intervals
 	intervals    []*IntervalMetrics
 	intervalLock sync.RWMutex
+	// current is the last interval, to be found without intervalLock
+	current atomic.Pointer[IntervalMetrics]
 
 	rateDenom float64
+
+	// quantiles is the compression of the quantile sketch of samples,
+	// 0 if the quantiles are not tracked
+	quantiles float64
+
+	// OnIntervalComplete is called with the completed interval,
+	// when a new interval supersedes it. It must be set before the sink is used.
+	// The interval may be in use, and a read lock should be acquired.
+	OnIntervalComplete func(*IntervalMetrics)
+
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+
+	// events is a ring of the recent emissions, with WithEventLog
+	events     []Event
+	eventsNext int
+	eventsFull bool
+	eventsLock sync.Mutex
+}
+
+// Event is a single emission recorded by InmemSink.WithEventLog
+type Event struct {
+	// Type of the metric: counter|gauge|sample
+	Type  string
+	Key   string
+	Value float64
+	Tags  []Tag
+	Time  time.Time
 }
 
 // IntervalMetrics stores the aggregated metrics
@@ -54,6 +87,24 @@ type IntervalMetrics struct {
 	// Samples maps the key to an AggregateSample,
 	// which has the rolled up view of a sample
 	Samples map[string]SampledValue
+
+	// shards keep the values of the current interval of InmemSink,
+	// so concurrent emissions to different keys do not contend.
+	// The shards are merged into the maps above when the interval is completed.
+	shards []intervalShard
+}
+
+// inmemShards is the number of shards of the current interval
+const inmemShards = 16
+
+// intervalShard stores the values for a subset of the keys
+type intervalShard struct {
+	sync.Mutex
+	// merged is set when the values are moved to IntervalMetrics
+	merged   bool
+	gauges   map[string]GaugeValue
+	counters map[string]SampledValue
+	samples  map[string]SampledValue
 }
 
 // NewIntervalMetrics creates a new IntervalMetrics for a given interval
@@ -67,6 +118,65 @@ func NewIntervalMetrics(intv time.Time) *IntervalMetrics {
 	}
 }
 
+func newShardedIntervalMetrics(intv time.Time) *IntervalMetrics {
+	m := NewIntervalMetrics(intv)
+	m.shards = make([]intervalShard, inmemShards)
+	for s := range m.shards {
+		m.shards[s].gauges = make(map[string]GaugeValue)
+		m.shards[s].counters = make(map[string]SampledValue)
+		m.shards[s].samples = make(map[string]SampledValue)
+	}
+	return m
+}
+
+// update calls fn with the maps to store the key,
+// under the lock of the key's shard, or the interval lock when merged
+func (m *IntervalMetrics) update(key string, fn func(gauges map[string]GaugeValue, counters, samples map[string]SampledValue)) {
+	if m.shards != nil {
+		sh := &m.shards[shardIndex(key)]
+		sh.Lock()
+		if !sh.merged {
+			fn(sh.gauges, sh.counters, sh.samples)
+			sh.Unlock()
+			return
+		}
+		sh.Unlock()
+	}
+
+	// the interval is completed, or not sharded
+	m.Lock()
+	fn(m.Gauges, m.Counters, m.Samples)
+	m.Unlock()
+}
+
+// mergeShards moves the values of the shards into the maps
+func (m *IntervalMetrics) mergeShards() {
+	m.Lock()
+	defer m.Unlock()
+	for s := range m.shards {
+		sh := &m.shards[s]
+		sh.Lock()
+		if !sh.merged {
+			maps.Copy(m.Gauges, sh.gauges)
+			maps.Copy(m.Counters, sh.counters)
+			maps.Copy(m.Samples, sh.samples)
+			sh.merged = true
+			sh.gauges, sh.counters, sh.samples = nil, nil, nil
+		}
+		sh.Unlock()
+	}
+}
+
+// shardIndex returns the shard of the key, using FNV-1a hash
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % inmemShards)
+}
+
 // NewInmemSinkFromURL creates an InmemSink from a URL. It is used
 // (and tested) from NewMetricSinkFromURL.
 func NewInmemSinkFromURL(u *url.URL) (Sink, error) {
@@ -82,7 +192,27 @@ func NewInmemSinkFromURL(u *url.URL) (Sink, error) {
 		return nil, errors.WithMessage(err, "bad 'retain' param")
 	}
 
-	return NewInmemSink(interval, retain), nil
+	sink := NewInmemSink(interval, retain)
+	if v := params.Get("rateUnit"); v != "" {
+		unit, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.WithMessage(err, "bad 'rateUnit' param")
+		}
+		if unit <= 0 {
+			return nil, errors.Errorf("bad 'rateUnit' param: must be positive: %q", v)
+		}
+		sink.WithRateUnit(unit)
+	}
+	if v := params.Get("quantiles"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.WithMessage(err, "bad 'quantiles' param")
+		}
+		if enabled {
+			sink.WithQuantiles(DefaultQuantileCompression)
+		}
+	}
+	return sink, nil
 }
 
 // NewInmemSink is used to construct a new in-memory sink.
@@ -94,59 +224,143 @@ func NewInmemSink(interval, retain time.Duration) *InmemSink {
 		retain:       retain,
 		maxIntervals: int(retain / interval),
 		rateDenom:    float64(interval.Nanoseconds()) / float64(rateTimeUnit.Nanoseconds()),
+		now:          time.Now,
 	}
 	i.intervals = make([]*IntervalMetrics, 0, i.maxIntervals)
 	return i
 }
 
+// WithRateUnit sets the time unit of the Rate of counters and samples,
+// by default 1 second. It must be called before the sink is used.
+func (i *InmemSink) WithRateUnit(unit time.Duration) *InmemSink {
+	i.rateDenom = float64(i.interval.Nanoseconds()) / float64(unit.Nanoseconds())
+	return i
+}
+
+// WithQuantiles enables to track the approximate quantiles of samples,
+// with the provided compression of the sketch, see DefaultQuantileCompression.
+// It must be called before the sink is used.
+func (i *InmemSink) WithQuantiles(compression float64) *InmemSink {
+	if compression <= 0 {
+		compression = DefaultQuantileCompression
+	}
+	i.quantiles = compression
+	return i
+}
+
+// WithEventLog enables to keep the last n emissions, regardless of the intervals,
+// to be returned by RecentEvents. It must be called before the sink is used.
+func (i *InmemSink) WithEventLog(n int) *InmemSink {
+	if n > 0 {
+		i.events = make([]Event, n)
+	}
+	return i
+}
+
+// RecentEvents returns the recent emissions in order, if WithEventLog is enabled
+func (i *InmemSink) RecentEvents() []Event {
+	i.eventsLock.Lock()
+	defer i.eventsLock.Unlock()
+	if !i.eventsFull {
+		return append([]Event(nil), i.events[:i.eventsNext]...)
+	}
+	list := make([]Event, 0, len(i.events))
+	list = append(list, i.events[i.eventsNext:]...)
+	return append(list, i.events[:i.eventsNext]...)
+}
+
+func (i *InmemSink) recordEvent(typ, key string, val float64, tags []Tag) {
+	if i.events == nil {
+		return
+	}
+	e := Event{Type: typ, Key: key, Value: val, Tags: tags, Time: i.now()}
+	i.eventsLock.Lock()
+	i.events[i.eventsNext] = e
+	i.eventsNext++
+	if i.eventsNext == len(i.events) {
+		i.eventsNext = 0
+		i.eventsFull = true
+	}
+	i.eventsLock.Unlock()
+}
+
 // SetGauge should retain the last value it is set to
 func (i *InmemSink) SetGauge(key string, val float64, tags []Tag) {
+	i.recordEvent(TypeGauge, key, val, tags)
 	k, name := i.flattenKeyLabels(key, tags)
 	intv := i.getInterval()
 
-	intv.Lock()
-	defer intv.Unlock()
-	intv.Gauges[k] = GaugeValue{Name: name, Value: val, Labels: tags}
+	intv.update(k, func(gauges map[string]GaugeValue, _, _ map[string]SampledValue) {
+		gauges[k] = GaugeValue{Name: name, Value: val, Labels: tags}
+	})
 }
 
 // IncrCounter should accumulate values
 func (i *InmemSink) IncrCounter(key string, val float64, tags []Tag) {
+	i.recordEvent(TypeCounter, key, val, tags)
 	k, name := i.flattenKeyLabels(key, tags)
 	intv := i.getInterval()
 
-	intv.Lock()
-	defer intv.Unlock()
-
-	agg, ok := intv.Counters[k]
-	if !ok {
-		agg = SampledValue{
-			Name:            name,
-			AggregateSample: &AggregateSample{},
-			Labels:          tags,
+	intv.update(k, func(_ map[string]GaugeValue, counters, _ map[string]SampledValue) {
+		agg, ok := counters[k]
+		if !ok {
+			agg = SampledValue{
+				Name:            name,
+				AggregateSample: &AggregateSample{},
+				Labels:          tags,
+			}
+			counters[k] = agg
 		}
-		intv.Counters[k] = agg
-	}
-	agg.Ingest(float64(val), i.rateDenom)
+		agg.Ingest(float64(val), i.rateDenom)
+	})
 }
 
 // AddSample is for timing information, where quantiles are used
 func (i *InmemSink) AddSample(key string, val float64, tags []Tag) {
+	i.recordEvent(TypeSample, key, val, tags)
 	k, name := i.flattenKeyLabels(key, tags)
 	intv := i.getInterval()
 
-	intv.Lock()
-	defer intv.Unlock()
+	intv.update(k, func(_ map[string]GaugeValue, _, samples map[string]SampledValue) {
+		agg, ok := samples[k]
+		if !ok {
+			agg = SampledValue{
+				Name:            name,
+				AggregateSample: i.newSample(),
+				Labels:          tags,
+			}
+			samples[k] = agg
+		}
+		agg.Ingest(float64(val), i.rateDenom)
+	})
+}
+
+// AddSampleN is used to add the sample observed n times
+func (i *InmemSink) AddSampleN(key string, val float64, n int, tags []Tag) {
+	i.recordEvent(TypeSample, key, val, tags)
+	k, name := i.flattenKeyLabels(key, tags)
+	intv := i.getInterval()
 
-	agg, ok := intv.Samples[k]
-	if !ok {
-		agg = SampledValue{
-			Name:            name,
-			AggregateSample: &AggregateSample{},
-			Labels:          tags,
+	intv.update(k, func(_ map[string]GaugeValue, _, samples map[string]SampledValue) {
+		agg, ok := samples[k]
+		if !ok {
+			agg = SampledValue{
+				Name:            name,
+				AggregateSample: i.newSample(),
+				Labels:          tags,
+			}
+			samples[k] = agg
 		}
-		intv.Samples[k] = agg
+		agg.IngestN(val, n, i.rateDenom)
+	})
+}
+
+func (i *InmemSink) newSample() *AggregateSample {
+	a := &AggregateSample{}
+	if i.quantiles > 0 {
+		a.quantiles = newQuantileSketch(i.quantiles)
 	}
-	agg.Ingest(float64(val), i.rateDenom)
+	return a
 }
 
 // Data is used to retrieve all the aggregated metrics
@@ -189,35 +403,65 @@ func (i *InmemSink) Data() []*IntervalMetrics {
 	for k, v := range current.Samples {
 		copyCurrent.Samples[k] = v
 	}
+	// merge the values of the shards, unless already merged
+	for s := range current.shards {
+		sh := &current.shards[s]
+		sh.Lock()
+		maps.Copy(copyCurrent.Gauges, sh.gauges)
+		maps.Copy(copyCurrent.Counters, sh.counters)
+		maps.Copy(copyCurrent.Samples, sh.samples)
+		sh.Unlock()
+	}
 	current.RUnlock()
 
 	return intervals
 }
 
-func (i *InmemSink) getExistingInterval(intv time.Time) *IntervalMetrics {
-	i.intervalLock.RLock()
-	defer i.intervalLock.RUnlock()
+// Drain returns and removes the completed intervals, so each interval
+// is returned once, to be consumed by another goroutine. The current interval is kept.
+// Intervals may be in use, and a read lock should be acquired
+func (i *InmemSink) Drain() []*IntervalMetrics {
+	// Get the current interval, forces creation
+	i.getInterval()
+
+	i.intervalLock.Lock()
+	defer i.intervalLock.Unlock()
 
 	n := len(i.intervals)
-	if n > 0 && i.intervals[n-1].Interval == intv {
-		return i.intervals[n-1]
+	completed := slices.Clone(i.intervals[:n-1])
+	i.intervals[0] = i.intervals[n-1]
+	clear(i.intervals[1:])
+	i.intervals = i.intervals[:1]
+	return completed
+}
+
+func (i *InmemSink) getExistingInterval(intv time.Time) *IntervalMetrics {
+	if m := i.current.Load(); m != nil && m.Interval == intv {
+		return m
 	}
 	return nil
 }
 
-func (i *InmemSink) createInterval(intv time.Time) *IntervalMetrics {
+// createInterval returns the current interval,
+// and the completed interval if the new one is created
+func (i *InmemSink) createInterval(intv time.Time) (current, completed *IntervalMetrics) {
 	i.intervalLock.Lock()
 	defer i.intervalLock.Unlock()
 
 	// Check for an existing interval
 	n := len(i.intervals)
-	if n > 0 && i.intervals[n-1].Interval == intv {
-		return i.intervals[n-1]
+	if n > 0 {
+		if i.intervals[n-1].Interval == intv {
+			return i.intervals[n-1], nil
+		}
+		completed = i.intervals[n-1]
+		completed.mergeShards()
 	}
 
 	// Add the current interval
-	current := NewIntervalMetrics(intv)
+	current = newShardedIntervalMetrics(intv)
 	i.intervals = append(i.intervals, current)
+	i.current.Store(current)
 	n++
 
 	// Truncate the intervals if they are too long
@@ -225,27 +469,38 @@ func (i *InmemSink) createInterval(intv time.Time) *IntervalMetrics {
 		copy(i.intervals[0:], i.intervals[n-i.maxIntervals:])
 		i.intervals = i.intervals[:i.maxIntervals]
 	}
-	return current
+	return current, completed
 }
 
 // getInterval returns the current interval to write to
 func (i *InmemSink) getInterval() *IntervalMetrics {
-	intv := time.Now().Truncate(i.interval)
+	intv := i.now().Truncate(i.interval)
 	if m := i.getExistingInterval(intv); m != nil {
 		return m
 	}
-	return i.createInterval(intv)
+	current, completed := i.createInterval(intv)
+	// the callback is called outside of the interval lock
+	if completed != nil && i.OnIntervalComplete != nil {
+		i.OnIntervalComplete(completed)
+	}
+	return current
 }
 
 // Flattens the key for formatting along with its tags, removes spaces
 func (i *InmemSink) flattenKeyLabels(key string, tags []Tag) (string, string) {
-	buf := &bytes.Buffer{}
-	replacer := strings.NewReplacer(" ", "_")
+	// fast path for tagless keys without spaces
+	if len(tags) == 0 && !strings.Contains(key, " ") {
+		return key, key
+	}
 
-	_, _ = replacer.WriteString(buf, key)
+	buf := &bytes.Buffer{}
+	_, _ = keyReplacer.WriteString(buf, key)
 
 	for _, label := range tags {
-		_, _ = replacer.WriteString(buf, fmt.Sprintf(";%s=%s", label.Name, label.Value))
+		buf.WriteByte(';')
+		_, _ = keyReplacer.WriteString(buf, label.Name)
+		buf.WriteByte('=')
+		_, _ = keyReplacer.WriteString(buf, label.Value)
 	}
 
 	return buf.String(), key
@@ -38,6 +38,8 @@ type SampledValue struct {
 	*AggregateSample
 	Mean   float64
 	Stddev float64
+	// Quantiles has p50, p95 and p99, if tracked with InmemSink.WithQuantiles
+	Quantiles map[string]float64 `json:",omitempty"`
 
 	Labels        []Tag             `json:"-"`
 	DisplayLabels map[string]string `json:"Labels"`
@@ -54,10 +56,10 @@ func (i *InmemSink) DisplayMetrics() (*Summary, error) {
 		return nil, fmt.Errorf("no metric intervals have been initialized yet")
 	case n == 1:
 		// Show the current interval if it's all we have
-		interval = i.intervals[0]
+		interval = data[0]
 	default:
 		// Show the most recent finished interval if we have one
-		interval = i.intervals[n-2]
+		interval = data[n-2]
 	}
 
 	summary := Summary{
@@ -112,6 +114,7 @@ func formatSamples(source map[string]SampledValue) []SampledValue {
 			AggregateSample: sample.AggregateSample,
 			Mean:            sample.AggregateSample.Mean(),
 			Stddev:          sample.AggregateSample.Stddev(),
+			Quantiles:       displayQuantiles(sample.AggregateSample),
 			DisplayLabels:   displayLabels,
 		})
 	}
@@ -121,3 +124,14 @@ func formatSamples(source map[string]SampledValue) []SampledValue {
 
 	return output
 }
+
+func displayQuantiles(a *AggregateSample) map[string]float64 {
+	if a.quantiles == nil || a.Count == 0 {
+		return nil
+	}
+	return map[string]float64{
+		"p50": a.Quantile(0.5),
+		"p95": a.Quantile(0.95),
+		"p99": a.Quantile(0.99),
+	}
+}
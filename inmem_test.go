@@ -1,6 +1,11 @@
 package metrics_test
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -16,7 +21,6 @@ func Test_NewInmemSink(t *testing.T) {
 		FilterDefault:        true,
 		HostName:             "test",
 		ServiceName:          "test",
-		EnableHostname:       true,
 		EnableHostnameLabel:  true,
 		EnableServiceLabel:   true,
 		EnableRuntimeMetrics: true,
@@ -87,3 +91,272 @@ func Test_InmemSink_Signal_Signal(t *testing.T) {
 	data := im.Data()
 	require.NotEmpty(t, data)
 }
+
+func Test_InmemSink_KeysWithSpaces(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	im.SetGauge("my gauge", 1, nil)
+	im.IncrCounter("my_counter", 1, nil)
+	im.AddSample("my sample", 1, []metrics.Tag{{Name: "tag name", Value: "tag value"}})
+
+	data := im.Data()
+	require.Len(t, data, 1)
+	assert.Equal(t, "my gauge", data[0].Gauges["my_gauge"].Name)
+	assert.Equal(t, "my_counter", data[0].Counters["my_counter"].Name)
+	assert.Equal(t, "my sample", data[0].Samples["my_sample;tag_name=tag_value"].Name)
+}
+
+func BenchmarkInmemSink_Tagless(b *testing.B) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		im.IncrCounter("test_metrics_counter", 1, nil)
+	}
+}
+
+// BenchmarkInmemSink_Parallel emits to different keys concurrently
+func BenchmarkInmemSink_Parallel(b *testing.B) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	keys := make([]string, 64)
+	for i := 0; i < len(keys); i++ {
+		keys[i] = fmt.Sprintf("test_metrics_counter_%d", i)
+	}
+	var worker atomic.Int32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := int(worker.Add(1))
+		for pb.Next() {
+			key := keys[n%len(keys)]
+			im.IncrCounter(key, 1, nil)
+			im.AddSample(key, 1, nil)
+			n++
+		}
+	})
+}
+
+func BenchmarkInmemSink_Tags(b *testing.B) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	tags := []metrics.Tag{
+		{Name: "method", Value: "get"},
+		{Name: "status", Value: "ok with spaces"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		im.IncrCounter("test metrics counter", 1, tags)
+	}
+}
+
+func Test_InmemSink_RecentEvents(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	inm := metrics.NewInmemSink(10*time.Second, time.Minute)
+	metrics.SetInmemClock(inm, func() time.Time { return now })
+	assert.Empty(t, inm.RecentEvents())
+
+	inm = inm.WithEventLog(3)
+	tags := []metrics.Tag{{Name: "method", Value: "get"}}
+	inm.SetGauge("test_gauge", 1, nil)
+	inm.IncrCounter("test_counter", 2, tags)
+	assert.Equal(t, []metrics.Event{
+		{Type: metrics.TypeGauge, Key: "test_gauge", Value: 1, Time: now},
+		{Type: metrics.TypeCounter, Key: "test_counter", Value: 2, Tags: tags, Time: now},
+	}, inm.RecentEvents())
+
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		inm.AddSample("test_sample", float64(i), nil)
+	}
+	events := inm.RecentEvents()
+	require.Len(t, events, 3)
+	for i, e := range events {
+		assert.Equal(t, metrics.TypeSample, e.Type)
+		assert.Equal(t, float64(i+2), e.Value)
+		assert.Equal(t, time.Date(2024, 1, 1, 0, 0, i+3, 0, time.UTC), e.Time)
+	}
+
+	// the aggregation is not changed
+	assert.Equal(t, 5, inm.Data()[0].Samples["test_sample"].Count)
+}
+
+func Test_InmemSink_Drain(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	inm := metrics.NewInmemSink(10*time.Second, time.Minute)
+	metrics.SetInmemClock(inm, func() time.Time { return now })
+
+	assert.Empty(t, inm.Drain())
+
+	inm.IncrCounter("test_counter", 1, nil)
+	now = now.Add(10 * time.Second)
+	inm.IncrCounter("test_counter", 2, nil)
+	now = now.Add(10 * time.Second)
+	inm.IncrCounter("test_counter", 3, nil)
+
+	drained := inm.Drain()
+	require.Len(t, drained, 2)
+	assert.Equal(t, float64(1), drained[0].Counters["test_counter"].Sum)
+	assert.Equal(t, float64(2), drained[1].Counters["test_counter"].Sum)
+
+	// the current interval is kept
+	data := inm.Data()
+	require.Len(t, data, 1)
+	assert.Equal(t, float64(3), data[0].Counters["test_counter"].Sum)
+	assert.Empty(t, inm.Drain())
+
+	inm.IncrCounter("test_counter", 4, nil)
+	now = now.Add(10 * time.Second)
+	drained = inm.Drain()
+	require.Len(t, drained, 1)
+	assert.Equal(t, now.Add(-10*time.Second), drained[0].Interval)
+	assert.Equal(t, float64(7), drained[0].Counters["test_counter"].Sum)
+	assert.Empty(t, inm.Drain())
+}
+
+func Test_InmemSink_Parallel(t *testing.T) {
+	var now atomic.Int64
+	now.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	inm := metrics.NewInmemSink(10*time.Second, time.Minute)
+	metrics.SetInmemClock(inm, func() time.Time { return time.Unix(0, now.Load()).UTC() })
+
+	const workers = 8
+	const emits = 1000
+	keys := []string{"test_a", "test_b", "test_c", "test_d"}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < emits; i++ {
+				key := keys[(w+i)%len(keys)]
+				inm.IncrCounter(key, 1, nil)
+				inm.AddSample(key, 2, nil)
+				inm.SetGauge(key, float64(w), nil)
+				_ = inm.Data()
+			}
+		}()
+	}
+	// complete the interval while emitting
+	time.Sleep(time.Millisecond)
+	now.Add(int64(10 * time.Second))
+	wg.Wait()
+
+	counts := map[string]int{}
+	sums := map[string]float64{}
+	for _, intv := range inm.Data() {
+		for k, v := range intv.Counters {
+			counts[k] += v.Count
+		}
+		for k, v := range intv.Samples {
+			sums[k] += v.Sum
+		}
+	}
+	for _, key := range keys {
+		assert.Equal(t, workers*emits/len(keys), counts[key], key)
+		assert.Equal(t, float64(2*workers*emits/len(keys)), sums[key], key)
+	}
+}
+
+func Test_InmemSink_Quantiles(t *testing.T) {
+	inm := metrics.NewInmemSink(time.Minute, time.Minute).WithQuantiles(0)
+
+	// uniform distribution of 1..10000 in random order
+	rnd := rand.New(rand.NewSource(1))
+	for _, v := range rnd.Perm(10000) {
+		inm.AddSample("test_sample", float64(v+1), nil)
+	}
+	inm.AddSample("test_single", 3, nil)
+	inm.IncrCounter("test_counter", 1, nil)
+
+	data := inm.Data()
+	sample := data[0].Samples["test_sample"]
+	assert.InDelta(t, 5000, sample.Quantile(0.5), 50)
+	assert.InDelta(t, 9500, sample.Quantile(0.95), 50)
+	assert.InDelta(t, 9900, sample.Quantile(0.99), 20)
+	assert.Equal(t, float64(1), sample.Quantile(0))
+	assert.Equal(t, float64(10000), sample.Quantile(1))
+	assert.Equal(t, float64(3), data[0].Samples["test_single"].Quantile(0.95))
+	assert.True(t, math.IsNaN(data[0].Counters["test_counter"].Quantile(0.5)))
+
+	summary, err := inm.DisplayMetrics()
+	require.NoError(t, err)
+	require.Len(t, summary.Samples, 2)
+	assert.InDelta(t, 9500, summary.Samples[0].Quantiles["p95"], 50)
+	assert.Nil(t, summary.Counters[0].Quantiles)
+
+	// weighted samples
+	inm = metrics.NewInmemSink(time.Minute, time.Minute).WithQuantiles(50)
+	for i := 1; i <= 100; i++ {
+		inm.AddSampleN("test_sample", float64(i), 10, nil)
+	}
+	sample = inm.Data()[0].Samples["test_sample"]
+	assert.Equal(t, 1000, sample.Count)
+	assert.InDelta(t, 50, sample.Quantile(0.5), 2)
+	assert.InDelta(t, 95, sample.Quantile(0.95), 2)
+
+	// not tracked by default
+	inm = metrics.NewInmemSink(time.Minute, time.Minute)
+	inm.AddSample("test_sample", 1, nil)
+	assert.True(t, math.IsNaN(inm.Data()[0].Samples["test_sample"].Quantile(0.5)))
+}
+
+func Test_InmemSink_OnIntervalComplete(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	inm := metrics.NewInmemSink(10*time.Second, time.Minute)
+	metrics.SetInmemClock(inm, func() time.Time { return now })
+
+	var completed []*metrics.IntervalMetrics
+	inm.OnIntervalComplete = func(intv *metrics.IntervalMetrics) {
+		// must not deadlock with the sink
+		inm.Data()
+		intv.RLock()
+		defer intv.RUnlock()
+		completed = append(completed, intv)
+	}
+
+	inm.SetGauge("test_gauge", 1, nil)
+	inm.IncrCounter("test_counter", 2, nil)
+	now = now.Add(5 * time.Second)
+	inm.IncrCounter("test_counter", 3, nil)
+	assert.Empty(t, completed)
+
+	now = now.Add(5 * time.Second)
+	inm.SetGauge("test_gauge", 2, nil)
+	require.Len(t, completed, 1)
+	intv := completed[0]
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), intv.Interval)
+	assert.Equal(t, float64(1), intv.Gauges["test_gauge"].Value)
+	assert.Equal(t, float64(5), intv.Counters["test_counter"].Sum)
+
+	now = now.Add(20 * time.Second)
+	inm.Data()
+	require.Len(t, completed, 2)
+	assert.Equal(t, float64(2), completed[1].Gauges["test_gauge"].Value)
+}
+
+func Test_AggregateSample_IngestN(t *testing.T) {
+	weighted := &metrics.AggregateSample{}
+	weighted.IngestN(2, 3, 1)
+	weighted.IngestN(5, 0, 1)
+	weighted.IngestN(1, 2, 1)
+
+	expected := &metrics.AggregateSample{}
+	for _, v := range []float64{2, 2, 2, 1, 1} {
+		expected.Ingest(v, 1)
+	}
+
+	assert.Equal(t, 5, weighted.Count)
+	assert.Equal(t, float64(8), weighted.Sum)
+	assert.Equal(t, float64(14), weighted.SumSq)
+	assert.Equal(t, float64(1), weighted.Min)
+	assert.Equal(t, float64(2), weighted.Max)
+	assert.Equal(t, expected.Mean(), weighted.Mean())
+	assert.Equal(t, expected.Stddev(), weighted.Stddev())
+	assert.Equal(t, expected.Rate, weighted.Rate)
+
+	// negative values are the first min and max
+	neg := &metrics.AggregateSample{}
+	neg.IngestN(-3, 2, 1)
+	assert.Equal(t, float64(-3), neg.Min)
+	assert.Equal(t, float64(-3), neg.Max)
+}
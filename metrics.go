@@ -1,36 +1,214 @@
 package metrics
 
 import (
+	"context"
+	"math"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
+
+	"github.com/effective-security/xlog"
 )
 
 // SetGauge should retain the last value it is set to
 func (m *Metrics) SetGauge(key string, val float64, tags ...Tag) {
+	val, ok := m.gaugeValue(val)
+	if !ok {
+		return
+	}
+	sink := m.sinkFor(TypeGauge)
+	if sink == nil {
+		return
+	}
+	allowed, keys, labels := m.Prepare(TypeGauge, key, tags...)
+	if !allowed {
+		return
+	}
+	sink.SetGauge(keys, val, labels)
+}
+
+// gaugeValue applies NaNGaugeBehavior to the value,
+// and returns false if the gauge should be dropped
+func (m *Metrics) gaugeValue(val float64) (float64, bool) {
+	if !math.IsNaN(val) {
+		return val, true
+	}
+	switch m.NaNGaugeBehavior {
+	case NaNGaugeZero:
+		return 0, true
+	case NaNGaugePass:
+		return val, true
+	default:
+		return val, false
+	}
+}
+
+// SetGaugeClamped sets the gauge to the value clamped into [min, max],
+// and increments `<key>_clamped_total` counter if the value is out of the range.
+func (m *Metrics) SetGaugeClamped(key string, val, min, max float64, tags ...Tag) {
+	if clamped := math.Max(min, math.Min(max, val)); clamped != val && !math.IsNaN(val) {
+		val = clamped
+		m.IncrCounter(key+"_clamped_total", 1, tags...)
+	}
+	m.SetGauge(key, val, tags...)
+}
+
+// defaultMaxEMASeries is the default of Config.MaxEMASeries
+const defaultMaxEMASeries = 1000
+
+// SetGaugeEMA sets the gauge to the exponential moving average of the values,
+// with the smoothing factor alpha in (0, 1]: ema = alpha*val + (1-alpha)*ema.
+// The first value of the series is emitted as is.
+// Over MaxEMASeries, the values of the new series are emitted without smoothing.
+func (m *Metrics) SetGaugeEMA(key string, val, alpha float64, tags ...Tag) {
+	if m.EmitRawEMA {
+		m.SetGauge(key+"_raw", val, tags...)
+	}
+	val, ok := m.gaugeValue(val)
+	if !ok {
+		return
+	}
+
+	sink := m.sinkFor(TypeGauge)
+	if sink == nil {
+		return
+	}
+	allowed, keys, labels := m.Prepare(TypeGauge, key, tags...)
+	if !allowed {
+		return
+	}
+
+	maxSeries := m.MaxEMASeries
+	if maxSeries <= 0 {
+		maxSeries = defaultMaxEMASeries
+	}
+
+	_, hash := FlattenKey(keys, labels)
+	m.emaLock.Lock()
+	if m.emas == nil {
+		m.emas = make(map[string]float64)
+	}
+	if ema, ok := m.emas[hash]; ok {
+		val = alpha*val + (1-alpha)*ema
+		m.emas[hash] = val
+	} else if len(m.emas) < maxSeries {
+		m.emas[hash] = val
+	}
+	m.emaLock.Unlock()
+
+	sink.SetGauge(keys, val, labels)
+}
+
+// defaultMaxChangedSeries is the default of Config.MaxChangedSeries
+const defaultMaxChangedSeries = 1000
+
+// SetGaugeIfChanged sets the gauge only if the value differs from the last emitted,
+// and returns true if the value was emitted.
+// Over MaxChangedSeries, the values of the new series are always emitted.
+func (m *Metrics) SetGaugeIfChanged(key string, val float64, tags ...Tag) bool {
+	val, ok := m.gaugeValue(val)
+	if !ok {
+		return false
+	}
+	sink := m.sinkFor(TypeGauge)
+	if sink == nil {
+		return false
+	}
+	allowed, keys, labels := m.Prepare(TypeGauge, key, tags...)
+	if !allowed {
+		return false
+	}
+
+	maxSeries := m.MaxChangedSeries
+	if maxSeries <= 0 {
+		maxSeries = defaultMaxChangedSeries
+	}
+
+	_, hash := FlattenKey(keys, labels)
+	m.lastGaugesLock.Lock()
+	if m.lastGauges == nil {
+		m.lastGauges = make(map[string]float64)
+	}
+	if last, ok := m.lastGauges[hash]; ok {
+		if last == val {
+			m.lastGaugesLock.Unlock()
+			return false
+		}
+		m.lastGauges[hash] = val
+	} else if len(m.lastGauges) < maxSeries {
+		m.lastGauges[hash] = val
+	}
+	m.lastGaugesLock.Unlock()
+
+	sink.SetGauge(keys, val, labels)
+	return true
+}
+
+// SetGaugeAt sets the gauge with the provided timestamp,
+// if the sink implements TimestampedSink, otherwise the timestamp is ignored.
+func (m *Metrics) SetGaugeAt(key string, val float64, ts time.Time, tags ...Tag) {
+	val, ok := m.gaugeValue(val)
+	if !ok {
+		return
+	}
+	sink := m.sinkFor(TypeGauge)
+	if sink == nil {
+		return
+	}
 	allowed, keys, labels := m.Prepare(TypeGauge, key, tags...)
 	if !allowed {
 		return
 	}
-	m.sink.SetGauge(keys, val, labels)
+	if tsink, ok := sink.(TimestampedSink); ok {
+		tsink.SetGaugeAt(keys, val, ts, labels)
+		return
+	}
+	sink.SetGauge(keys, val, labels)
 }
 
 // IncrCounter should accumulate values
 func (m *Metrics) IncrCounter(key string, val float64, tags ...Tag) {
+	sink := m.sinkFor(TypeCounter)
+	if sink == nil {
+		return
+	}
 	allowed, keys, labels := m.Prepare(TypeCounter, key, tags...)
 	if !allowed {
 		return
 	}
-	m.sink.IncrCounter(keys, val, labels)
+	sink.IncrCounter(keys, val, labels)
+}
+
+// InitCounter registers the counter at 0, so it is exposed before the first increment,
+// if the sink implements CounterInitSink, otherwise it is a no-op.
+func (m *Metrics) InitCounter(key string, tags ...Tag) {
+	sink := m.sinkFor(TypeCounter)
+	if sink == nil {
+		return
+	}
+	is, ok := sink.(CounterInitSink)
+	if !ok {
+		return
+	}
+	allowed, keys, labels := m.Prepare(TypeCounter, key, tags...)
+	if !allowed {
+		return
+	}
+	is.InitCounter(keys, labels)
 }
 
 // AddSample is for timing information, where quantiles are used
 func (m *Metrics) AddSample(key string, val float64, tags ...Tag) {
+	sink := m.sinkFor(TypeSample)
+	if sink == nil {
+		return
+	}
 	allowed, keys, labels := m.Prepare(TypeSample, key, tags...)
 	if !allowed {
 		return
 	}
-	m.sink.AddSample(keys, val, labels)
+	sink.AddSample(keys, val, labels)
 }
 
 // MeasureSince is for timing information
@@ -38,24 +216,330 @@ func (m *Metrics) MeasureSince(key string, start time.Time, tags ...Tag) {
 	elapsed := time.Since(start)
 	msec := float64(elapsed.Nanoseconds()) / float64(m.TimerGranularity)
 
+	sink := m.sinkFor(TypeSample)
+	if sink == nil {
+		return
+	}
+	allowed, keys, labels := m.Prepare(TypeTimer, key, tags...)
+	if !allowed {
+		return
+	}
+	sink.AddSample(keys, msec, labels)
+}
+
+// AddSampleN adds the sample observed n times, for example a batch of n events.
+// If the sink does not implement WeightedSink, the sample is added n times.
+func (m *Metrics) AddSampleN(key string, val float64, n int, tags ...Tag) {
+	sink := m.sinkFor(TypeSample)
+	if sink == nil {
+		return
+	}
 	allowed, keys, labels := m.Prepare(TypeSample, key, tags...)
 	if !allowed {
 		return
 	}
-	m.sink.AddSample(keys, msec, labels)
+	if ws, ok := sink.(WeightedSink); ok {
+		ws.AddSampleN(keys, val, n, labels)
+		return
+	}
+	for i := 0; i < n; i++ {
+		sink.AddSample(keys, val, labels)
+	}
+}
+
+// EmitPreparedGauge sets the gauge with key and tags returned by Prepare,
+// to avoid the Prepare cost on hot paths.
+// Note that the filters, prefixes and global tags are not applied,
+// the caller must not use it with the raw key, and must prepare again after UpdateFilter.
+func (m *Metrics) EmitPreparedGauge(key string, val float64, tags []Tag) {
+	if sink := m.sinkFor(TypeGauge); sink != nil {
+		sink.SetGauge(key, val, tags)
+	}
+}
+
+// EmitPreparedCounter increments the counter with key and tags returned by Prepare,
+// see EmitPreparedGauge for the limitations.
+func (m *Metrics) EmitPreparedCounter(key string, val float64, tags []Tag) {
+	if sink := m.sinkFor(TypeCounter); sink != nil {
+		sink.IncrCounter(key, val, tags)
+	}
+}
+
+// EmitPreparedSample adds the sample with key and tags returned by Prepare,
+// see EmitPreparedGauge for the limitations.
+func (m *Metrics) EmitPreparedSample(key string, val float64, tags []Tag) {
+	if sink := m.sinkFor(TypeSample); sink != nil {
+		sink.AddSample(key, val, tags)
+	}
+}
+
+// defaultMaxIncrGaugeSeries is the default of Config.MaxIncrGaugeSeries
+const defaultMaxIncrGaugeSeries = 1000
+
+// IncrGauge adjusts the gauge by delta.
+// If the sink implements GaugeDeltaSink, the delta is applied natively,
+// otherwise the current value is tracked and emitted with SetGauge.
+// Over MaxIncrGaugeSeries, the emissions of the new series are dropped and counted,
+// as the current value is unknown.
+func (m *Metrics) IncrGauge(key string, delta float64, tags ...Tag) {
+	sink := m.sinkFor(TypeGauge)
+	if sink == nil {
+		return
+	}
+	allowed, keys, labels := m.Prepare(TypeGauge, key, tags...)
+	if !allowed {
+		return
+	}
+	if ds, ok := sink.(GaugeDeltaSink); ok {
+		ds.IncrGauge(keys, delta, labels)
+		return
+	}
+
+	maxSeries := m.MaxIncrGaugeSeries
+	if maxSeries <= 0 {
+		maxSeries = defaultMaxIncrGaugeSeries
+	}
+
+	_, hash := FlattenKey(keys, labels)
+	m.gaugeLock.Lock()
+	if m.gauges == nil {
+		m.gauges = make(map[string]float64)
+	}
+	cur, ok := m.gauges[hash]
+	if !ok && len(m.gauges) >= maxSeries {
+		m.gaugeLock.Unlock()
+		m.droppedGauges.Add(1)
+		logger.KV(xlog.DEBUG, "reason", "untracked_gauge", "key", keys)
+		return
+	}
+	val := cur + delta
+	m.gauges[hash] = val
+	m.gaugeLock.Unlock()
+
+	sink.SetGauge(keys, val, labels)
+}
+
+// DroppedIncrGauges returns the number of IncrGauge emissions dropped over MaxIncrGaugeSeries
+func (m *Metrics) DroppedIncrGauges() uint64 {
+	return m.droppedGauges.Load()
+}
+
+// IncrRatio increments `<base>_total` counter, and `<base>_errors_total`
+// counter if not success, with the same tags.
+// It is used to emit the pair of counters for SLO calculations.
+func (m *Metrics) IncrRatio(base string, success bool, tags ...Tag) {
+	m.IncrCounter(base+"_total", 1, tags...)
+	if !success {
+		m.IncrCounter(base+"_errors_total", 1, tags...)
+	}
+}
+
+// TimeBlock returns a function to be called when the operation completes,
+// to emit `<key>_duration` sample and increment `<key>_total` counter with the same tags.
+//
+//	defer m.TimeBlock("db_query", tags...)()
+func (m *Metrics) TimeBlock(key string, tags ...Tag) func() {
+	start := time.Now()
+	return func() {
+		m.MeasureSince(key+"_duration", start, tags...)
+		m.IncrCounter(key+"_total", 1, tags...)
+	}
+}
+
+// Sink returns the current sink
+func (m *Metrics) Sink() Sink {
+	return m.sink.Load().(sinkHolder).Sink
+}
+
+// SetSink replaces the sink on the running Metrics,
+// the metrics emitted after the call are sent to the new sink.
+func (m *Metrics) SetSink(sink Sink) {
+	m.sink.Store(sinkHolder{Sink: sink})
+}
+
+// SetEnabled enables or disables the emission of all metrics,
+// for example to stop the emission during an incident without restart
+func (m *Metrics) SetEnabled(enabled bool) {
+	m.disabled.Store(!enabled)
+}
+
+// Enabled returns false if the emission is disabled by SetEnabled
+func (m *Metrics) Enabled() bool {
+	return !m.disabled.Load()
+}
+
+// sinkFor returns the current sink, or nil if the emission is disabled,
+// or the sink implements CapabilitySink and does not support the metric type
+func (m *Metrics) sinkFor(typ string) Sink {
+	if m.disabled.Load() {
+		return nil
+	}
+	sink := m.Sink()
+	if cs, ok := sink.(CapabilitySink); ok && !cs.Supports(typ) {
+		return nil
+	}
+	return sink
+}
+
+// sinkHolder allows to store different Sink types in atomic.Value
+type sinkHolder struct {
+	Sink
+}
+
+// HealthCheck returns an error if the sink implements HealthChecker,
+// and its backend is not reachable
+func (m *Metrics) HealthCheck(ctx context.Context) error {
+	if hc, ok := m.Sink().(HealthChecker); ok {
+		return hc.HealthCheck(ctx)
+	}
+	return nil
+}
+
+// WithContext returns a Provider bound to the context.
+// The context is passed to the sink if it implements ContextSink,
+// otherwise the metrics are emitted as usual.
+func (m *Metrics) WithContext(ctx context.Context) Provider {
+	return &contextMetrics{m: m, ctx: ctx}
+}
+
+// contextMetrics is a Provider bound to a context
+type contextMetrics struct {
+	m   *Metrics
+	ctx context.Context
+}
+
+// SetGauge should retain the last value it is set to
+func (c *contextMetrics) SetGauge(key string, val float64, tags ...Tag) {
+	val, ok := c.m.gaugeValue(val)
+	if !ok {
+		return
+	}
+	sink := c.m.sinkFor(TypeGauge)
+	if sink == nil {
+		return
+	}
+	cs, ok := sink.(ContextSink)
+	if !ok {
+		c.m.SetGauge(key, val, tags...)
+		return
+	}
+	allowed, keys, labels := c.m.Prepare(TypeGauge, key, tags...)
+	if !allowed {
+		return
+	}
+	cs.SetGaugeCtx(c.ctx, keys, val, labels)
+}
+
+// IncrCounter should accumulate values
+func (c *contextMetrics) IncrCounter(key string, val float64, tags ...Tag) {
+	sink := c.m.sinkFor(TypeCounter)
+	if sink == nil {
+		return
+	}
+	cs, ok := sink.(ContextSink)
+	if !ok {
+		c.m.IncrCounter(key, val, tags...)
+		return
+	}
+	allowed, keys, labels := c.m.Prepare(TypeCounter, key, tags...)
+	if !allowed {
+		return
+	}
+	cs.IncrCounterCtx(c.ctx, keys, val, labels)
+}
+
+// AddSample is for timing information, where quantiles are used
+func (c *contextMetrics) AddSample(key string, val float64, tags ...Tag) {
+	c.addSample(TypeSample, key, val, tags)
+}
+
+// MeasureSince is for timing information
+func (c *contextMetrics) MeasureSince(key string, start time.Time, tags ...Tag) {
+	elapsed := time.Since(start)
+	msec := float64(elapsed.Nanoseconds()) / float64(c.m.TimerGranularity)
+	c.addSample(TypeTimer, key, msec, tags)
+}
+
+// addSample emits the sample prepared as typ, TypeSample or TypeTimer
+func (c *contextMetrics) addSample(typ string, key string, val float64, tags []Tag) {
+	sink := c.m.sinkFor(TypeSample)
+	if sink == nil {
+		return
+	}
+	allowed, keys, labels := c.m.Prepare(typ, key, tags...)
+	if !allowed {
+		return
+	}
+	if cs, ok := sink.(ContextSink); ok {
+		cs.AddSampleCtx(c.ctx, keys, val, labels)
+		return
+	}
+	sink.AddSample(keys, val, labels)
 }
 
 // UpdateFilter overwrites the existing filter with the given rules.
+// It is safe to call concurrently with the emission.
 func (m *Metrics) UpdateFilter(allow, block []string) {
-	m.AllowedPrefixes = allow
-	m.BlockedPrefixes = block
+	m.filterLock.Lock()
+	defer m.filterLock.Unlock()
+	m.filter.Store(&prefixFilter{allowed: allow, blocked: block})
+}
+
+// UpdateFilterFrom merges the filter rules of other config with the existing filter.
+// It is safe to call concurrently with the emission and other updates.
+func (m *Metrics) UpdateFilterFrom(other *Config) {
+	if other == nil {
+		return
+	}
+	m.filterLock.Lock()
+	defer m.filterLock.Unlock()
+	f := m.currentFilter()
+	m.filter.Store(&prefixFilter{
+		allowed: unionStrings(f.allowed, other.AllowedPrefixes),
+		blocked: unionStrings(f.blocked, other.BlockedPrefixes),
+	})
+}
+
+// Filter returns the allowed and blocked prefixes of the current filter
+func (m *Metrics) Filter() (allowed, blocked []string) {
+	f := m.currentFilter()
+	return f.allowed, f.blocked
+}
+
+// AddCollector registers a function to be called each ProfileInterval,
+// to emit application stats on the same cadence as the runtime metrics.
+func (m *Metrics) AddCollector(fn func(Provider)) {
+	m.collectorsLock.Lock()
+	m.collectors = append(m.collectors, fn)
+	m.collectorsLock.Unlock()
+
+	m.startCollector()
+}
+
+// startCollector starts the periodic collector, once
+func (m *Metrics) startCollector() {
+	m.collectOnce.Do(func() {
+		go m.collectStats()
+	})
 }
 
 // Periodically collects runtime stats to publish
 func (m *Metrics) collectStats() {
 	for {
 		time.Sleep(m.ProfileInterval)
-		m.emitRuntimeStats()
+		if m.EnableRuntimeMetrics {
+			m.emitRuntimeStats()
+		}
+		if m.EmitInternalMetrics {
+			m.emitInternalStats()
+		}
+
+		m.collectorsLock.RLock()
+		collectors := m.collectors
+		m.collectorsLock.RUnlock()
+		for _, fn := range collectors {
+			fn(m)
+		}
 	}
 }
 
@@ -63,18 +547,25 @@ func (m *Metrics) collectStats() {
 func (m *Metrics) emitRuntimeStats() {
 	// Export number of Goroutines
 	numRoutines := runtime.NumGoroutine()
-	m.SetGauge("runtime_num_goroutines", float64(numRoutines))
+	m.setRuntimeGauge("runtime_num_goroutines", float64(numRoutines))
 
 	// Export memory stats
 	var stats runtime.MemStats
-	runtime.ReadMemStats(&stats)
-	m.SetGauge("runtime_alloc_bytes", float64(stats.Alloc))
-	m.SetGauge("runtime_sys_bytes", float64(stats.Sys))
-	m.SetGauge("runtime_malloc_count", float64(stats.Mallocs))
-	m.SetGauge("runtime_free_count", float64(stats.Frees))
-	m.SetGauge("runtime_heap_objects", float64(stats.HeapObjects))
-	m.SetGauge("runtime_total_gc_pause_ns", float64(stats.PauseTotalNs))
-	m.SetGauge("runtime_total_gc_runs", float64(stats.NumGC))
+	m.readMemStats(&stats)
+	m.setRuntimeGauge("runtime_alloc_bytes", float64(stats.Alloc))
+	m.setRuntimeGauge("runtime_sys_bytes", float64(stats.Sys))
+	m.setRuntimeGauge("runtime_malloc_count", float64(stats.Mallocs))
+	m.setRuntimeGauge("runtime_free_count", float64(stats.Frees))
+	m.setRuntimeGauge("runtime_heap_objects", float64(stats.HeapObjects))
+	m.setRuntimeGauge("runtime_total_gc_pause_ns", float64(stats.PauseTotalNs))
+	m.setRuntimeGauge("runtime_total_gc_runs", float64(stats.NumGC))
+
+	if m.EnableUptimeMetric {
+		m.setRuntimeGauge("runtime_uptime_seconds", m.now().Sub(m.started).Seconds())
+		// the start time is constant, but it is emitted on each interval
+		// to not be expired by sinks
+		m.setRuntimeGauge("process_start_time_seconds", float64(m.started.Unix()))
+	}
 
 	// Export info about the last few GC runs
 	num := stats.NumGC
@@ -89,13 +580,39 @@ func (m *Metrics) emitRuntimeStats() {
 		m.lastNumGC = num - 255
 	}
 
-	for i := m.lastNumGC; i < num; i++ {
-		pause := stats.PauseNs[i%256]
-		m.AddSample("runtime_gc_pause_ns", float64(pause))
+	// Limit the number of the most recent samples
+	if maxSamples := uint32(m.MaxGCPauseSamples); maxSamples > 0 && num-m.lastNumGC > maxSamples {
+		m.lastNumGC = num - maxSamples
+	}
+
+	if !slices.Contains(m.DisabledRuntimeMetrics, "runtime_gc_pause_ns") {
+		for i := m.lastNumGC; i < num; i++ {
+			pause := stats.PauseNs[i%256]
+			m.AddSample("runtime_gc_pause_ns", float64(pause))
+		}
 	}
 	m.lastNumGC = num
 }
 
+// setRuntimeGauge sets the runtime gauge, if not disabled
+func (m *Metrics) setRuntimeGauge(key string, val float64) {
+	if slices.Contains(m.DisabledRuntimeMetrics, key) {
+		return
+	}
+	m.SetGauge(key, val)
+}
+
+// emitInternalStats emits the number of allowed and blocked metrics since the last call.
+// The counters are sent directly to the sink, to not be filtered or counted by Prepare.
+func (m *Metrics) emitInternalStats() {
+	if m.disabled.Load() {
+		return
+	}
+	sink := m.Sink()
+	sink.IncrCounter("metrics_emitted_total", float64(m.emitted.Swap(0)), nil)
+	sink.IncrCounter("metrics_filtered_total", float64(m.filtered.Swap(0)), nil)
+}
+
 // StringStartsWithOneOf returns true if one of items slice is a prefix of specified value.
 func StringStartsWithOneOf(value string, items []string) bool {
 	for _, x := range items {
@@ -105,3 +622,37 @@ func StringStartsWithOneOf(value string, items []string) bool {
 	}
 	return false
 }
+
+var keyReplacer = strings.NewReplacer(" ", "_")
+
+// FlattenKey returns the sanitized metric name, and the canonical hash
+// of the name and tags in `name;tag1=val1;tag2=val2` format.
+// The tags are sorted by name, so the hash does not depend on the tags order.
+// It can be used by sinks to key the series.
+func FlattenKey(key string, tags []Tag) (name, hash string) {
+	name = keyReplacer.Replace(key)
+	if len(tags) == 0 {
+		return name, name
+	}
+	if !slices.IsSortedFunc(tags, compareTags) {
+		tags = slices.Clone(tags)
+		slices.SortStableFunc(tags, compareTags)
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, t := range tags {
+		b.WriteString(";")
+		b.WriteString(t.Name)
+		b.WriteString("=")
+		b.WriteString(t.Value)
+	}
+	return name, b.String()
+}
+
+func compareTags(a, b Tag) int {
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Value, b.Value)
+}
@@ -3,13 +3,22 @@ package metrics_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"net/url"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 
 	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
 	"github.com/effective-security/xlog"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -283,6 +292,37 @@ func Test_NewMetricSinkFromURL_InMem(t *testing.T) {
 	assert.Len(t, first.Samples, 2)
 }
 
+func Test_NewInmemSinkFromURL_RateUnit(t *testing.T) {
+	rate := func(rawURL string) float64 {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		im, err := metrics.NewInmemSinkFromURL(u)
+		require.NoError(t, err)
+		im.IncrCounter("test_counter", 60, nil)
+		return im.(*metrics.InmemSink).Data()[0].Counters["test_counter"].Rate
+	}
+	assert.Equal(t, float64(1), rate("inmem://localhost?interval=1m&retain=5m"))
+	assert.Equal(t, float64(60), rate("inmem://localhost?interval=1m&retain=5m&rateUnit=1m"))
+
+	u, err := url.Parse("inmem://localhost?interval=1m&retain=5m&quantiles=true")
+	require.NoError(t, err)
+	im, err := metrics.NewInmemSinkFromURL(u)
+	require.NoError(t, err)
+	im.AddSample("test_sample", 2, nil)
+	assert.Equal(t, float64(2), im.(*metrics.InmemSink).Data()[0].Samples["test_sample"].Quantile(0.5))
+
+	for rawURL, expErr := range map[string]string{
+		"inmem://localhost?interval=1m&retain=5m&rateUnit=xxx":  "bad 'rateUnit' param: time: invalid duration \"xxx\"",
+		"inmem://localhost?interval=1m&retain=5m&rateUnit=0s":   "bad 'rateUnit' param: must be positive: \"0s\"",
+		"inmem://localhost?interval=1m&retain=5m&quantiles=xxx": "bad 'quantiles' param: strconv.ParseBool: parsing \"xxx\": invalid syntax",
+	} {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		_, err = metrics.NewInmemSinkFromURL(u)
+		assert.EqualError(t, err, expErr)
+	}
+}
+
 func Test_StringStartsWithOneOf(t *testing.T) {
 	tcases := []struct {
 		str    string
@@ -379,3 +419,1225 @@ func Test_DescribeHelp(t *testing.T) {
 	require.Len(t, help, 1)
 	assert.Equal(t, help["global_es_counter_test"], "test counter metric")
 }
+
+func Test_MaxTagValueLength(t *testing.T) {
+	cfg := &metrics.Config{
+		FilterDefault:     true,
+		MaxTagValueLength: 5,
+	}
+	tags := []metrics.Tag{
+		{Name: "short", Value: "val"},
+		{Name: "long", Value: "https://localhost/v1/status"},
+	}
+
+	allowed, key, prepared := cfg.Prepare(metrics.TypeCounter, "test", tags...)
+	assert.True(t, allowed)
+	assert.Equal(t, "test", key)
+	assert.Equal(t, []metrics.Tag{
+		{Name: "short", Value: "val"},
+		{Name: "long", Value: "ht..."},
+	}, prepared)
+	// the original tags must not be modified
+	assert.Equal(t, "https://localhost/v1/status", tags[1].Value)
+
+	// the multibyte values are truncated on a rune boundary
+	_, _, prepared = cfg.Prepare(metrics.TypeCounter, "test", metrics.Tag{Name: "utf8", Value: "ééééé"})
+	assert.Equal(t, []metrics.Tag{{Name: "utf8", Value: "é..."}}, prepared)
+	assert.True(t, utf8.ValidString(prepared[0].Value))
+	assert.LessOrEqual(t, len(prepared[0].Value), cfg.MaxTagValueLength)
+
+	// no room for the suffix
+	cfg.MaxTagValueLength = 3
+	_, _, prepared = cfg.Prepare(metrics.TypeCounter, "test", metrics.Tag{Name: "utf8", Value: "ééééé"})
+	assert.Equal(t, []metrics.Tag{{Name: "utf8", Value: "é"}}, prepared)
+	cfg.MaxTagValueLength = 5
+
+	cfg.DropLongTagValues = true
+	allowed, _, _ = cfg.Prepare(metrics.TypeCounter, "test", tags...)
+	assert.False(t, allowed)
+
+	allowed, _, prepared = cfg.Prepare(metrics.TypeCounter, "test", tags[0])
+	assert.True(t, allowed)
+	assert.Equal(t, []metrics.Tag{{Name: "short", Value: "val"}}, prepared)
+
+	mocked := &mockedSink{t: t}
+	mocked.On("IncrCounter", "test", float64(1), []metrics.Tag{{Name: "short", Value: "val"}}).Times(1)
+
+	prov, err := metrics.New(cfg, mocked)
+	require.NoError(t, err)
+	prov.IncrCounter("test", 1, tags...)
+	prov.IncrCounter("test", 1, tags[0])
+	mocked.AssertExpectations(t)
+}
+
+func Test_IncrRatio(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, im)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "method", Value: "get"}}
+	for _, success := range []bool{true, false, true, true, false} {
+		prov.IncrRatio("requests", success, tags...)
+	}
+
+	data := im.Data()
+	require.Len(t, data, 1)
+	counters := data[0].Counters
+	require.Len(t, counters, 2)
+	assert.Equal(t, 5, counters["requests_total;method=get"].Count)
+	assert.Equal(t, float64(5), counters["requests_total;method=get"].Sum)
+	assert.Equal(t, 2, counters["requests_errors_total;method=get"].Count)
+	assert.Equal(t, float64(2), counters["requests_errors_total;method=get"].Sum)
+
+	_, err = metrics.NewGlobal(&metrics.Config{FilterDefault: true}, im)
+	require.NoError(t, err)
+
+	d := metrics.Describe{
+		Type:         metrics.TypeCounter,
+		Name:         "calls",
+		RequiredTags: []string{"method"},
+	}
+	d.IncrRatio(true, "put")
+	d.IncrRatio(false, "put")
+
+	counters = im.Data()[0].Counters
+	assert.Equal(t, float64(2), counters["calls_total;method=put"].Sum)
+	assert.Equal(t, float64(1), counters["calls_errors_total;method=put"].Sum)
+}
+
+type mockedDeltaSink struct {
+	mockedSink
+}
+
+func (m *mockedDeltaSink) IncrGauge(key string, delta float64, labels []metrics.Tag) {
+	m.Called(key, delta, labels)
+}
+
+func Test_IncrGauge(t *testing.T) {
+	t.Run("emulated", func(t *testing.T) {
+		mocked := &mockedSink{t: t}
+		tags := []metrics.Tag{{Name: "pool", Value: "db"}}
+		mocked.On("SetGauge", "connections", float64(1), tags).Times(1)
+		mocked.On("SetGauge", "connections", float64(2), tags).Times(1)
+		mocked.On("SetGauge", "connections", float64(0), tags).Times(2)
+		mocked.On("SetGauge", "connections", float64(-1), tags).Times(1)
+		mocked.On("SetGauge", "connections", float64(-1), []metrics.Tag(nil)).Times(1)
+		mocked.On("SetGauge", "connections", float64(-2), []metrics.Tag(nil)).Times(1)
+
+		prov, err := metrics.New(&metrics.Config{
+			FilterDefault:      true,
+			MaxIncrGaugeSeries: 2,
+		}, mocked)
+		require.NoError(t, err)
+
+		prov.IncrGauge("connections", 1, tags...)
+		prov.IncrGauge("connections", 1, tags...)
+		prov.IncrGauge("connections", -2, tags...)
+		prov.IncrGauge("connections", -1, tags...)
+		// different tags are tracked separately
+		prov.IncrGauge("connections", -1)
+		prov.IncrGauge("connections", -1)
+		// over MaxIncrGaugeSeries the new series are dropped, not published with the delta as value
+		prov.IncrGauge("requests", 1)
+		prov.IncrGauge("requests", -1)
+		assert.Equal(t, uint64(2), prov.DroppedIncrGauges())
+		// the tracked series are still updated
+		prov.IncrGauge("connections", 1, tags...)
+
+		mocked.AssertExpectations(t)
+	})
+
+	t.Run("native", func(t *testing.T) {
+		mocked := &mockedDeltaSink{mockedSink: mockedSink{t: t}}
+		mocked.On("IncrGauge", "connections", float64(1), []metrics.Tag(nil)).Times(1)
+		mocked.On("IncrGauge", "connections", float64(-3), []metrics.Tag(nil)).Times(1)
+
+		prov, err := metrics.New(&metrics.Config{FilterDefault: true}, mocked)
+		require.NoError(t, err)
+
+		prov.IncrGauge("connections", 1)
+		prov.IncrGauge("connections", -3)
+
+		mocked.AssertExpectations(t)
+		mocked.AssertNotCalled(t, "SetGauge", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func Test_MetricLabels(t *testing.T) {
+	mocked := &mockedSink{t: t}
+	mocked.On("IncrCounter", "es_requests", float64(1), []metrics.Tag{
+		{Name: "region", Value: "us-west-2"},
+		{Name: "env", Value: "test"},
+	}).Times(1)
+	mocked.On("IncrCounter", "es_other", float64(1), []metrics.Tag{
+		{Name: "region", Value: "us-west-2"},
+		{Name: "user", Value: "denis"},
+		{Name: "env", Value: "test"},
+	}).Times(1)
+
+	prov, err := metrics.New(&metrics.Config{
+		ServiceName:   "es",
+		FilterDefault: true,
+		GlobalTags:    []metrics.Tag{{Name: "env", Value: "test"}},
+		MetricLabels: map[string][]string{
+			"requests": {"region"},
+		},
+	}, mocked)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{
+		{Name: "region", Value: "us-west-2"},
+		{Name: "user", Value: "denis"},
+	}
+	prov.IncrCounter("requests", 1, tags...)
+	prov.IncrCounter("other", 1, tags...)
+
+	mocked.AssertExpectations(t)
+	assert.Equal(t, uint64(1), prov.DroppedLabels())
+	// the original tags must not be modified
+	assert.Len(t, tags, 2)
+}
+
+func Test_FlattenKey(t *testing.T) {
+	name, hash := metrics.FlattenKey("my metric", nil)
+	assert.Equal(t, "my_metric", name)
+	assert.Equal(t, "my_metric", hash)
+
+	tags := []metrics.Tag{
+		{Name: "foo", Value: "bar"},
+		{Name: "baz", Value: "buz"},
+	}
+	name, hash = metrics.FlattenKey("my_metric", tags)
+	assert.Equal(t, "my_metric", name)
+	assert.Equal(t, "my_metric;baz=buz;foo=bar", hash)
+	// the original tags must not be sorted in place
+	assert.Equal(t, "foo", tags[0].Name)
+
+	_, hash2 := metrics.FlattenKey("my_metric", []metrics.Tag{
+		{Name: "baz", Value: "buz"},
+		{Name: "foo", Value: "bar"},
+	})
+	assert.Equal(t, hash, hash2)
+}
+
+func Test_AddCollector(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:   true,
+		ProfileInterval: 10 * time.Millisecond,
+	}, im)
+	require.NoError(t, err)
+
+	called := make(chan struct{}, 100)
+	prov.AddCollector(func(p metrics.Provider) {
+		p.SetGauge("pool_connections", 3)
+		called <- struct{}{}
+	})
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("collector was not called")
+	}
+
+	var found bool
+	for _, intv := range im.Data() {
+		intv.RLock()
+		g, ok := intv.Gauges["pool_connections"]
+		intv.RUnlock()
+		if ok {
+			found = true
+			assert.Equal(t, float64(3), g.Value)
+		}
+	}
+	assert.True(t, found)
+}
+
+func Test_DescribeBindTo(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{
+		ServiceName:   "es",
+		FilterDefault: true,
+	}, im)
+	require.NoError(t, err)
+
+	d := metrics.Describe{
+		Name:         "bound",
+		RequiredTags: []string{"method"},
+	}
+	b := d.BindTo(prov)
+	b.SetGauge(1, "get")
+	b.IncrCounter(2, "get")
+	b.AddSample(3, "get")
+	b.MeasureSince(time.Now(), "put")
+	b.IncrRatio(false, "get")
+
+	data := im.Data()
+	require.Len(t, data, 1)
+	first := data[0]
+	assert.Equal(t, float64(1), first.Gauges["es_bound;method=get"].Value)
+	assert.Equal(t, float64(2), first.Counters["es_bound;method=get"].Sum)
+	assert.Equal(t, float64(1), first.Counters["es_bound_total;method=get"].Sum)
+	assert.Equal(t, float64(1), first.Counters["es_bound_errors_total;method=get"].Sum)
+	assert.Equal(t, float64(3), first.Samples["es_bound;method=get"].Sum)
+	assert.Contains(t, first.Samples, "es_bound;method=put")
+}
+
+func Test_Aliases(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute)
+	prov, err := metrics.New(&metrics.Config{
+		ServiceName:       "es",
+		FilterDefault:     true,
+		Aliases:           map[string]string{"http_requests_total": "http_requests"},
+		UnprefixedMetrics: []string{"http_requests"},
+	}, im)
+	require.NoError(t, err)
+
+	prov.IncrCounter("http_requests_total", 1)
+	prov.IncrCounter("http_errors_total", 1)
+
+	counters := im.Data()[0].Counters
+	assert.Contains(t, counters, "http_requests")
+	assert.NotContains(t, counters, "http_requests_total")
+	assert.NotContains(t, counters, "es_http_requests_total")
+	assert.Contains(t, counters, "es_http_errors_total")
+
+	_, key, _ := prov.WouldEmit(metrics.TypeCounter, "http_requests_total")
+	assert.Equal(t, "http_requests", key)
+}
+
+func Test_NameCase(t *testing.T) {
+	cfg := &metrics.Config{
+		ServiceName:   "es",
+		FilterDefault: true,
+		NameCase:      metrics.NameCaseSnake,
+	}
+	for in, exp := range map[string]string{
+		"httpRequests":       "es_http_requests",
+		"HttpRequests":       "es_http_requests",
+		"HTTPRequests":       "es_http_requests",
+		"http_requests":      "es_http_requests",
+		"http2RequestsTotal": "es_http2_requests_total",
+		"userID":             "es_user_id",
+		"cache_HitRatio":     "es_cache_hit_ratio",
+	} {
+		_, key, _ := cfg.Prepare(metrics.TypeCounter, in)
+		assert.Equal(t, exp, key, in)
+		// idempotent
+		_, again, _ := cfg.Prepare(metrics.TypeCounter, strings.TrimPrefix(key, "es_"))
+		assert.Equal(t, exp, again, in)
+	}
+
+	cfg.NameCase = metrics.NameCaseLower
+	_, key, _ := cfg.Prepare(metrics.TypeCounter, "httpRequests")
+	assert.Equal(t, "es_httprequests", key)
+
+	cfg.NameCase = metrics.NameCaseAsIs
+	_, key, _ = cfg.Prepare(metrics.TypeCounter, "httpRequests")
+	assert.Equal(t, "es_httpRequests", key)
+}
+
+func Test_UnprefixedMetrics(t *testing.T) {
+	cfg := &metrics.Config{
+		ServiceName:       "es",
+		HostName:          "host1",
+		EnableHostname:    true,
+		EnableTypePrefix:  true,
+		GlobalPrefix:      "global",
+		FilterDefault:     true,
+		UnprefixedMetrics: []string{"http_server_requests"},
+	}
+
+	allowed, key, _ := cfg.Prepare(metrics.TypeCounter, "http_server_requests")
+	assert.True(t, allowed)
+	assert.Equal(t, "http_server_requests", key)
+
+	allowed, key, _ = cfg.Prepare(metrics.TypeCounter, "requests")
+	assert.True(t, allowed)
+	assert.Equal(t, "global_es_counter_host1_requests", key)
+
+	cfg.EnableServiceLabel = true
+	_, key, tags := cfg.Prepare(metrics.TypeCounter, "http_server_requests")
+	assert.Equal(t, "http_server_requests", key)
+	assert.Equal(t, []metrics.Tag{{Name: "service", Value: "es"}}, tags)
+}
+
+func Test_MaxGCPauseSamples(t *testing.T) {
+	mocked := &mockedSink{t: t}
+	mocked.On("SetGauge", mock.Anything, mock.Anything, mock.Anything)
+	mocked.On("AddSample", "runtime_gc_pause_ns", float64(4), mock.Anything).Once()
+	mocked.On("AddSample", "runtime_gc_pause_ns", float64(5), mock.Anything).Once()
+	mocked.On("AddSample", "runtime_gc_pause_ns", float64(6), mock.Anything).Once()
+
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:        true,
+		EnableRuntimeMetrics: true,
+		// the stats are emitted by the test
+		ProfileInterval:   time.Hour,
+		MaxGCPauseSamples: 2,
+	}, mocked)
+	require.NoError(t, err)
+
+	var stats runtime.MemStats
+	metrics.SetMemStatsSource(prov, func(ms *runtime.MemStats) { *ms = stats })
+	for i := 0; i < 5; i++ {
+		stats.PauseNs[i] = uint64(i + 1)
+	}
+	stats.NumGC = 5
+
+	// only the most recent samples are emitted
+	metrics.EmitRuntimeStats(prov)
+	mocked.AssertNumberOfCalls(t, "AddSample", 2)
+
+	stats.PauseNs[5] = 6
+	stats.NumGC = 6
+	metrics.EmitRuntimeStats(prov)
+	mocked.AssertNumberOfCalls(t, "AddSample", 3)
+	mocked.AssertExpectations(t)
+}
+
+// gaugeRecorder records all emitted gauge values
+type gaugeRecorder struct {
+	metrics.BlackholeSink
+	lock   sync.Mutex
+	gauges map[string][]float64
+}
+
+func (r *gaugeRecorder) SetGauge(key string, val float64, _ []metrics.Tag) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.gauges[key] = append(r.gauges[key], val)
+}
+
+func (r *gaugeRecorder) values(key string) []float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]float64(nil), r.gauges[key]...)
+}
+
+func Test_UptimeMetric(t *testing.T) {
+	rec := &gaugeRecorder{gauges: make(map[string][]float64)}
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:        true,
+		EnableRuntimeMetrics: true,
+		EnableUptimeMetric:   true,
+		// the stats are emitted by the test
+		ProfileInterval: time.Hour,
+	}, rec)
+	require.NoError(t, err)
+
+	started := time.Unix(1700000000, 0)
+	now := started
+	metrics.SetMetricsClock(prov, func() time.Time { return now })
+
+	metrics.EmitRuntimeStats(prov)
+	now = now.Add(10 * time.Second)
+	metrics.EmitRuntimeStats(prov)
+
+	assert.Equal(t, []float64{0, 10}, rec.values("runtime_uptime_seconds"))
+	assert.Equal(t, []float64{1700000000, 1700000000}, rec.values("process_start_time_seconds"))
+}
+
+func Test_SetSink(t *testing.T) {
+	first := &mockedSink{t: t}
+	first.On("IncrCounter", "test_counter", float64(1), []metrics.Tag(nil)).Times(1)
+	second := &mockedSink{t: t}
+	second.On("IncrCounter", "test_counter", float64(2), []metrics.Tag(nil)).Times(1)
+
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, first)
+	require.NoError(t, err)
+	assert.Equal(t, first, prov.Sink())
+
+	prov.IncrCounter("test_counter", 1)
+	prov.SetSink(second)
+	assert.Equal(t, second, prov.Sink())
+	prov.IncrCounter("test_counter", 2)
+
+	first.AssertExpectations(t)
+	first.AssertNumberOfCalls(t, "IncrCounter", 1)
+	second.AssertExpectations(t)
+
+	// swap to a different sink type
+	prov.SetSink(&metrics.BlackholeSink{})
+	prov.IncrCounter("test_counter", 3)
+	second.AssertNumberOfCalls(t, "IncrCounter", 1)
+}
+
+func Test_DropEmptyTags(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault: true,
+		DropEmptyTags: true,
+		GlobalTags:    []metrics.Tag{{Name: "env", Value: ""}},
+	}, im)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{
+		{Name: "foo", Value: ""},
+		{Name: "region", Value: "us-west-2"},
+		{Name: "", Value: "bar"},
+	}
+	prov.IncrCounter("test_counter", 1, tags...)
+	prov.IncrCounter("test_counter2", 1, tags[1])
+
+	data := im.Data()
+	require.Len(t, data, 1)
+	assert.Contains(t, data[0].Counters, "test_counter;region=us-west-2")
+	assert.Contains(t, data[0].Counters, "test_counter2;region=us-west-2")
+	assert.Len(t, data[0].Counters, 2)
+	// the original tags must not be modified
+	assert.Equal(t, "foo", tags[0].Name)
+}
+
+// inmemReader reads the gauges and counters of all intervals of the sink
+func inmemReader(im *metrics.InmemSink) metricstest.SinkReader {
+	return func(hash string) (float64, bool) {
+		var val float64
+		found := false
+		for _, intv := range im.Data() {
+			if g, ok := intv.Gauges[hash]; ok {
+				val = g.Value
+				found = true
+			}
+			if c, ok := intv.Counters[hash]; ok {
+				val += c.Sum
+				found = true
+			}
+		}
+		return val, found
+	}
+}
+
+func Test_SinkConformance(t *testing.T) {
+	t.Run("blackhole", func(t *testing.T) {
+		metricstest.SinkConformance(t, &metrics.BlackholeSink{})
+	})
+
+	readable := map[string]func(inner *metrics.InmemSink) metrics.Sink{
+		"inmem": func(inner *metrics.InmemSink) metrics.Sink {
+			return inner
+		},
+		"fanout": func(inner *metrics.InmemSink) metrics.Sink {
+			return metrics.NewFanoutSink(&metrics.BlackholeSink{}, inner)
+		},
+		"gauges": func(inner *metrics.InmemSink) metrics.Sink {
+			return metrics.NewSampleAsGaugeSink(inner, time.Minute)
+		},
+	}
+	for name, newSink := range readable {
+		t.Run(name, func(t *testing.T) {
+			im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+			metricstest.SinkConformanceWithReader(t, newSink(im), inmemReader(im))
+		})
+	}
+}
+
+func Test_EmitInternalMetrics(t *testing.T) {
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:       true,
+		BlockedPrefixes:     []string{"blocked"},
+		EmitInternalMetrics: true,
+		ProfileInterval:     20 * time.Millisecond,
+	}, rec)
+	require.NoError(t, err)
+
+	// Help and Units do not count the described metrics
+	list := []*metrics.Describe{
+		{Type: metrics.TypeCounter, Name: "allowed_counter", Help: "allowed", Unit: "count"},
+		{Type: metrics.TypeCounter, Name: "blocked_counter", Help: "blocked", Unit: "count"},
+	}
+	assert.Len(t, prov.Help(list), 1)
+	assert.Len(t, prov.Units(list), 1)
+
+	prov.IncrCounter("allowed_counter", 1)
+	prov.SetGauge("allowed_gauge", 1)
+	prov.AddSample("allowed_sample", 1)
+	prov.IncrCounter("blocked_counter", 1)
+	prov.SetGauge("blocked_gauge", 1)
+
+	time.Sleep(100 * time.Millisecond)
+
+	totals := map[string]float64{}
+	for _, c := range rec.Calls() {
+		if c.Type == metrics.TypeCounter {
+			totals[c.Key] += c.Value
+		}
+	}
+	assert.Equal(t, float64(3), totals["metrics_emitted_total"])
+	assert.Equal(t, float64(2), totals["metrics_filtered_total"])
+}
+
+type healthSink struct {
+	metrics.BlackholeSink
+	err error
+}
+
+func (s *healthSink) HealthCheck(_ context.Context) error {
+	return s.err
+}
+
+func Test_HealthCheck(t *testing.T) {
+	ctx := context.Background()
+
+	prov, err := metrics.New(&metrics.Config{}, &metrics.BlackholeSink{})
+	require.NoError(t, err)
+	assert.NoError(t, prov.HealthCheck(ctx))
+
+	reachable := &healthSink{}
+	unreachable := &healthSink{err: errors.New("unreachable")}
+
+	prov.SetSink(reachable)
+	assert.NoError(t, prov.HealthCheck(ctx))
+
+	prov.SetSink(metrics.NewFanoutSink(&metrics.BlackholeSink{}, reachable, unreachable))
+	assert.EqualError(t, prov.HealthCheck(ctx), "unreachable")
+}
+
+func Test_EmitPrepared(t *testing.T) {
+	cfg := &metrics.Config{
+		FilterDefault:    true,
+		ServiceName:      "svc",
+		EnableTypePrefix: true,
+		GlobalTags:       []metrics.Tag{{Name: "env", Value: "test"}},
+	}
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+
+	normal := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(cfg, normal)
+	require.NoError(t, err)
+	prov.SetGauge("test_gauge", 1, tags...)
+	prov.IncrCounter("test_counter", 2, tags...)
+	prov.AddSample("test_sample", 3, tags...)
+
+	prepared := metricstest.NewOrderedRecorder()
+	prov.SetSink(prepared)
+
+	allowed, key, labels := prov.Prepare(metrics.TypeGauge, "test_gauge", tags...)
+	require.True(t, allowed)
+	prov.EmitPreparedGauge(key, 1, labels)
+	allowed, key, labels = prov.Prepare(metrics.TypeCounter, "test_counter", tags...)
+	require.True(t, allowed)
+	prov.EmitPreparedCounter(key, 2, labels)
+	allowed, key, labels = prov.Prepare(metrics.TypeSample, "test_sample", tags...)
+	require.True(t, allowed)
+	prov.EmitPreparedSample(key, 3, labels)
+
+	assert.Equal(t, normal.Calls(), prepared.Calls())
+}
+
+func BenchmarkMetrics_IncrCounter(b *testing.B) {
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault: true,
+		ServiceName:   "svc",
+		GlobalTags:    []metrics.Tag{{Name: "env", Value: "test"}},
+	}, &metrics.BlackholeSink{})
+	require.NoError(b, err)
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+
+	b.Run("normal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			prov.IncrCounter("test_counter", 1, tags...)
+		}
+	})
+	b.Run("prepared", func(b *testing.B) {
+		_, key, labels := prov.Prepare(metrics.TypeCounter, "test_counter", tags...)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			prov.EmitPreparedCounter(key, 1, labels)
+		}
+	})
+}
+
+func Test_InternTags(t *testing.T) {
+	cfg := &metrics.Config{FilterDefault: true, InternTags: true}
+
+	// the values are built at runtime, to not share the string constants
+	dynamic := func() []metrics.Tag {
+		return []metrics.Tag{{Name: "region", Value: fmt.Sprintf("us-%s-%d", "west", 2)}}
+	}
+	tags1, tags2 := dynamic(), dynamic()
+	require.NotSame(t, unsafe.StringData(tags1[0].Value), unsafe.StringData(tags2[0].Value))
+
+	_, _, interned1 := cfg.Prepare(metrics.TypeCounter, "requests", tags1...)
+	_, _, interned2 := cfg.Prepare(metrics.TypeCounter, "requests", tags2...)
+	assert.Equal(t, tags1, interned1)
+	assert.Equal(t, tags2, interned2)
+	assert.Same(t, unsafe.StringData(interned1[0].Value), unsafe.StringData(interned2[0].Value))
+
+	// the caller's tags are not modified
+	assert.NotSame(t, unsafe.StringData(tags1[0].Value), unsafe.StringData(tags2[0].Value))
+
+	// the canonical tags are copied, so the sink can keep them
+	_, _, interned3 := cfg.Prepare(metrics.TypeCounter, "requests", interned1...)
+	assert.NotSame(t, &interned1[0], &interned3[0])
+	assert.Same(t, unsafe.StringData(interned1[0].Value), unsafe.StringData(interned3[0].Value))
+}
+
+// tagsSink retains the tags of the counters
+type tagsSink struct {
+	metrics.BlackholeSink
+	tags [][]metrics.Tag
+}
+
+func (s *tagsSink) IncrCounter(_ string, _ float64, tags []metrics.Tag) {
+	s.tags = append(s.tags, tags)
+}
+
+// BenchmarkMetrics_InternTags reports the heap retained by a sink keeping the tags,
+// for the tags built on each call and for the reused tags
+func BenchmarkMetrics_InternTags(b *testing.B) {
+	reused := [][]metrics.Tag{
+		{{Name: "region", Value: "eu-central-availability-zone-0"}, {Name: "env", Value: "production"}},
+		{{Name: "region", Value: "eu-central-availability-zone-1"}, {Name: "env", Value: "production"}},
+	}
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("dynamic/intern=%t", intern), func(b *testing.B) {
+			benchmarkInternTags(b, intern, func(i int) []metrics.Tag {
+				return []metrics.Tag{
+					{Name: "region", Value: fmt.Sprintf("us-west-availability-zone-%d", i%3)},
+					{Name: "env", Value: fmt.Sprintf("environment-%d", i%2)},
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("reused/intern=%t", intern), func(b *testing.B) {
+			benchmarkInternTags(b, intern, func(i int) []metrics.Tag {
+				return reused[i%2]
+			})
+		})
+	}
+}
+
+func benchmarkInternTags(b *testing.B, intern bool, tags func(i int) []metrics.Tag) {
+	rec := &tagsSink{}
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true, InternTags: intern}, rec)
+	require.NoError(b, err)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		prov.IncrCounter("test_counter", 1, tags(i)...)
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "retained-B/op")
+	runtime.KeepAlive(rec)
+}
+
+func Test_WouldEmit(t *testing.T) {
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}, {Name: "tag2", Value: "val2"}}
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:       true,
+		BlockedPrefixes:     []string{"es_svc_counter_blocked"},
+		ServiceName:         "svc",
+		GlobalPrefix:        "es",
+		EnableTypePrefix:    true,
+		EmitInternalMetrics: true,
+		MetricLabels: map[string][]string{
+			"allowed": {"tag1"},
+		},
+	}, rec)
+	require.NoError(t, err)
+
+	allowed, key, labels := prov.WouldEmit(metrics.TypeCounter, "allowed", tags...)
+	assert.True(t, allowed)
+	assert.Equal(t, "es_svc_counter_allowed", key)
+	assert.Equal(t, tags[:1], labels)
+
+	allowed, key, _ = prov.WouldEmit(metrics.TypeCounter, "blocked", tags...)
+	assert.False(t, allowed)
+	assert.Equal(t, "es_svc_counter_blocked", key)
+
+	// blocked prefix does not match the gauge
+	allowed, key, _ = prov.WouldEmit(metrics.TypeGauge, "blocked", tags...)
+	assert.True(t, allowed)
+	assert.Equal(t, "es_svc_gauge_blocked", key)
+
+	// not allowed by default
+	prov.FilterDefault = false
+	allowed, _, _ = prov.WouldEmit(metrics.TypeGauge, "allowed", tags...)
+	assert.False(t, allowed)
+
+	// no side effects
+	assert.Empty(t, rec.Calls())
+	assert.Equal(t, uint64(0), prov.DroppedLabels())
+
+	_, err = metrics.NewGlobal(&metrics.Config{FilterDefault: true, GlobalPrefix: "global"}, rec)
+	require.NoError(t, err)
+	allowed, key, labels = metrics.WouldEmit(metrics.TypeSample, "test_sample", tags...)
+	assert.True(t, allowed)
+	assert.Equal(t, "global_test_sample", key)
+	assert.Equal(t, tags, labels)
+}
+
+func Test_AddSampleN(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, im)
+	require.NoError(t, err)
+
+	prov.AddSampleN("test_batch", 10, 3)
+	prov.AddSample("test_batch", 4)
+
+	data := im.Data()
+	require.NotEmpty(t, data)
+	agg := data[len(data)-1].Samples["test_batch"]
+	require.NotNil(t, agg.AggregateSample)
+	assert.Equal(t, 4, agg.Count)
+	assert.Equal(t, float64(34), agg.Sum)
+	assert.Equal(t, float64(4), agg.Min)
+	assert.Equal(t, float64(10), agg.Max)
+
+	// emulated with AddSample
+	rec := metricstest.NewOrderedRecorder()
+	prov.SetSink(rec)
+	metrics.AddSampleN("test_global", 1, 2)
+	prov.AddSampleN("test_batch", 10, 2)
+	assert.Len(t, rec.Calls(), 2)
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "test_batch"},
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "test_batch"},
+	)
+}
+
+func Test_DisabledRuntimeMetrics(t *testing.T) {
+	rec := &gaugeRecorder{gauges: make(map[string][]float64)}
+	_, err := metrics.New(&metrics.Config{
+		FilterDefault:          true,
+		EnableRuntimeMetrics:   true,
+		ProfileInterval:        20 * time.Millisecond,
+		DisabledRuntimeMetrics: []string{"runtime_free_count", "runtime_malloc_count"},
+	}, rec)
+	require.NoError(t, err)
+
+	time.Sleep(70 * time.Millisecond)
+
+	assert.Empty(t, rec.values("runtime_free_count"))
+	assert.Empty(t, rec.values("runtime_malloc_count"))
+	assert.NotEmpty(t, rec.values("runtime_num_goroutines"))
+	assert.NotEmpty(t, rec.values("runtime_alloc_bytes"))
+}
+
+// noSampleSink is a sink that does not support samples
+type noSampleSink struct {
+	*metricstest.OrderedRecorder
+}
+
+func (s noSampleSink) Supports(typ string) bool {
+	return typ != metrics.TypeSample
+}
+
+func Test_CapabilitySink(t *testing.T) {
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, noSampleSink{rec})
+	require.NoError(t, err)
+
+	prov.AddSample("test_sample", 1)
+	prov.MeasureSince("test_sample", time.Now())
+	prov.AddSampleN("test_sample", 1, 2)
+	prov.WithContext(context.Background()).AddSample("test_sample", 1)
+	prov.SetGauge("test_gauge", 2)
+	prov.IncrGauge("test_gauge", 1)
+	prov.IncrCounter("test_counter", 3)
+	prov.EmitPreparedSample("test_sample", 1, nil)
+	prov.EmitPreparedGauge("test_gauge", 4, nil)
+
+	require.Len(t, rec.Calls(), 4)
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 2},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 3},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "test_counter", Value: 3},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 4},
+	)
+}
+
+// initCounterSink records InitCounter as a zero counter
+type initCounterSink struct {
+	*metricstest.OrderedRecorder
+}
+
+func (s initCounterSink) InitCounter(key string, tags []metrics.Tag) {
+	s.IncrCounter(key, 0, tags)
+}
+
+func Test_InitCounter(t *testing.T) {
+	initRec := metricstest.NewOrderedRecorder()
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault: true,
+		ServiceName:   "svc",
+	}, metrics.NewFanoutSink(initCounterSink{initRec}, rec))
+	require.NoError(t, err)
+
+	prov.InitCounter("test_errors", metrics.Tag{Name: "code", Value: "500"})
+	initRec.AssertSequence(t, metricstest.RecordedCall{
+		Type: metrics.TypeCounter, Key: "svc_test_errors", Value: 0,
+		Tags: []metrics.Tag{{Name: "code", Value: "500"}},
+	})
+	// the sinks without pre-declaration are not called
+	assert.Empty(t, rec.Calls())
+
+	// no-op for the sink without CounterInitSink
+	prov.SetSink(rec)
+	prov.InitCounter("test_errors")
+	assert.Empty(t, rec.Calls())
+}
+
+func Test_MergeFilters(t *testing.T) {
+	base := &metrics.Config{
+		FilterDefault:   true,
+		AllowedPrefixes: []string{"es_", "http_"},
+		BlockedPrefixes: []string{"debug_"},
+	}
+	base.MergeFilters(nil)
+	base.MergeFilters(&metrics.Config{
+		AllowedPrefixes: []string{"http_", "grpc_", "grpc_"},
+		BlockedPrefixes: []string{"debug_", "trace_"},
+	})
+	assert.Equal(t, []string{"es_", "http_", "grpc_"}, base.AllowedPrefixes)
+	assert.Equal(t, []string{"debug_", "trace_"}, base.BlockedPrefixes)
+
+	assert.True(t, base.AllowMetric("grpc_requests"))
+	assert.False(t, base.AllowMetric("debug_requests"))
+	assert.False(t, base.AllowMetric("trace_spans"))
+
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:   true,
+		BlockedPrefixes: []string{"debug_"},
+	}, rec)
+	require.NoError(t, err)
+
+	prov.UpdateFilterFrom(&metrics.Config{BlockedPrefixes: []string{"debug_", "trace_"}})
+	_, blocked := prov.Filter()
+	assert.Equal(t, []string{"debug_", "trace_"}, blocked)
+
+	prov.IncrCounter("debug_requests", 1)
+	prov.IncrCounter("trace_spans", 1)
+	prov.IncrCounter("http_requests", 1)
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "http_requests", Value: 1},
+	)
+	assert.Len(t, rec.Calls(), 1)
+}
+
+func Test_UpdateFilterFromConcurrent(t *testing.T) {
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:   true,
+		BlockedPrefixes: []string{"debug_"},
+	}, metricstest.NewOrderedRecorder())
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				prov.IncrCounter("http_requests", 1)
+				prov.AllowMetric("debug_requests")
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			prov.UpdateFilterFrom(&metrics.Config{BlockedPrefixes: []string{fmt.Sprintf("blocked_%d_", i)}})
+		}(i)
+	}
+	wg.Wait()
+
+	// the concurrent merges are not lost
+	_, blocked := prov.Filter()
+	assert.Len(t, blocked, 11)
+	for i := 0; i < 10; i++ {
+		assert.False(t, prov.AllowMetric(fmt.Sprintf("blocked_%d_requests", i)))
+	}
+}
+
+func Test_TypeLabel(t *testing.T) {
+	cfg := &metrics.Config{
+		ServiceName:        "es",
+		EnableServiceLabel: true,
+		EnableTypeLabel:    true,
+		EnableTypePrefix:   true,
+		FilterDefault:      true,
+	}
+
+	allowed, key, tags := cfg.Prepare(metrics.TypeCounter, "requests", metrics.Tag{Name: "method", Value: "get"})
+	assert.True(t, allowed)
+	assert.Equal(t, "requests", key)
+	assert.Equal(t, []metrics.Tag{
+		{Name: "method", Value: "get"},
+		{Name: "type", Value: "counter"},
+		{Name: "service", Value: "es"},
+	}, tags)
+
+	_, key, tags = cfg.Prepare(metrics.TypeGauge, "connections")
+	assert.Equal(t, "connections", key)
+	assert.Contains(t, tags, metrics.Tag{Name: "type", Value: "gauge"})
+
+	cfg.EnableTypeLabel = false
+	_, key, tags = cfg.Prepare(metrics.TypeGauge, "connections")
+	assert.Equal(t, "gauge_connections", key)
+	assert.NotContains(t, tags, metrics.Tag{Name: "type", Value: "gauge"})
+}
+
+func Test_TimeBlock(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, im)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "table", Value: "users"}}
+	for i := 0; i < 2; i++ {
+		done := prov.TimeBlock("db_query", tags...)
+		time.Sleep(5 * time.Millisecond)
+		done()
+	}
+
+	data := im.Data()
+	require.Len(t, data, 1)
+	assert.Equal(t, float64(2), data[0].Counters["db_query_total;table=users"].Sum)
+	sample := data[0].Samples["db_query_duration;table=users"]
+	require.NotNil(t, sample.AggregateSample)
+	assert.Equal(t, 2, sample.Count)
+	assert.GreaterOrEqual(t, sample.Min, float64(5))
+}
+
+func Test_SetGaugeClamped(t *testing.T) {
+	im := metrics.NewInmemSink(time.Minute, time.Minute*5)
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, im)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "host", Value: "h1"}}
+	gauge := func() float64 {
+		return im.Data()[0].Gauges["cpu_ratio;host=h1"].Value
+	}
+	clamped := func() float64 {
+		c := im.Data()[0].Counters["cpu_ratio_clamped_total;host=h1"]
+		if c.AggregateSample == nil {
+			return 0
+		}
+		return c.Sum
+	}
+
+	prov.SetGaugeClamped("cpu_ratio", 0.5, 0, 1, tags...)
+	assert.Equal(t, 0.5, gauge())
+	assert.Equal(t, float64(0), clamped())
+
+	prov.SetGaugeClamped("cpu_ratio", 1.3, 0, 1, tags...)
+	assert.Equal(t, float64(1), gauge())
+	assert.Equal(t, float64(1), clamped())
+
+	prov.SetGaugeClamped("cpu_ratio", -0.1, 0, 1, tags...)
+	assert.Equal(t, float64(0), gauge())
+	assert.Equal(t, float64(2), clamped())
+
+	prov.SetGaugeClamped("cpu_ratio", 1, 0, 1, tags...)
+	assert.Equal(t, float64(1), gauge())
+	assert.Equal(t, float64(2), clamped())
+}
+
+func Test_SetGaugeEMA(t *testing.T) {
+	rec := &gaugeRecorder{gauges: make(map[string][]float64)}
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault: true,
+		EmitRawEMA:    true,
+		MaxEMASeries:  1,
+	}, rec)
+	require.NoError(t, err)
+
+	// step from 0 to 100
+	prov.SetGaugeEMA("queue_depth", 0, 0.5)
+	for i := 0; i < 10; i++ {
+		prov.SetGaugeEMA("queue_depth", 100, 0.5)
+	}
+
+	values := rec.values("queue_depth")
+	require.Len(t, values, 11)
+	assert.Equal(t, []float64{0, 50, 75, 87.5}, values[:4])
+	// 100 * (1 - 0.5^10)
+	assert.InDelta(t, 99.902, values[10], 0.001)
+	assert.Equal(t, float64(100), rec.values("queue_depth_raw")[10])
+
+	// over MaxEMASeries the values are not smoothed
+	prov.SetGaugeEMA("other_depth", 0, 0.5)
+	prov.SetGaugeEMA("other_depth", 100, 0.5)
+	assert.Equal(t, []float64{0, 100}, rec.values("other_depth"))
+}
+
+func Test_SetGaugeIfChanged(t *testing.T) {
+	rec := &gaugeRecorder{gauges: make(map[string][]float64)}
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault:    true,
+		MaxChangedSeries: 2,
+	}, rec)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		prov.SetGaugeIfChanged("leader", 1)
+	}
+	assert.True(t, prov.SetGaugeIfChanged("leader", 0))
+	assert.False(t, prov.SetGaugeIfChanged("leader", 0))
+	assert.True(t, prov.SetGaugeIfChanged("leader", 1))
+	assert.Equal(t, []float64{1, 0, 1}, rec.values("leader"))
+
+	// the tags are part of the series
+	assert.True(t, prov.SetGaugeIfChanged("version", 3, metrics.Tag{Name: "config", Value: "a"}))
+	assert.False(t, prov.SetGaugeIfChanged("version", 3, metrics.Tag{Name: "config", Value: "a"}))
+
+	// over MaxChangedSeries the values are always emitted
+	assert.True(t, prov.SetGaugeIfChanged("other", 3))
+	assert.True(t, prov.SetGaugeIfChanged("other", 3))
+	assert.Equal(t, []float64{3, 3}, rec.values("other"))
+}
+
+func Test_NaNGaugeBehavior(t *testing.T) {
+	newProv := func(b metrics.NaNGaugeBehavior) (*metrics.Metrics, *metrics.InmemSink) {
+		im := metrics.NewInmemSink(time.Minute, time.Minute)
+		prov, err := metrics.New(&metrics.Config{
+			FilterDefault:    true,
+			NaNGaugeBehavior: b,
+		}, im)
+		require.NoError(t, err)
+		return prov, im
+	}
+
+	prov, im := newProv(metrics.NaNGaugeDrop)
+	prov.SetGauge("test_gauge", math.NaN())
+	prov.SetGaugeClamped("test_clamped", math.NaN(), 0, 1)
+	data := im.Data()
+	assert.NotContains(t, data[0].Gauges, "test_gauge")
+	assert.NotContains(t, data[0].Gauges, "test_clamped")
+	assert.Empty(t, data[0].Counters)
+
+	prov, im = newProv(metrics.NaNGaugeZero)
+	prov.SetGauge("test_gauge", math.NaN())
+	assert.Equal(t, float64(0), im.Data()[0].Gauges["test_gauge"].Value)
+
+	prov, im = newProv(metrics.NaNGaugePass)
+	prov.SetGauge("test_gauge", math.NaN())
+	assert.True(t, math.IsNaN(im.Data()[0].Gauges["test_gauge"].Value))
+}
+
+func Test_TypePrefixTypes(t *testing.T) {
+	cfg := &metrics.Config{
+		FilterDefault:    true,
+		EnableTypePrefix: true,
+		TypePrefixTypes:  []string{metrics.TypeCounter, metrics.TypeGauge},
+	}
+
+	_, key, _ := cfg.Prepare(metrics.TypeCounter, "requests")
+	assert.Equal(t, "counter_requests", key)
+	_, key, _ = cfg.Prepare(metrics.TypeGauge, "connections")
+	assert.Equal(t, "gauge_connections", key)
+	_, key, _ = cfg.Prepare(metrics.TypeSample, "latency_seconds")
+	assert.Equal(t, "latency_seconds", key)
+
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(cfg, rec)
+	require.NoError(t, err)
+	prov.MeasureSince("latency_seconds", time.Now())
+	rec.AssertSequence(t, metricstest.RecordedCall{Type: metrics.TypeSample, Key: "latency_seconds"})
+
+	cfg.TypePrefixTypes = nil
+	_, key, _ = cfg.Prepare(metrics.TypeSample, "latency_seconds")
+	assert.Equal(t, "sample_latency_seconds", key)
+}
+
+func Test_SetEnabled(t *testing.T) {
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, rec)
+	require.NoError(t, err)
+	assert.True(t, prov.Enabled())
+
+	prov.SetEnabled(false)
+	assert.False(t, prov.Enabled())
+	prov.SetGauge("test_gauge", 1)
+	prov.IncrCounter("test_counter", 1)
+	prov.AddSample("test_sample", 1)
+	prov.EmitPreparedGauge("test_prepared", 1, nil)
+	assert.Empty(t, rec.Calls())
+
+	prov.SetEnabled(true)
+	prov.SetGauge("test_gauge", 2)
+	prov.IncrCounter("test_counter", 3)
+	prov.AddSample("test_sample", 4)
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 2},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "test_counter", Value: 3},
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "test_sample", Value: 4},
+	)
+}
+
+func Test_DescribeTimer(t *testing.T) {
+	latency := &metrics.Describe{
+		Type:         metrics.TypeTimer,
+		Name:         "request_latency",
+		Help:         "request latency",
+		RequiredTags: []string{"method"},
+	}
+
+	cfg := &metrics.Config{
+		ServiceName:      "svc",
+		EnableTypePrefix: true,
+		FilterDefault:    true,
+		GlobalPrefix:     "es",
+	}
+	help := cfg.Help([]*metrics.Describe{latency})
+	assert.Equal(t, map[string]string{"es_svc_sample_request_latency": "request latency"}, help)
+
+	rec := metricstest.NewOrderedRecorder()
+	prov, err := metrics.NewGlobal(cfg, rec)
+	require.NoError(t, err)
+
+	latency.MeasureSince(time.Now(), "put")
+	metrics.MeasureSince(latency.Name, time.Now(), latency.Tags("put")...)
+	latency.BindTo(prov).MeasureSince(time.Now(), "put")
+	prov.WithContext(context.Background()).MeasureSince(latency.Name, time.Now(), latency.Tags("put")...)
+
+	calls := rec.Calls()
+	require.Len(t, calls, 4)
+	for _, c := range calls {
+		assert.Equal(t, metrics.TypeSample, c.Type)
+		assert.Contains(t, help, c.Key)
+		assert.Equal(t, []metrics.Tag{{Name: "method", Value: "put"}}, c.Tags)
+	}
+}
+
+func Test_TimerTypePrefix(t *testing.T) {
+	latency := &metrics.Describe{
+		Type: metrics.TypeTimer,
+		Name: "request_latency",
+		Help: "request latency",
+	}
+
+	tcases := []struct {
+		types []string
+		exp   string
+	}{
+		{types: nil, exp: "sample_request_latency"},
+		{types: []string{metrics.TypeSample}, exp: "sample_request_latency"},
+		{types: []string{metrics.TypeTimer}, exp: "timer_request_latency"},
+		{types: []string{metrics.TypeCounter}, exp: "request_latency"},
+	}
+	for _, tc := range tcases {
+		cfg := &metrics.Config{
+			EnableTypePrefix: true,
+			TypePrefixTypes:  tc.types,
+			FilterDefault:    true,
+		}
+		assert.Equal(t, map[string]string{tc.exp: "request latency"}, cfg.Help([]*metrics.Describe{latency}), tc.types)
+
+		rec := metricstest.NewOrderedRecorder()
+		prov, err := metrics.New(cfg, rec)
+		require.NoError(t, err)
+		prov.MeasureSince(latency.Name, time.Now())
+		calls := rec.Calls()
+		require.Len(t, calls, 1)
+		assert.Equal(t, tc.exp, calls[0].Key, tc.types)
+	}
+}
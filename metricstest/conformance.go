@@ -0,0 +1,85 @@
+package metricstest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/effective-security/metrics"
+)
+
+// SinkReader returns the current value of a gauge, or the sum of a counter,
+// by the series hash returned by metrics.FlattenKey, and false if the series is not found
+type SinkReader func(hash string) (float64, bool)
+
+// SinkConformance drives the Sink methods with the typical inputs,
+// it is used in tests to verify that a sink conforms to metrics.Sink.
+func SinkConformance(t *testing.T, sink metrics.Sink) {
+	t.Helper()
+	SinkConformanceWithReader(t, sink, nil)
+}
+
+// SinkConformanceWithReader drives the Sink methods as SinkConformance,
+// and verifies with read that the sink retains the last gauge and the sum of the counter.
+// The checks of the values are skipped if read is nil.
+func SinkConformanceWithReader(t *testing.T, sink metrics.Sink, read SinkReader) {
+	t.Helper()
+
+	tags := []metrics.Tag{
+		{Name: "tag1", Value: "val1"},
+		{Name: "tag2", Value: "val2"},
+	}
+	check := func(t *testing.T, key string, tags []metrics.Tag, expected float64) {
+		t.Helper()
+		if read == nil {
+			return
+		}
+		_, hash := metrics.FlattenKey(key, tags)
+		val, ok := read(hash)
+		if !ok {
+			t.Errorf("series %q is not found", hash)
+		} else if val != expected {
+			t.Errorf("series %q: expected %v, got %v", hash, expected, val)
+		}
+	}
+
+	t.Run("SetGauge", func(t *testing.T) {
+		sink.SetGauge("conformance_gauge", 1, nil)
+		sink.SetGauge("conformance_gauge", -1.5, nil)
+		sink.SetGauge("conformance_gauge_tags", 0, tags)
+		sink.SetGauge("conformance_gauge_tags", 42, tags)
+		check(t, "conformance_gauge", nil, -1.5)
+		check(t, "conformance_gauge_tags", tags, 42)
+	})
+	t.Run("IncrCounter", func(t *testing.T) {
+		sink.IncrCounter("conformance_counter", 1, nil)
+		sink.IncrCounter("conformance_counter", 0, nil)
+		sink.IncrCounter("conformance_counter_tags", 1, tags)
+		sink.IncrCounter("conformance_counter_tags", 2.5, tags)
+		check(t, "conformance_counter", nil, 1)
+		check(t, "conformance_counter_tags", tags, 3.5)
+	})
+	t.Run("AddSample", func(_ *testing.T) {
+		sink.AddSample("conformance_sample", 1, nil)
+		sink.AddSample("conformance_sample", 0, nil)
+		sink.AddSample("conformance_sample_tags", 10, tags)
+		sink.AddSample("conformance_sample_tags", 0.1, tags)
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					sink.SetGauge("conformance_gauge_tags", float64(j), tags)
+					sink.IncrCounter("conformance_counter_tags", 1, tags)
+					sink.AddSample("conformance_sample_tags", float64(j), tags)
+				}
+			}()
+		}
+		wg.Wait()
+		// the last value of each goroutine is the same
+		check(t, "conformance_gauge_tags", tags, 99)
+		check(t, "conformance_counter_tags", tags, 1003.5)
+	})
+}
@@ -0,0 +1,144 @@
+// Package metricstest provides helpers to test metrics emission.
+package metricstest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/effective-security/metrics"
+)
+
+// TestingT is the interface of testing.T used by the assertions
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// RecordedCall is a single call to the Sink
+type RecordedCall struct {
+	// Type of the metric: counter|gauge|sample
+	Type  string
+	Key   string
+	Value float64
+	Tags  []metrics.Tag
+}
+
+func (c RecordedCall) String() string {
+	return fmt.Sprintf("%s %s=%v %v", c.Type, c.Key, c.Value, c.Tags)
+}
+
+var _ metrics.Sink = (*OrderedRecorder)(nil)
+
+// OrderedRecorder is a Sink that records all calls in order
+type OrderedRecorder struct {
+	lock  sync.Mutex
+	calls []RecordedCall
+}
+
+// NewOrderedRecorder returns a new OrderedRecorder
+func NewOrderedRecorder() *OrderedRecorder {
+	return &OrderedRecorder{}
+}
+
+// SetGauge should retain the last value it is set to
+func (r *OrderedRecorder) SetGauge(key string, val float64, tags []metrics.Tag) {
+	r.record(metrics.TypeGauge, key, val, tags)
+}
+
+// IncrCounter should accumulate values
+func (r *OrderedRecorder) IncrCounter(key string, val float64, tags []metrics.Tag) {
+	r.record(metrics.TypeCounter, key, val, tags)
+}
+
+// AddSample is for timing information, where quantiles are used
+func (r *OrderedRecorder) AddSample(key string, val float64, tags []metrics.Tag) {
+	r.record(metrics.TypeSample, key, val, tags)
+}
+
+func (r *OrderedRecorder) record(typ, key string, val float64, tags []metrics.Tag) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, RecordedCall{
+		Type:  typ,
+		Key:   key,
+		Value: val,
+		Tags:  slices.Clone(tags),
+	})
+}
+
+// Calls returns a copy of the recorded calls
+func (r *OrderedRecorder) Calls() []RecordedCall {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return slices.Clone(r.calls)
+}
+
+// Reset removes the recorded calls
+func (r *OrderedRecorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = nil
+}
+
+// Value returns the last value of the gauge, or the sum of the counter,
+// by the series hash returned by metrics.FlattenKey.
+// It can be used as SinkReader.
+func (r *OrderedRecorder) Value(hash string) (float64, bool) {
+	var val float64
+	found := false
+	for _, c := range r.Calls() {
+		if _, h := metrics.FlattenKey(c.Key, c.Tags); h != hash {
+			continue
+		}
+		switch c.Type {
+		case metrics.TypeGauge:
+			val = c.Value
+			found = true
+		case metrics.TypeCounter:
+			val += c.Value
+			found = true
+		}
+	}
+	return val, found
+}
+
+// AssertSequence asserts that the expected calls were recorded in the given order.
+// Other calls in between are ignored.
+// Type and Key are always compared, Tags are compared if not nil.
+// Value is not compared, as timing values are not deterministic,
+// use Calls to check the values.
+func (r *OrderedRecorder) AssertSequence(t TestingT, expected ...RecordedCall) bool {
+	t.Helper()
+
+	calls := r.Calls()
+	idx := 0
+	for _, c := range calls {
+		if idx == len(expected) {
+			break
+		}
+		if matchCall(expected[idx], c) {
+			idx++
+		}
+	}
+	if idx < len(expected) {
+		list := make([]string, len(calls))
+		for i, c := range calls {
+			list[i] = c.String()
+		}
+		t.Errorf("expected call %q not found in sequence:\n%s", expected[idx].String(), strings.Join(list, "\n"))
+		return false
+	}
+	return true
+}
+
+func matchCall(exp, c RecordedCall) bool {
+	if exp.Type != c.Type || exp.Key != c.Key {
+		return false
+	}
+	if exp.Tags != nil && !slices.Equal(exp.Tags, c.Tags) {
+		return false
+	}
+	return true
+}
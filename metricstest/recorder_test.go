@@ -0,0 +1,71 @@
+package metricstest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkConformance(t *testing.T) {
+	r := metricstest.NewOrderedRecorder()
+	metricstest.SinkConformanceWithReader(t, r, r.Value)
+	assert.Len(t, r.Calls(), 3*4+10*100*3)
+}
+
+func Test_OrderedRecorder(t *testing.T) {
+	r := metricstest.NewOrderedRecorder()
+	prov, err := metrics.New(&metrics.Config{
+		ServiceName:   "es",
+		FilterDefault: true,
+	}, r)
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "method", Value: "get"}}
+	prov.IncrCounter("requests", 1, tags...)
+	prov.SetGauge("connections", 2)
+	prov.MeasureSince("request_time", time.Now(), tags...)
+
+	calls := r.Calls()
+	require.Len(t, calls, 3)
+	assert.Equal(t, metricstest.RecordedCall{
+		Type:  metrics.TypeCounter,
+		Key:   "es_requests",
+		Value: 1,
+		Tags:  tags,
+	}, calls[0])
+
+	assert.True(t, r.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "es_requests", Tags: tags},
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "es_request_time"},
+	))
+
+	mt := &mockT{}
+	assert.False(t, r.AssertSequence(mt,
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "es_request_time"},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "es_requests"},
+	))
+	assert.Contains(t, mt.msg, "counter es_requests")
+
+	mt = &mockT{}
+	assert.False(t, r.AssertSequence(mt,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "es_requests", Tags: []metrics.Tag{}},
+	))
+
+	r.Reset()
+	assert.Empty(t, r.Calls())
+}
+
+type mockT struct {
+	msg string
+}
+
+func (m *mockT) Helper() {}
+
+func (m *mockT) Errorf(format string, args ...any) {
+	m.msg = fmt.Sprintf(format, args...)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -339,13 +340,6 @@ func TestDefinitions2(t *testing.T) {
 	})
 }
 
-func TestSinkInterface(t *testing.T) {
-	var ps *Sink
-	_ = metrics.Sink(ps)
-	var pps *PushSink
-	_ = metrics.Sink(pps)
-}
-
 func Test_flattenKey(t *testing.T) {
 	testCases := []struct {
 		name               string
@@ -362,7 +356,7 @@ func Test_flattenKey(t *testing.T) {
 				{Name: "baz", Value: "buz"},
 			},
 			expectedOutputKey:  "my_example_metric",
-			expectedOutputHash: "my_example_metric;foo=bar;baz=buz",
+			expectedOutputHash: "my_example_metric;baz=buz;foo=bar",
 		},
 		{
 			name:       "key with whitespace",
@@ -372,7 +366,7 @@ func Test_flattenKey(t *testing.T) {
 				{Name: "baz", Value: "buz"},
 			},
 			expectedOutputKey:  "_my_example_metric_",
-			expectedOutputHash: "_my_example_metric_;foo=bar;baz=buz",
+			expectedOutputHash: "_my_example_metric_;baz=buz;foo=bar",
 		},
 		{
 			name:       "key with dot",
@@ -382,7 +376,7 @@ func Test_flattenKey(t *testing.T) {
 				{Name: "baz", Value: "buz"},
 			},
 			expectedOutputKey:  "_my_example_metric_",
-			expectedOutputHash: "_my_example_metric_;foo=bar;baz=buz",
+			expectedOutputHash: "_my_example_metric_;baz=buz;foo=bar",
 		},
 		{
 			name:       "key with dash",
@@ -392,7 +386,7 @@ func Test_flattenKey(t *testing.T) {
 				{Name: "baz", Value: "buz"},
 			},
 			expectedOutputKey:  "_my_example_metric_",
-			expectedOutputHash: "_my_example_metric_;foo=bar;baz=buz",
+			expectedOutputHash: "_my_example_metric_;baz=buz;foo=bar",
 		},
 		{
 			name:       "key with forward slash",
@@ -402,7 +396,7 @@ func Test_flattenKey(t *testing.T) {
 				{Name: "baz", Value: "buz"},
 			},
 			expectedOutputKey:  "_my_example_metric_",
-			expectedOutputHash: "_my_example_metric_;foo=bar;baz=buz",
+			expectedOutputHash: "_my_example_metric_;baz=buz;foo=bar",
 		},
 		{
 			name:       "key with all restricted",
@@ -412,7 +406,7 @@ func Test_flattenKey(t *testing.T) {
 				{Name: "baz", Value: "buz"},
 			},
 			expectedOutputKey:  "_my_example_metric",
-			expectedOutputHash: "_my_example_metric;foo=bar;baz=buz",
+			expectedOutputHash: "_my_example_metric;baz=buz;foo=bar",
 		},
 	}
 
@@ -428,3 +422,509 @@ func Test_flattenKey(t *testing.T) {
 		})
 	}
 }
+
+func TestSetInfo(t *testing.T) {
+	sink, err := NewSinkFrom(Opts{
+		Expiration: 5 * time.Second,
+		Registerer: prometheus.NewRegistry(),
+		Help: map[string]string{
+			"build_info": "build information",
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	collect := func() []*dto.Metric {
+		ch := make(chan prometheus.Metric, 10)
+		// info metrics must survive expiration
+		sink.collectAtTime(ch, time.Now().Add(time.Minute))
+		close(ch)
+
+		var list []*dto.Metric
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), "build_info") {
+				continue
+			}
+			if !strings.Contains(m.Desc().String(), "build information") {
+				t.Fatalf("expected info to include help, but was %s", m.Desc().String())
+			}
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatalf("unexpected error reading metric: %s", err)
+			}
+			list = append(list, &pb)
+		}
+		return list
+	}
+	labelValue := func(m *dto.Metric, name string) string {
+		for _, l := range m.Label {
+			if l.GetName() == name {
+				return l.GetValue()
+			}
+		}
+		return ""
+	}
+
+	sink.SetInfo("build_info", []metrics.Tag{{Name: "version", Value: "v1"}})
+	sink.SetInfo("build_info", []metrics.Tag{{Name: "version", Value: "v1"}})
+	list := collect()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 info series, got %d", len(list))
+	}
+	if v := labelValue(list[0], "version"); v != "v1" {
+		t.Fatalf("expected version v1, got %q", v)
+	}
+	if list[0].Gauge.GetValue() != 1 {
+		t.Fatalf("expected info value 1, got %f", list[0].Gauge.GetValue())
+	}
+
+	sink.SetInfo("build_info", []metrics.Tag{{Name: "version", Value: "v2"}})
+	list = collect()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 info series, got %d", len(list))
+	}
+	if v := labelValue(list[0], "version"); v != "v2" {
+		t.Fatalf("expected version v2, got %q", v)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	sink, err := NewSinkFrom(Opts{
+		Expiration: 5 * time.Second,
+		Registerer: prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	collect := func(at time.Time) map[string]float64 {
+		ch := make(chan prometheus.Metric, 10)
+		sink.collectAtTime(ch, at)
+		close(ch)
+
+		res := make(map[string]float64)
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatalf("unexpected error reading metric: %s", err)
+			}
+			key := m.Desc().String()
+			for _, l := range pb.Label {
+				key += ";" + l.GetName() + "=" + l.GetValue()
+			}
+			res[key] = pb.GetGauge().GetValue()
+		}
+		return res
+	}
+	upValue := func(list map[string]float64, name, label string) float64 {
+		for k, v := range list {
+			if strings.Contains(k, `fqName: "`+name+`"`) && strings.HasSuffix(k, label) {
+				return v
+			}
+		}
+		t.Fatalf("%s is not collected: %v", name, list)
+		return -1
+	}
+
+	tags := []metrics.Tag{{Name: "source", Value: "db"}}
+	sink.RegisterHeartbeat("replicator", tags)
+	sink.RegisterHeartbeat("indexer", nil)
+
+	now := time.Now()
+	list := collect(now)
+	if v := upValue(list, "replicator_up", "source=db"); v != 0 {
+		t.Fatalf("expected replicator_up 0 before the beat, got %v", v)
+	}
+
+	sink.Beat("replicator", tags)
+	sink.Beat("indexer", nil)
+	list = collect(time.Now())
+	if v := upValue(list, "replicator_up", "source=db"); v != 1 {
+		t.Fatalf("expected replicator_up 1, got %v", v)
+	}
+	if v := upValue(list, "indexer_up", ""); v != 1 {
+		t.Fatalf("expected indexer_up 1, got %v", v)
+	}
+
+	// the up gauge flips to 0 after expiration
+	list = collect(time.Now().Add(10 * time.Second))
+	if v := upValue(list, "replicator_up", "source=db"); v != 0 {
+		t.Fatalf("expected replicator_up 0 after expiration, got %v", v)
+	}
+	if v := upValue(list, "indexer_up", ""); v != 0 {
+		t.Fatalf("expected indexer_up 0 after expiration, got %v", v)
+	}
+}
+
+func TestExpirationJitter(t *testing.T) {
+	for _, jitter := range []float64{-0.1, 1, 1.5} {
+		_, err := NewSinkFrom(Opts{
+			Expiration:       10 * time.Second,
+			ExpirationJitter: jitter,
+			Registerer:       prometheus.NewRegistry(),
+		})
+		if err == nil {
+			t.Fatalf("expected error for jitter %v", jitter)
+		}
+	}
+
+	sink, err := NewSinkFrom(Opts{
+		Expiration:       10 * time.Second,
+		ExpirationJitter: 0.5,
+		Registerer:       prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	total := 100
+	for i := 0; i < total; i++ {
+		sink.SetGauge(fmt.Sprintf("jitter_gauge_%d", i), 1, nil)
+	}
+	now := time.Now()
+
+	count := func(at time.Time) int {
+		ch := make(chan prometheus.Metric, total)
+		sink.collectAtTime(ch, at)
+		close(ch)
+		return len(ch)
+	}
+
+	if n := count(now.Add(4 * time.Second)); n != total {
+		t.Fatalf("expected all %d series before the min expiry, got %d", total, n)
+	}
+	// at the nominal expiration only a part of the series are evicted
+	n := count(now.Add(10 * time.Second))
+	if n == 0 || n == total {
+		t.Fatalf("expected series to expire at different times, got %d of %d", n, total)
+	}
+	if n := count(now.Add(16 * time.Second)); n != 0 {
+		t.Fatalf("expected all series to expire after the max expiry, got %d", n)
+	}
+}
+
+func TestMinRetention(t *testing.T) {
+	sink, err := NewSinkFrom(Opts{
+		Expiration:   time.Second,
+		MinRetention: time.Minute,
+		Registerer:   prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.SetGauge("retained_gauge", 1, nil)
+	sink.AddSample("retained_sample", 1, nil)
+	sink.IncrCounter("retained_counter", 1, nil)
+	now := time.Now()
+
+	count := func(at time.Time) int {
+		ch := make(chan prometheus.Metric, 10)
+		sink.collectAtTime(ch, at)
+		close(ch)
+		return len(ch)
+	}
+
+	for _, d := range []time.Duration{2 * time.Second, 30 * time.Second, 59 * time.Second} {
+		if n := count(now.Add(d)); n != 3 {
+			t.Fatalf("expected all series to be retained after %v, got %d", d, n)
+		}
+	}
+	// counters are never expired
+	if n := count(now.Add(61 * time.Second)); n != 1 {
+		t.Fatalf("expected series to expire after MinRetention, got %d", n)
+	}
+}
+
+func TestExpireAfterCollect(t *testing.T) {
+	sink, err := NewSinkFrom(Opts{
+		Expiration:            time.Second,
+		ExpireAfterCollect:    true,
+		ShadowHistogramSuffix: "_hist",
+		Registerer:            prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.SetGauge("pushed_gauge", 1, nil)
+	sink.AddSample("pushed_sample", 1, nil)
+	now := time.Now()
+
+	count := func(at time.Time) int {
+		ch := make(chan prometheus.Metric, 10)
+		sink.collectAtTime(ch, at)
+		close(ch)
+		return len(ch)
+	}
+
+	// the first scrape is after the expiration
+	if n := count(now.Add(10 * time.Second)); n != 3 {
+		t.Fatalf("expected the series to survive until the first collect, got %d", n)
+	}
+	if n := count(now.Add(10*time.Second + 500*time.Millisecond)); n != 3 {
+		t.Fatalf("expected the series to survive within the expiration since the collect, got %d", n)
+	}
+	if n := count(now.Add(12 * time.Second)); n != 0 {
+		t.Fatalf("expected the series to expire after the collect, got %d", n)
+	}
+}
+
+type fakePusher struct {
+	sink    *Sink
+	pushes  []map[string]float64
+	deletes int
+}
+
+func (f *fakePusher) Push() error {
+	f.pushes = append(f.pushes, f.sink.Snapshot())
+	return nil
+}
+
+func (f *fakePusher) Delete() error {
+	f.deletes++
+	return nil
+}
+
+func TestPushSinkResetSummaries(t *testing.T) {
+	sink, err := NewPushSinkFrom(PushOpts{
+		Address:              "localhost:9091",
+		PushInterval:         time.Hour,
+		Name:                 "pushtest",
+		ResetSummariesOnPush: true,
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	fake := &fakePusher{sink: sink.Sink}
+	sink.pusher = fake
+	defer sink.Shutdown()
+
+	sink.SetGauge("push_gauge", 1, nil)
+	sink.AddSample("push_sample", 10, nil)
+	sink.AddSample("push_sample", 20, nil)
+	if err = sink.push(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.AddSample("push_sample", 5, nil)
+	if err = sink.push(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	if len(fake.pushes) != 2 {
+		t.Fatalf("expected 2 pushes, got %d", len(fake.pushes))
+	}
+	first, second := fake.pushes[0], fake.pushes[1]
+	if first["push_sample_sum"] != 30 || first["push_sample_count"] != 2 {
+		t.Fatalf("unexpected first push: %v", first)
+	}
+	if second["push_sample_sum"] != 5 || second["push_sample_count"] != 1 {
+		t.Fatalf("expected only the second window in the second push: %v", second)
+	}
+	if second["push_gauge"] != 1 {
+		t.Fatalf("expected gauge to be kept: %v", second)
+	}
+}
+
+func TestPushSinkCreatedTimestamp(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		sink, err := NewPushSinkFrom(PushOpts{
+			Address:                 "localhost:9091",
+			PushInterval:            time.Hour,
+			Name:                    "pushtest",
+			DisableCreatedTimestamp: disabled,
+		})
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+		sink.pusher = &fakePusher{sink: sink.Sink}
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(sink.Sink)
+		sink.IncrCounter("push_counter", 1, nil)
+		mfs, err := reg.Gather()
+		sink.Shutdown()
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+		if len(mfs) != 1 || len(mfs[0].Metric) != 1 {
+			t.Fatalf("expected one counter, got %v", mfs)
+		}
+		created := mfs[0].Metric[0].GetCounter().GetCreatedTimestamp()
+		if disabled && created != nil {
+			t.Fatalf("expected no created timestamp, got %v", created)
+		}
+		if !disabled && created == nil {
+			t.Fatalf("expected the created timestamp to be kept")
+		}
+	}
+}
+
+func TestPushSinkGrouping(t *testing.T) {
+	requests := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sink, err := NewPushSinkFrom(PushOpts{
+		Address:      server.URL,
+		PushInterval: time.Hour,
+		Name:         "pushtest",
+		Grouping:     map[string]string{"instance": "i1", "az": "a"},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	defer sink.Shutdown()
+
+	sink.SetGauge("push_gauge", 1, nil)
+	if err = sink.push(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	req := <-requests
+	if !strings.HasPrefix(req, "PUT /metrics/job/pushtest/") ||
+		!strings.Contains(req, "/az/a") ||
+		!strings.Contains(req, "/instance/i1") {
+		t.Fatalf("unexpected request: %s", req)
+	}
+}
+
+func TestPushSinkDeleteOnShutdown(t *testing.T) {
+	sink, err := NewPushSinkFrom(PushOpts{
+		Address:          "localhost:9091",
+		PushInterval:     time.Hour,
+		Name:             "pushtest",
+		DeleteOnShutdown: true,
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	fake := &fakePusher{sink: sink.Sink}
+	sink.pusher = fake
+
+	sink.SetGauge("push_gauge", 1, nil)
+	sink.Shutdown()
+
+	if fake.deletes != 1 {
+		t.Fatalf("expected 1 delete, got %d", fake.deletes)
+	}
+	if len(fake.pushes) != 0 {
+		t.Fatalf("expected no push on shutdown, got %d", len(fake.pushes))
+	}
+}
+
+func TestCoalesceGaugeUpdates(t *testing.T) {
+	sink, err := NewSinkFrom(Opts{
+		Expiration:           time.Second,
+		CoalesceGaugeUpdates: true,
+		Registerer:           prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		sink.SetGauge("coalesced_gauge", float64(i), nil)
+	}
+	if v := sink.Snapshot()["coalesced_gauge"]; v != 9 {
+		t.Fatalf("expected the last value to win, got %v", v)
+	}
+
+	count := func(at time.Time) int {
+		ch := make(chan prometheus.Metric, 10)
+		sink.collectAtTime(ch, at)
+		close(ch)
+		return len(ch)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	sink.SetGauge("coalesced_gauge", 10, nil)
+	updated := time.Now()
+	// the update in place extends the expiry
+	if n := count(updated.Add(900 * time.Millisecond)); n != 1 {
+		t.Fatalf("expected the gauge to be retained, got %d", n)
+	}
+	if n := count(updated.Add(2 * time.Second)); n != 0 {
+		t.Fatalf("expected the gauge to expire, got %d", n)
+	}
+}
+
+func TestCoalesceGaugeUpdatesExpired(t *testing.T) {
+	sink, err := NewSinkFrom(Opts{
+		Expiration:           time.Second,
+		CoalesceGaugeUpdates: true,
+		Registerer:           prometheus.NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	collect := func(at time.Time) {
+		ch := make(chan prometheus.Metric, 10)
+		sink.collectAtTime(ch, at)
+		close(ch)
+	}
+
+	sink.SetGauge("coalesced_gauge", 1, nil)
+	pg, _ := sink.gauges.Load("coalesced_gauge")
+	orphan := pg.(*gauge)
+
+	// the gauge loaded before the expiry is not updated in place
+	collect(time.Now().Add(2 * time.Second))
+	if orphan.setInPlace(2) {
+		t.Fatalf("expected the expired gauge to not be updated")
+	}
+	sink.SetGauge("coalesced_gauge", 3, nil)
+	if v, ok := sink.Snapshot()["coalesced_gauge"]; !ok || v != 3 {
+		t.Fatalf("expected the gauge to be created again, got %v, %t", v, ok)
+	}
+
+	// the updates racing with the expiry are not lost
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				collect(time.Now().Add(2 * time.Second))
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		sink.SetGauge("coalesced_gauge", float64(i), nil)
+		if v, ok := sink.Snapshot()["coalesced_gauge"]; ok && v != float64(i) {
+			t.Fatalf("expected %d, got %v", i, v)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkSetGauge(b *testing.B) {
+	for _, coalesce := range []bool{false, true} {
+		b.Run(fmt.Sprintf("coalesce=%t", coalesce), func(b *testing.B) {
+			sink, err := NewSinkFrom(Opts{
+				Expiration:           time.Minute,
+				CoalesceGaugeUpdates: coalesce,
+				Registerer:           prometheus.NewRegistry(),
+			})
+			if err != nil {
+				b.Fatalf("err = %v, want nil", err)
+			}
+			tags := []metrics.Tag{{Name: "queue", Value: "q1"}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sink.SetGauge("queue_depth", float64(i), tags)
+			}
+		})
+	}
+}
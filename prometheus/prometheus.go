@@ -1,15 +1,26 @@
 package prometheus
 
 import (
+	"fmt"
 	"log"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/effective-security/metrics"
 	"github.com/effective-security/xlog"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 var logger = xlog.NewPackageLogger("github.com/effective-security/metrics", "prom")
@@ -29,12 +40,73 @@ var (
 // DefMaxAge.
 const ObservationMaxAge = 10 * time.Minute
 
+// defaultObjectives are the quantiles of the summaries, if not configured by ObjectivesByPattern
+var defaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
 // Opts is used to configure the Prometheus Sink
 type Opts struct {
 	// Expiration is the duration a metric is valid for, after which it will be
 	// untracked. If the value is zero, a metric is never expired.
 	Expiration time.Duration
-	Registerer prometheus.Registerer
+	// ExpirationJitter is the fraction of Expiration to randomize each ephemeral
+	// series expiry by, in [0, 1). For example 0.1 means ±10%.
+	// It avoids evicting all series created at the same time in the same Collect.
+	ExpirationJitter float64
+	// MinRetention is the minimum duration an ephemeral series is retained
+	// since it is first seen, regardless of Expiration.
+	// It allows a one-shot metric to be scraped, for example a rare error.
+	MinRetention time.Duration
+	Registerer   prometheus.Registerer
+
+	// ExpireAfterCollect specifies to count the expiration of an ephemeral series
+	// from the first Collect after its last update, instead of the last update,
+	// so the series is scraped at least once before it is expired,
+	// when the scrapes are less frequent than the Expiration.
+	ExpireAfterCollect bool
+
+	// DisableCreatedTimestamp removes the created timestamp of counters and summaries.
+	// The created timestamp is exposed by default, as by the client library without this sink,
+	// for example as the OpenMetrics `_created` series, and allows the scrapers to detect restarts.
+	DisableCreatedTimestamp bool
+
+	// LabelValueNormalizer is called for each tag of the emitted metrics,
+	// to normalize the label value, for example to lowercase the user input.
+	// If nil, the values are not changed.
+	LabelValueNormalizer func(name, value string) string
+
+	// ObjectivesByPattern specifies the summary objectives for ephemeral summaries,
+	// the first pattern matching the metric name wins, see path.Match for the syntax.
+	// If none matches, then the default p50/p90/p99 objectives are used.
+	ObjectivesByPattern []ObjectivesPattern
+
+	// ShadowHistogramSuffix enables to observe each AddSample also in a histogram,
+	// named with the suffix, for example "_hist".
+	// It allows to migrate from summaries to histograms without breaking dashboards.
+	ShadowHistogramSuffix string
+	// ShadowHistogramBuckets are the buckets of the shadow histograms,
+	// by default prometheus.DefBuckets
+	ShadowHistogramBuckets []float64
+
+	// EmitInternalMetrics exposes the sink's own metrics:
+	// `prometheus_sink_collect_duration_seconds` and `prometheus_sink_series_count`
+	// gauges, labeled by the sink name.
+	EmitInternalMetrics bool
+
+	// CoalesceGaugeUpdates specifies to update the existing gauges in place,
+	// instead of copying and storing the gauge on each SetGauge,
+	// to reduce the cost of high-frequency updates.
+	CoalesceGaugeUpdates bool
+
+	// ValidateDefinitions specifies to check the definitions with ValidateOpts
+	// when the sink is created, by default only the duplicates are checked.
+	ValidateDefinitions bool
+
+	// AppendUnitSuffix specifies to append the unit from Units to the exposed names,
+	// for example "_seconds", if the name does not end with it already.
+	// The suffix of the counters is inserted before "_total".
+	AppendUnitSuffix bool
+	// Units of the metrics, see metrics.Config.Units
+	Units map[string]string
 
 	// Gauges, Summaries, and Counters allow us to pre-declare metrics by giving
 	// their Name, Help, and ConstLabels to the Sink when it is created.
@@ -66,10 +138,42 @@ type Sink struct {
 	// If these will ever be copied, they should be converted to *sync.Map values and initialized appropriately
 	gauges     sync.Map
 	summaries  sync.Map
+	histograms sync.Map
 	counters   sync.Map
+	infos      sync.Map
+	heartbeats sync.Map
 	expiration time.Duration
+	jitter     float64
+	retention  time.Duration
+	onCollect  bool
+	created    bool
+	coalesce   bool
+	normalizer func(name, value string) string
+	objectives []ObjectivesPattern
+	shadow     string // suffix of the shadow histograms
+	buckets    []float64
 	help       map[string]string
+	units      map[string]string // set with AppendUnitSuffix
 	name       string
+
+	// collectDurationDesc and seriesCountDesc are set if EmitInternalMetrics is enabled
+	collectDurationDesc *prometheus.Desc
+	seriesCountDesc     *prometheus.Desc
+
+	constLock  sync.RWMutex
+	constFuncs []constMetricFunc
+}
+
+type constMetricFunc struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	fn        func() (float64, []string)
+}
+
+// ObjectivesPattern specifies the summary objectives for metrics matching the Pattern
+type ObjectivesPattern struct {
+	Pattern    string
+	Objectives map[float64]float64
 }
 
 // GaugeDefinition can be provided to PrometheusOpts to declare a constant gauge that is not deleted on expiry.
@@ -84,6 +188,67 @@ type gauge struct {
 	updatedAt time.Time
 	// canDelete is set if the metric is created during runtime so we know it's ephemeral and can delete it on expiry.
 	canDelete bool
+	// expiration is the jittered expiration of the series
+	expiration time.Duration
+	// createdAt is the time the series is first seen
+	createdAt time.Time
+	// coalesced is set with CoalesceGaugeUpdates
+	coalesced *coalescedGauge
+	// collected is the time of the first Collect after the last update in nanoseconds,
+	// with ExpireAfterCollect
+	collected *atomic.Int64
+}
+
+// coalescedGauge is the state of the gauge updated in place
+type coalescedGauge struct {
+	// lock serializes the update in place with the expiry of the gauge
+	lock sync.Mutex
+	// lastUpdate is updatedAt in nanoseconds
+	lastUpdate atomic.Int64
+	// deleted is set when the gauge is expired, and must not be updated in place
+	deleted bool
+}
+
+// lastUpdated returns the time of the last update
+func (g *gauge) lastUpdated() time.Time {
+	if g.coalesced != nil {
+		return time.Unix(0, g.coalesced.lastUpdate.Load())
+	}
+	return g.updatedAt
+}
+
+// setInPlace updates the coalesced gauge,
+// and returns false if the gauge is deleted on expiry
+func (g *gauge) setInPlace(val float64) bool {
+	g.coalesced.lock.Lock()
+	defer g.coalesced.lock.Unlock()
+	if g.coalesced.deleted {
+		return false
+	}
+	g.Set(val)
+	g.coalesced.lastUpdate.Store(time.Now().UnixNano())
+	return true
+}
+
+// expireGauge deletes the gauge from the sink, if it is expired at the time t
+func (p *Sink) expireGauge(k any, g *gauge, t time.Time) bool {
+	if !g.canDelete {
+		return false
+	}
+	if g.coalesced != nil {
+		// the update in place can not happen between the check and the delete
+		g.coalesced.lock.Lock()
+		defer g.coalesced.lock.Unlock()
+	}
+	lastUpdate := collectedSince(g.collected, g.lastUpdated(), t)
+	if !lastUpdate.Add(g.expiration).Before(t) || p.retained(g.createdAt, t) {
+		return false
+	}
+	if g.coalesced != nil {
+		g.coalesced.deleted = true
+	}
+	p.gauges.CompareAndDelete(k, g)
+	return true
 }
 
 // SummaryDefinition can be provided to PrometheusOpts to declare a constant summary that is not deleted on expiry.
@@ -95,8 +260,19 @@ type SummaryDefinition struct {
 
 type summary struct {
 	prometheus.Summary
-	updatedAt time.Time
-	canDelete bool
+	updatedAt  time.Time
+	canDelete  bool
+	expiration time.Duration
+	createdAt  time.Time
+	collected  *atomic.Int64
+}
+
+type histogram struct {
+	prometheus.Histogram
+	updatedAt  time.Time
+	expiration time.Duration
+	createdAt  time.Time
+	collected  *atomic.Int64
 }
 
 // CounterDefinition can be provided to PrometheusOpts to declare a constant counter that is not deleted on expiry.
@@ -112,6 +288,43 @@ type counter struct {
 	//canDelete bool
 }
 
+// heartbeat exposes `<name>_up` gauge, 1 if the last beat is within the expiration
+type heartbeat struct {
+	desc *prometheus.Desc
+	// lastBeat is the time of the last beat in nanoseconds, 0 if never
+	lastBeat atomic.Int64
+}
+
+// metric returns the up gauge at the time t,
+// the beat never expires if expiration is 0
+func (hb *heartbeat) metric(expiration time.Duration, t time.Time) prometheus.Metric {
+	up := float64(0)
+	if last := hb.lastBeat.Load(); last != 0 && (expiration == 0 || time.Unix(0, last).Add(expiration).After(t)) {
+		up = 1
+	}
+	return prometheus.MustNewConstMetric(hb.desc, prometheus.GaugeValue, up)
+}
+
+// lastUpdated returns the time of the last beat, zero if never
+func (hb *heartbeat) lastUpdated() time.Time {
+	if last := hb.lastBeat.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
+}
+
+type info struct {
+	prometheus.Gauge
+	// hash identifies the label set of the current series
+	hash string
+}
+
+var (
+	_ metrics.Sink            = (*Sink)(nil)
+	_ metrics.Sink            = (*PushSink)(nil)
+	_ metrics.CounterInitSink = (*Sink)(nil)
+)
+
 // NewSink creates a new Sink using the default options.
 func NewSink() (*Sink, error) {
 	return NewSinkFrom(DefaultPrometheusOpts)
@@ -119,6 +332,40 @@ func NewSink() (*Sink, error) {
 
 // NewSinkFrom creates a new Sink using the passed options.
 func NewSinkFrom(opts Opts) (*Sink, error) {
+	sink := newSink(opts)
+
+	check := checkDefinitions
+	if opts.ValidateDefinitions {
+		check = ValidateOpts
+	}
+	if err := check(opts); err != nil {
+		return nil, err
+	}
+	// the jitter of 1 or more makes the expiration of some series zero or negative
+	if opts.ExpirationJitter < 0 || opts.ExpirationJitter >= 1 {
+		return nil, errors.Errorf("invalid expiration jitter: %v, must be in [0, 1)", opts.ExpirationJitter)
+	}
+	for _, o := range opts.ObjectivesByPattern {
+		if _, err := path.Match(o.Pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid objectives pattern: %q", o.Pattern)
+		}
+	}
+
+	sink.initGauges(opts.GaugeDefinitions)
+	sink.initSummaries(opts.SummaryDefinitions)
+	sink.initCounters(opts.CounterDefinitions)
+
+	reg := opts.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	return sink, reg.Register(sink)
+}
+
+// newSink returns the sink with the options and defaults applied,
+// the definitions are not validated and the sink is not registered
+func newSink(opts Opts) *Sink {
 	name := opts.Name
 	if name == "" {
 		name = "default_prometheus_sink"
@@ -128,23 +375,35 @@ func NewSinkFrom(opts Opts) (*Sink, error) {
 		summaries:  sync.Map{},
 		counters:   sync.Map{},
 		expiration: opts.Expiration,
+		jitter:     opts.ExpirationJitter,
+		retention:  opts.MinRetention,
+		onCollect:  opts.ExpireAfterCollect,
+		created:    !opts.DisableCreatedTimestamp,
+		coalesce:   opts.CoalesceGaugeUpdates,
+		normalizer: opts.LabelValueNormalizer,
+		objectives: opts.ObjectivesByPattern,
+		shadow:     opts.ShadowHistogramSuffix,
+		buckets:    opts.ShadowHistogramBuckets,
 		help:       opts.Help,
 		name:       name,
 	}
 	if sink.help == nil {
 		sink.help = make(map[string]string)
 	}
-
-	initGauges(&sink.gauges, opts.GaugeDefinitions, sink.help)
-	initSummaries(&sink.summaries, opts.SummaryDefinitions, sink.help)
-	initCounters(&sink.counters, opts.CounterDefinitions, sink.help)
-
-	reg := opts.Registerer
-	if reg == nil {
-		reg = prometheus.DefaultRegisterer
+	if sink.buckets == nil {
+		sink.buckets = prometheus.DefBuckets
 	}
-
-	return sink, reg.Register(sink)
+	if opts.AppendUnitSuffix {
+		sink.units = opts.Units
+	}
+	if opts.EmitInternalMetrics {
+		constLabels := prometheus.Labels{"sink": name}
+		sink.collectDurationDesc = prometheus.NewDesc("prometheus_sink_collect_duration_seconds",
+			"Duration of the last Collect of the metrics sink", nil, constLabels)
+		sink.seriesCountDesc = prometheus.NewDesc("prometheus_sink_series_count",
+			"Number of series collected by the metrics sink", []string{"type"}, constLabels)
+	}
+	return sink
 }
 
 // Describe sends a Collector.Describe value from the descriptor created around Sink.Name
@@ -168,22 +427,21 @@ func (p *Sink) Collect(c chan<- prometheus.Metric) {
 // collectAtTime allows internal testing of the expiry based logic here without
 // mocking clocks or making tests timing sensitive.
 func (p *Sink) collectAtTime(c chan<- prometheus.Metric, t time.Time) {
+	started := time.Now()
 	expire := p.expiration != 0
 	deleted := 0
+	var gauges, summaries, histograms, counters, infos int
 	p.gauges.Range(func(k, v any) bool {
 		if v == nil {
 			return true
 		}
 		g := v.(*gauge)
-		lastUpdate := g.updatedAt
-		if expire && lastUpdate.Add(p.expiration).Before(t) {
-			if g.canDelete {
-				p.gauges.Delete(k)
-				deleted++
-				return true
-			}
+		if expire && p.expireGauge(k, g, t) {
+			deleted++
+			return true
 		}
 		g.Collect(c)
+		gauges++
 		return true
 	})
 	p.summaries.Range(func(k, v any) bool {
@@ -191,15 +449,40 @@ func (p *Sink) collectAtTime(c chan<- prometheus.Metric, t time.Time) {
 			return true
 		}
 		s := v.(*summary)
-		lastUpdate := s.updatedAt
-		if expire && lastUpdate.Add(p.expiration).Before(t) {
+		lastUpdate := collectedSince(s.collected, s.updatedAt, t)
+		if expire && lastUpdate.Add(s.expiration).Before(t) && !p.retained(s.createdAt, t) {
 			if s.canDelete {
 				p.summaries.Delete(k)
 				deleted++
 				return true
 			}
 		}
-		s.Collect(c)
+		if p.created {
+			s.Collect(c)
+		} else {
+			c <- noCreatedTimestamp{Metric: s.Summary}
+		}
+		summaries++
+		return true
+	})
+	// shadow histograms are always ephemeral
+	p.histograms.Range(func(k, v any) bool {
+		if v == nil {
+			return true
+		}
+		h := v.(*histogram)
+		lastUpdate := collectedSince(h.collected, h.updatedAt, t)
+		if expire && lastUpdate.Add(h.expiration).Before(t) && !p.retained(h.createdAt, t) {
+			p.histograms.Delete(k)
+			deleted++
+			return true
+		}
+		if p.created {
+			h.Collect(c)
+		} else {
+			c <- noCreatedTimestamp{Metric: h.Histogram}
+		}
+		histograms++
 		return true
 	})
 	p.counters.Range(func(_, v any) bool {
@@ -218,65 +501,267 @@ func (p *Sink) collectAtTime(c chan<- prometheus.Metric, t time.Time) {
 				}
 			}
 		*/
-		count.Collect(c)
+		if p.created {
+			count.Collect(c)
+		} else {
+			c <- noCreatedTimestamp{Metric: count.Counter}
+		}
+		counters++
+		return true
+	})
+	// info metrics are never expired
+	p.infos.Range(func(_, v any) bool {
+		if v == nil {
+			return true
+		}
+		v.(*info).Collect(c)
+		infos++
+		return true
+	})
+	// heartbeats are computed at collect time, and never expired
+	p.heartbeats.Range(func(_, v any) bool {
+		c <- v.(*heartbeat).metric(p.expiration, t)
 		return true
 	})
 	if deleted > 0 {
 		logger.KV(xlog.DEBUG, "deleted_expired", deleted)
 	}
+
+	p.constLock.RLock()
+	for _, cm := range p.constFuncs {
+		val, labelValues := cm.fn()
+		m, err := prometheus.NewConstMetric(cm.desc, cm.valueType, val, labelValues...)
+		if err != nil {
+			// the error is reported by the registry on Gather, instead of panic in Collect
+			m = prometheus.NewInvalidMetric(cm.desc, err)
+		}
+		c <- m
+	}
+	p.constLock.RUnlock()
+
+	if p.collectDurationDesc != nil {
+		c <- prometheus.MustNewConstMetric(p.seriesCountDesc, prometheus.GaugeValue, float64(gauges), "gauge")
+		c <- prometheus.MustNewConstMetric(p.seriesCountDesc, prometheus.GaugeValue, float64(summaries), "summary")
+		c <- prometheus.MustNewConstMetric(p.seriesCountDesc, prometheus.GaugeValue, float64(histograms), "histogram")
+		c <- prometheus.MustNewConstMetric(p.seriesCountDesc, prometheus.GaugeValue, float64(counters), "counter")
+		c <- prometheus.MustNewConstMetric(p.seriesCountDesc, prometheus.GaugeValue, float64(infos), "info")
+		c <- prometheus.MustNewConstMetric(p.collectDurationDesc, prometheus.GaugeValue, time.Since(started).Seconds())
+	}
 }
 
-func initGauges(m *sync.Map, gauges []GaugeDefinition, help map[string]string) {
+// RegisterConstMetricFunc registers a callback to emit a const metric on each Collect,
+// the function returns the value and the label values in the order of desc variable labels.
+// If the label values do not match desc, the metric is reported as invalid on Gather.
+func (p *Sink) RegisterConstMetricFunc(desc *prometheus.Desc, valueType prometheus.ValueType, fn func() (float64, []string)) {
+	p.constLock.Lock()
+	defer p.constLock.Unlock()
+	p.constFuncs = append(p.constFuncs, constMetricFunc{
+		desc:      desc,
+		valueType: valueType,
+		fn:        fn,
+	})
+}
+
+// noCreatedTimestamp removes the created timestamp set by the client library
+// from counters and summaries
+type noCreatedTimestamp struct {
+	prometheus.Metric
+}
+
+// Write implements prometheus.Metric
+func (m noCreatedTimestamp) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	if out.Counter != nil {
+		out.Counter.CreatedTimestamp = nil
+	}
+	if out.Summary != nil {
+		out.Summary.CreatedTimestamp = nil
+	}
+	if out.Histogram != nil {
+		out.Histogram.CreatedTimestamp = nil
+	}
+	return nil
+}
+
+// seriesExpiration returns the expiration for a new ephemeral series,
+// randomized by the configured jitter
+func (p *Sink) seriesExpiration() time.Duration {
+	if p.jitter <= 0 {
+		return p.expiration
+	}
+	return time.Duration(float64(p.expiration) * (1 + p.jitter*(2*rand.Float64()-1)))
+}
+
+// checkDefinitions returns an error if the same metric is declared more than once
+func checkDefinitions(opts Opts) error {
+	declared := make(map[string]string)
+	check := func(kind, name string, tags []metrics.Tag) error {
+		_, hash := flattenKey(name, tags)
+		if prev, ok := declared[hash]; ok {
+			return errors.Errorf("duplicate metric definition: %s %q is already declared as %s", kind, hash, prev)
+		}
+		declared[hash] = kind
+		return nil
+	}
+
+	for _, g := range opts.GaugeDefinitions {
+		if err := check("gauge", g.Name, g.ConstTags); err != nil {
+			return err
+		}
+	}
+	for _, s := range opts.SummaryDefinitions {
+		if err := check("summary", s.Name, s.ConstTags); err != nil {
+			return err
+		}
+	}
+	for _, c := range opts.CounterDefinitions {
+		if err := check("counter", c.Name, c.ConstTags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateOpts checks the metric definitions: the names and tags must be valid
+// Prometheus names, the help must not be empty, and each name must be declared
+// with one type only. All found problems are returned in one error.
+func ValidateOpts(opts Opts) error {
+	var problems []string
+	types := make(map[string]string)
+	declared := make(map[string]bool)
+	check := func(kind, name, help string, tags []metrics.Tag) {
+		key, hash := flattenKey(name, tags)
+		if !model.IsValidMetricName(model.LabelValue(key)) {
+			problems = append(problems, fmt.Sprintf("%s %q: invalid name", kind, name))
+		}
+		for _, t := range tags {
+			if !model.LabelName(t.Name).IsValid() {
+				problems = append(problems, fmt.Sprintf("%s %q: invalid tag name %q", kind, name, t.Name))
+			}
+		}
+		if help == "" && opts.Help[key] == "" {
+			problems = append(problems, fmt.Sprintf("%s %q: empty help", kind, name))
+		}
+		if prev, ok := types[key]; ok && prev != kind {
+			problems = append(problems, fmt.Sprintf("%s %q: already declared as %s", kind, name, prev))
+		} else if declared[hash] {
+			problems = append(problems, fmt.Sprintf("%s %q: duplicate definition", kind, hash))
+		}
+		if _, ok := types[key]; !ok {
+			types[key] = kind
+		}
+		declared[hash] = true
+	}
+
+	for _, g := range opts.GaugeDefinitions {
+		check("gauge", g.Name, g.Help, g.ConstTags)
+	}
+	for _, s := range opts.SummaryDefinitions {
+		check("summary", s.Name, s.Help, s.ConstTags)
+	}
+	for _, c := range opts.CounterDefinitions {
+		check("counter", c.Name, c.Help, c.ConstTags)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid metric definitions: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// newCollected returns the collect time of a new series with ExpireAfterCollect, or nil
+func (p *Sink) newCollected() *atomic.Int64 {
+	if !p.onCollect {
+		return nil
+	}
+	return new(atomic.Int64)
+}
+
+// collectedSince returns the time to count the expiration from.
+// With ExpireAfterCollect, it is the time of the first Collect after the last update,
+// and the series is marked as collected at t if it is not yet.
+func collectedSince(collected *atomic.Int64, lastUpdate, t time.Time) time.Time {
+	if collected == nil {
+		return lastUpdate
+	}
+	if c := collected.Load(); c >= lastUpdate.UnixNano() {
+		return time.Unix(0, c)
+	}
+	collected.Store(t.UnixNano())
+	return t
+}
+
+// retained returns true if the series first seen at createdAt
+// is within MinRetention at t
+func (p *Sink) retained(createdAt, t time.Time) bool {
+	return p.retention > 0 && t.Before(createdAt.Add(p.retention))
+}
+
+func (p *Sink) initGauges(gauges []GaugeDefinition) {
 	for _, g := range gauges {
 		key, hash := flattenKey(g.Name, g.ConstTags)
-		help[key] = g.Help
+		p.help[key] = g.Help
 		pG := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        key,
+			Name:        p.exposedName(key, false),
 			Help:        g.Help,
 			ConstLabels: prometheusLabels(g.ConstTags),
 		})
-		m.Store(hash, &gauge{Gauge: pG})
+		p.gauges.Store(hash, &gauge{Gauge: pG})
 	}
 }
 
-func initSummaries(m *sync.Map, summaries []SummaryDefinition, help map[string]string) {
+func (p *Sink) initSummaries(summaries []SummaryDefinition) {
 	for _, s := range summaries {
 		key, hash := flattenKey(s.Name, s.ConstTags)
-		help[key] = s.Help
+		p.help[key] = s.Help
 		pS := prometheus.NewSummary(prometheus.SummaryOpts{
-			Name:        key,
+			Name:        p.exposedName(key, false),
 			Help:        s.Help,
 			MaxAge:      ObservationMaxAge,
 			ConstLabels: prometheusLabels(s.ConstTags),
-			Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			Objectives:  defaultObjectives,
 		})
-		m.Store(hash, &summary{Summary: pS})
+		p.summaries.Store(hash, &summary{Summary: pS})
 	}
 }
 
-func initCounters(m *sync.Map, counters []CounterDefinition, help map[string]string) {
+func (p *Sink) initCounters(counters []CounterDefinition) {
 	for _, c := range counters {
 		key, hash := flattenKey(c.Name, c.ConstTags)
-		help[key] = c.Help
+		p.help[key] = c.Help
 		pC := prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        key,
+			Name:        p.exposedName(key, true),
 			Help:        c.Help,
 			ConstLabels: prometheusLabels(c.ConstTags),
 		})
-		m.Store(hash, &counter{Counter: pC})
+		p.counters.Store(hash, &counter{Counter: pC})
+	}
+}
+
+// exposedName returns the name with the unit suffix, with AppendUnitSuffix.
+// The suffix of the counters is inserted before "_total".
+func (p *Sink) exposedName(key string, isCounter bool) string {
+	unit := p.units[key]
+	if unit == "" {
+		return key
+	}
+	suffix := "_" + unit
+	base, total := key, ""
+	if isCounter && strings.HasSuffix(key, "_total") {
+		base, total = strings.TrimSuffix(key, "_total"), "_total"
+	}
+	if strings.HasSuffix(base, suffix) {
+		return key
 	}
+	return base + suffix + total
 }
 
 var forbiddenCharsReplacer = strings.NewReplacer(" ", "_", ".", "_", "=", "_", "-", "_", "/", "_")
 
 func flattenKey(parts string, labels []metrics.Tag) (string, string) {
 	key := forbiddenCharsReplacer.Replace(parts)
-
-	hash := key
-	for _, label := range labels {
-		hash += ";" + label.Name + "=" + label.Value
-	}
-
+	_, hash := metrics.FlattenKey(key, labels)
 	return key, hash
 }
 
@@ -288,8 +773,25 @@ func prometheusLabels(labels []metrics.Tag) prometheus.Labels {
 	return l
 }
 
+// normalizeLabels returns the labels with normalized values,
+// the provided slice is not modified
+func (p *Sink) normalizeLabels(labels []metrics.Tag) []metrics.Tag {
+	if p.normalizer == nil || len(labels) == 0 {
+		return labels
+	}
+	normalized := make([]metrics.Tag, len(labels))
+	for i, l := range labels {
+		normalized[i] = metrics.Tag{
+			Name:  l.Name,
+			Value: p.normalizer(l.Name, l.Value),
+		}
+	}
+	return normalized
+}
+
 // SetGauge should retain the last value it is set to
 func (p *Sink) SetGauge(parts string, val float64, labels []metrics.Tag) {
+	labels = p.normalizeLabels(labels)
 	key, hash := flattenKey(parts, labels)
 	pg, ok := p.gauges.Load(hash)
 
@@ -300,35 +802,52 @@ func (p *Sink) SetGauge(parts string, val float64, labels []metrics.Tag) {
 	// so there's no issues there. It's possible for racy updates to occur to the updatedAt
 	// value, but since we're always setting it to time.Now(), it doesn't really matter.
 	if ok {
-		localGauge := *pg.(*gauge)
-		localGauge.Set(val)
-		localGauge.updatedAt = time.Now()
-		p.gauges.Store(hash, &localGauge)
-
-		// The gauge does not exist, create the gauge and allow it to be deleted
-	} else {
-		help := key
-		existingHelp, ok := p.help[key]
-		if ok {
-			help = existingHelp
+		g := pg.(*gauge)
+		if g.coalesced == nil {
+			localGauge := *g
+			localGauge.Set(val)
+			localGauge.updatedAt = time.Now()
+			p.gauges.Store(hash, &localGauge)
+			return
 		}
-		g := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        key,
-			Help:        help,
-			ConstLabels: prometheusLabels(labels),
-		})
-		g.Set(val)
-		pg = &gauge{
-			Gauge:     g,
-			updatedAt: time.Now(),
-			canDelete: true,
+		// with CoalesceGaugeUpdates, the gauge is updated in place,
+		// or created again below, if it is deleted on expiry after Load
+		if g.setInPlace(val) {
+			return
 		}
-		p.gauges.Store(hash, pg)
 	}
+
+	// The gauge does not exist, create the gauge and allow it to be deleted
+	help := key
+	existingHelp, ok := p.help[key]
+	if ok {
+		help = existingHelp
+	}
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        p.exposedName(key, false),
+		Help:        help,
+		ConstLabels: prometheusLabels(labels),
+	})
+	g.Set(val)
+	now := time.Now()
+	ng := &gauge{
+		Gauge:      g,
+		updatedAt:  now,
+		canDelete:  true,
+		expiration: p.seriesExpiration(),
+		createdAt:  now,
+		collected:  p.newCollected(),
+	}
+	if p.coalesce {
+		ng.coalesced = &coalescedGauge{}
+		ng.coalesced.lastUpdate.Store(now.UnixNano())
+	}
+	p.gauges.Store(hash, ng)
 }
 
 // AddSample is for timing information, where quantiles are used
 func (p *Sink) AddSample(parts string, val float64, labels []metrics.Tag) {
+	labels = p.normalizeLabels(labels)
 	key, hash := flattenKey(parts, labels)
 	ps, ok := p.summaries.Load(hash)
 
@@ -347,20 +866,72 @@ func (p *Sink) AddSample(parts string, val float64, labels []metrics.Tag) {
 			help = existingHelp
 		}
 		s := prometheus.NewSummary(prometheus.SummaryOpts{
-			Name:        key,
+			Name:        p.exposedName(key, false),
 			Help:        help,
 			MaxAge:      ObservationMaxAge,
 			ConstLabels: prometheusLabels(labels),
-			Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			Objectives:  p.summaryObjectives(key),
 		})
 		s.Observe(val)
+		now := time.Now()
 		ps = &summary{
-			Summary:   s,
-			updatedAt: time.Now(),
-			canDelete: true,
+			Summary:    s,
+			updatedAt:  now,
+			canDelete:  true,
+			expiration: p.seriesExpiration(),
+			createdAt:  now,
+			collected:  p.newCollected(),
 		}
 		p.summaries.Store(hash, ps)
 	}
+
+	if p.shadow != "" {
+		p.observeHistogram(key, hash, val, labels)
+	}
+}
+
+// observeHistogram observes the sample in the shadow histogram
+func (p *Sink) observeHistogram(key, hash string, val float64, labels []metrics.Tag) {
+	hash = suffixHash(hash, p.shadow)
+	ph, ok := p.histograms.Load(hash)
+	if ok {
+		// use a local copy, as in AddSample
+		localHistogram := *ph.(*histogram)
+		localHistogram.Observe(val)
+		localHistogram.updatedAt = time.Now()
+		p.histograms.Store(hash, &localHistogram)
+		return
+	}
+
+	help := key
+	if existingHelp, ok := p.help[key]; ok {
+		help = existingHelp
+	}
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        p.exposedName(key, false) + p.shadow,
+		Help:        help,
+		ConstLabels: prometheusLabels(labels),
+		Buckets:     p.buckets,
+	})
+	h.Observe(val)
+	now := time.Now()
+	p.histograms.Store(hash, &histogram{
+		Histogram:  h,
+		updatedAt:  now,
+		expiration: p.seriesExpiration(),
+		createdAt:  now,
+		collected:  p.newCollected(),
+	})
+}
+
+// summaryObjectives returns the objectives for the summary name
+func (p *Sink) summaryObjectives(name string) map[float64]float64 {
+	for _, o := range p.objectives {
+		if ok, _ := path.Match(o.Pattern, name); ok {
+			return o.Objectives
+		}
+	}
+	return defaultObjectives
 }
 
 // EmitKey is not implemented. Prometheus doesn’t offer a type for which an
@@ -371,6 +942,7 @@ func (p *Sink) AddSample(parts string, val float64, labels []metrics.Tag) {
 
 // IncrCounter should accumulate values
 func (p *Sink) IncrCounter(parts string, val float64, labels []metrics.Tag) {
+	labels = p.normalizeLabels(labels)
 	key, hash := flattenKey(parts, labels)
 	pc, ok := p.counters.Load(hash)
 
@@ -389,7 +961,7 @@ func (p *Sink) IncrCounter(parts string, val float64, labels []metrics.Tag) {
 			help = existingHelp
 		}
 		c := prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        key,
+			Name:        p.exposedName(key, true),
 			Help:        help,
 			ConstLabels: prometheusLabels(labels),
 		})
@@ -403,34 +975,359 @@ func (p *Sink) IncrCounter(parts string, val float64, labels []metrics.Tag) {
 	}
 }
 
+// InitCounter registers the counter at 0, if it does not exist,
+// so it is exposed before the first increment
+func (p *Sink) InitCounter(parts string, labels []metrics.Tag) {
+	labels = p.normalizeLabels(labels)
+	key, hash := flattenKey(parts, labels)
+	if _, ok := p.counters.Load(hash); ok {
+		return
+	}
+
+	help := key
+	existingHelp, ok := p.help[key]
+	if ok {
+		help = existingHelp
+	}
+	c := prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        p.exposedName(key, true),
+		Help:        help,
+		ConstLabels: prometheusLabels(labels),
+	})
+	p.counters.LoadOrStore(hash, &counter{
+		Counter:   c,
+		updatedAt: time.Now(),
+	})
+}
+
+// SetInfo sets an info metric, that is a constant `1` gauge with the given labels,
+// for things like build info or feature flag states.
+// Info metrics never expire. Only one series is kept per metric name:
+// setting the same labels again is a no-op, and setting a new label set
+// replaces the previous series.
+func (p *Sink) SetInfo(parts string, labels []metrics.Tag) {
+	labels = p.normalizeLabels(labels)
+	key, hash := flattenKey(parts, labels)
+	if pi, ok := p.infos.Load(key); ok && pi.(*info).hash == hash {
+		return
+	}
+
+	help := key
+	existingHelp, ok := p.help[key]
+	if ok {
+		help = existingHelp
+	}
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        p.exposedName(key, false),
+		Help:        help,
+		ConstLabels: prometheusLabels(labels),
+	})
+	g.Set(1)
+	p.infos.Store(key, &info{
+		Gauge: g,
+		hash:  hash,
+	})
+}
+
+// RegisterHeartbeat registers `<name>_up` gauge, that is 1 if Beat was called
+// within the expiration window, and 0 otherwise or if Beat was never called.
+func (p *Sink) RegisterHeartbeat(name string, labels []metrics.Tag) {
+	p.heartbeat(name, labels)
+}
+
+// Beat records the heartbeat of the subsystem, registering it if needed
+func (p *Sink) Beat(name string, labels []metrics.Tag) {
+	p.heartbeat(name, labels).lastBeat.Store(time.Now().UnixNano())
+}
+
+func (p *Sink) heartbeat(name string, labels []metrics.Tag) *heartbeat {
+	labels = p.normalizeLabels(labels)
+	key, hash := flattenKey(name+"_up", labels)
+	if hb, ok := p.heartbeats.Load(hash); ok {
+		return hb.(*heartbeat)
+	}
+
+	help := key
+	existingHelp, ok := p.help[key]
+	if ok {
+		help = existingHelp
+	}
+	hb, _ := p.heartbeats.LoadOrStore(hash, &heartbeat{
+		desc: prometheus.NewDesc(p.exposedName(key, false), help, nil, prometheusLabels(labels)),
+	})
+	return hb.(*heartbeat)
+}
+
+// Snapshot returns the current values of gauges, heartbeats and counters keyed by their hash,
+// and summaries as `_sum` and `_count` values.
+// It can be used for a lightweight status endpoint without gathering the registry.
+func (p *Sink) Snapshot() map[string]float64 {
+	res := make(map[string]float64)
+	p.gauges.Range(func(k, v any) bool {
+		if v == nil {
+			return true
+		}
+		// use a local copy, as in SetGauge
+		localGauge := *v.(*gauge)
+		var m dto.Metric
+		if localGauge.Write(&m) == nil {
+			res[k.(string)] = m.GetGauge().GetValue()
+		}
+		return true
+	})
+	p.counters.Range(func(k, v any) bool {
+		if v == nil {
+			return true
+		}
+		localCounter := *v.(*counter)
+		var m dto.Metric
+		if localCounter.Write(&m) == nil {
+			res[k.(string)] = m.GetCounter().GetValue()
+		}
+		return true
+	})
+	p.summaries.Range(func(k, v any) bool {
+		if v == nil {
+			return true
+		}
+		localSummary := *v.(*summary)
+		var m dto.Metric
+		if localSummary.Write(&m) == nil {
+			hash := k.(string)
+			res[suffixHash(hash, "_sum")] = m.GetSummary().GetSampleSum()
+			res[suffixHash(hash, "_count")] = float64(m.GetSummary().GetSampleCount())
+		}
+		return true
+	})
+	p.histograms.Range(func(k, v any) bool {
+		if v == nil {
+			return true
+		}
+		localHistogram := *v.(*histogram)
+		var m dto.Metric
+		if localHistogram.Write(&m) == nil {
+			hash := k.(string)
+			res[suffixHash(hash, "_sum")] = m.GetHistogram().GetSampleSum()
+			res[suffixHash(hash, "_count")] = float64(m.GetHistogram().GetSampleCount())
+		}
+		return true
+	})
+	now := time.Now()
+	p.heartbeats.Range(func(k, v any) bool {
+		var m dto.Metric
+		if v.(*heartbeat).metric(p.expiration, now).Write(&m) == nil {
+			res[k.(string)] = m.GetGauge().GetValue()
+		}
+		return true
+	})
+	return res
+}
+
+// suffixHash adds the suffix to the metric name in the hash
+func suffixHash(hash, suffix string) string {
+	name, tags, found := strings.Cut(hash, ";")
+	if !found {
+		return name + suffix
+	}
+	return name + suffix + ";" + tags
+}
+
+// SeriesInfo describes a series held by the sink
+type SeriesInfo struct {
+	Name string
+	// Type of the series: gauge|summary|histogram|counter|info
+	Type        string
+	Labels      map[string]string
+	LastUpdated time.Time
+}
+
+// SeriesDescriptors returns the series currently held by the sink,
+// sorted by name, to audit the cardinality.
+func (p *Sink) SeriesDescriptors() []SeriesInfo {
+	var res []SeriesInfo
+	add := func(typ, hash string, updatedAt time.Time, m prometheus.Metric) {
+		var d dto.Metric
+		if m.Write(&d) != nil {
+			return
+		}
+		name, _, _ := strings.Cut(hash, ";")
+		labels := make(map[string]string, len(d.GetLabel()))
+		for _, lp := range d.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		res = append(res, SeriesInfo{
+			Name:        name,
+			Type:        typ,
+			Labels:      labels,
+			LastUpdated: updatedAt,
+		})
+	}
+
+	p.gauges.Range(func(k, v any) bool {
+		if v != nil {
+			localGauge := *v.(*gauge)
+			add("gauge", k.(string), localGauge.lastUpdated(), localGauge)
+		}
+		return true
+	})
+	p.summaries.Range(func(k, v any) bool {
+		if v != nil {
+			localSummary := *v.(*summary)
+			add("summary", k.(string), localSummary.updatedAt, localSummary)
+		}
+		return true
+	})
+	p.histograms.Range(func(k, v any) bool {
+		if v != nil {
+			localHistogram := *v.(*histogram)
+			add("histogram", k.(string), localHistogram.updatedAt, localHistogram)
+		}
+		return true
+	})
+	p.counters.Range(func(k, v any) bool {
+		if v != nil {
+			localCounter := *v.(*counter)
+			add("counter", k.(string), localCounter.updatedAt, localCounter)
+		}
+		return true
+	})
+	p.infos.Range(func(k, v any) bool {
+		if v != nil {
+			add("info", k.(string), time.Time{}, v.(*info))
+		}
+		return true
+	})
+	// heartbeats are exposed as gauges, updated by the last beat
+	now := time.Now()
+	p.heartbeats.Range(func(k, v any) bool {
+		hb := v.(*heartbeat)
+		add("gauge", k.(string), hb.lastUpdated(), hb.metric(p.expiration, now))
+		return true
+	})
+
+	slices.SortStableFunc(res, func(a, b SeriesInfo) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Type, b.Type)
+	})
+	return res
+}
+
+// DefaultDumpFileMode is the mode of the file written by DumpToFile,
+// readable by other users, for example node_exporter
+const DefaultDumpFileMode os.FileMode = 0644
+
+// DumpToFile writes the current metrics of the sink in Prometheus text format to the file.
+// The file is written atomically, to be used for crash diagnostics on shutdown.
+func (p *Sink) DumpToFile(path string) error {
+	return p.DumpToFileMode(path, DefaultDumpFileMode)
+}
+
+// DumpToFileMode writes the metrics as DumpToFile does, with the file mode
+func (p *Sink) DumpToFileMode(path string, mode os.FileMode) error {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(p); err != nil {
+		return errors.WithStack(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+
+	// CreateTemp creates the file with 0600
+	if err = f.Chmod(mode); err != nil {
+		_ = f.Close()
+		return errors.WithStack(err)
+	}
+	for _, mf := range families {
+		if _, err = expfmt.MetricFamilyToText(f, mf); err != nil {
+			_ = f.Close()
+			return errors.WithStack(err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), path))
+}
+
 // PushSink wraps a normal prometheus sink and provides an address and facilities to export it to an address
 // on an interval.
 type PushSink struct {
 	*Sink
-	pusher       *push.Pusher
-	address      string
-	pushInterval time.Duration
-	stopChan     chan struct{}
+	pusher         pusher
+	address        string
+	pushInterval   time.Duration
+	stopChan       chan struct{}
+	resetSummaries bool
+	deleteOnStop   bool
+}
+
+// pusher is implemented by push.Pusher
+type pusher interface {
+	Push() error
+	Delete() error
+}
+
+// PushOpts is used to configure the Prometheus PushSink
+type PushOpts struct {
+	// Address of the Pushgateway
+	Address string
+	// PushInterval is the interval to push metrics
+	PushInterval time.Duration
+	// Name is the job name
+	Name string
+	// ResetSummariesOnPush specifies to reset the ephemeral summaries after each
+	// successful push, so each push reflects only the observations since the previous one.
+	// Gauges, counters and pre-declared metrics are not changed.
+	ResetSummariesOnPush bool
+	// Grouping labels of the pushed metrics, in addition to the job name,
+	// for example instance, to not overwrite the metrics of other instances
+	Grouping map[string]string
+	// DeleteOnShutdown specifies to delete the metrics of the job and grouping labels
+	// from the Pushgateway on Shutdown, instead of the final push
+	DeleteOnShutdown bool
+	// DisableCreatedTimestamp removes the created timestamp of the pushed counters and summaries,
+	// see Opts.DisableCreatedTimestamp
+	DisableCreatedTimestamp bool
 }
 
 // NewPushSink creates a PrometheusPushSink by taking an address, interval, and destination name.
 func NewPushSink(address string, pushInterval time.Duration, name string) (*PushSink, error) {
-	promSink := &Sink{
-		gauges:     sync.Map{},
-		summaries:  sync.Map{},
-		counters:   sync.Map{},
-		expiration: 60 * time.Second,
-		name:       "default_prometheus_sink",
-	}
+	return NewPushSinkFrom(PushOpts{
+		Address:      address,
+		PushInterval: pushInterval,
+		Name:         name,
+	})
+}
+
+// NewPushSinkFrom creates a PrometheusPushSink using the passed options.
+func NewPushSinkFrom(opts PushOpts) (*PushSink, error) {
+	promSink := newSink(Opts{
+		Expiration:              60 * time.Second,
+		DisableCreatedTimestamp: opts.DisableCreatedTimestamp,
+	})
 
-	pusher := push.New(address, name).Collector(promSink)
+	pusher := push.New(opts.Address, opts.Name).Collector(promSink)
+	for name, value := range opts.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
 
 	sink := &PushSink{
-		promSink,
-		pusher,
-		address,
-		pushInterval,
-		make(chan struct{}),
+		Sink:           promSink,
+		pusher:         pusher,
+		address:        opts.Address,
+		pushInterval:   opts.PushInterval,
+		stopChan:       make(chan struct{}),
+		resetSummaries: opts.ResetSummariesOnPush,
+		deleteOnStop:   opts.DeleteOnShutdown,
 	}
 
 	sink.flushMetrics()
@@ -444,7 +1341,7 @@ func (s *PushSink) flushMetrics() {
 		for {
 			select {
 			case <-ticker.C:
-				err := s.pusher.Push()
+				err := s.push()
 				if err != nil {
 					log.Printf("[ERR] Error pushing to Prometheus! Err: %s", err)
 				}
@@ -456,9 +1353,30 @@ func (s *PushSink) flushMetrics() {
 	}()
 }
 
+// push metrics, and reset the summaries if configured
+func (s *PushSink) push() error {
+	err := s.pusher.Push()
+	if err == nil && s.resetSummaries {
+		s.Sink.summaries.Range(func(k, v any) bool {
+			if v != nil && v.(*summary).canDelete {
+				s.Sink.summaries.Delete(k)
+			}
+			return true
+		})
+	}
+	return err
+}
+
 // Shutdown tears down the PrometheusPushSink, and blocks while flushing metrics to the backend.
+// If DeleteOnShutdown is set, the metrics are deleted from the Pushgateway instead.
 func (s *PushSink) Shutdown() {
 	close(s.stopChan)
+	if s.deleteOnStop {
+		if err := s.pusher.Delete(); err != nil {
+			logger.KV(xlog.ERROR, "reason", "delete", "err", err)
+		}
+		return
+	}
 	// Closing the channel only stops the running goroutine that pushes metrics.
 	// To minimize the chance of data loss pusher.Push is called one last time.
 	_ = s.pusher.Push()
@@ -3,13 +3,18 @@ package prometheus_test
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
 	"github.com/effective-security/metrics/prometheus"
 	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -86,3 +91,484 @@ func Test_SetProviderPrometheus(t *testing.T) {
 	ok := reg.Unregister(d)
 	assert.True(t, ok)
 }
+
+func Test_DumpToFile(t *testing.T) {
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+	})
+	require.NoError(t, err)
+
+	d.SetGauge("test_dump_gauge", 42, []metrics.Tag{{Name: "tag1", Value: "val1"}})
+	d.IncrCounter("test_dump_counter", 1, nil)
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	require.NoError(t, d.DumpToFile(path))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	body := string(b)
+	assert.Contains(t, body, `test_dump_gauge{tag1="val1"} 42`)
+	assert.Contains(t, body, "# TYPE test_dump_counter counter")
+	assert.Contains(t, body, "test_dump_counter 1")
+
+	err = d.DumpToFile(filepath.Join(t.TempDir(), "notfound", "metrics.prom"))
+	assert.Error(t, err)
+}
+
+func Test_CreatedTimestamp(t *testing.T) {
+	// scrape returns the OpenMetrics exposition with the `_created` lines
+	scrape := func(disabled bool) string {
+		reg := prom.NewRegistry()
+		d, err := prometheus.NewSinkFrom(prometheus.Opts{
+			Expiration:              time.Minute,
+			Registerer:              reg,
+			DisableCreatedTimestamp: disabled,
+		})
+		require.NoError(t, err)
+		d.IncrCounter("test_requests_total", 1, nil)
+		d.AddSample("test_latency", 1, nil)
+
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		var b strings.Builder
+		enc := expfmt.NewEncoder(&b, expfmt.NewFormat(expfmt.TypeOpenMetrics), expfmt.WithCreatedLines())
+		for _, mf := range mfs {
+			require.NoError(t, enc.Encode(mf))
+		}
+		return b.String()
+	}
+
+	out := scrape(false)
+	assert.Contains(t, out, "test_requests_total 1.0\n")
+	assert.Contains(t, out, "test_requests_created ")
+	assert.Contains(t, out, "test_latency_created ")
+
+	out = scrape(true)
+	assert.Contains(t, out, "test_requests_total 1.0\n")
+	assert.NotContains(t, out, "_created")
+}
+
+func Test_Snapshot(t *testing.T) {
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+	})
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	d.SetGauge("test_snapshot_gauge", 1, tags)
+	d.SetGauge("test_snapshot_gauge", 42, tags)
+	d.IncrCounter("test_snapshot_counter", 1, nil)
+	d.IncrCounter("test_snapshot_counter", 2, nil)
+	d.AddSample("test_snapshot_sample", 10, tags)
+	d.AddSample("test_snapshot_sample", 20, tags)
+	d.RegisterHeartbeat("test_snapshot", nil)
+	d.Beat("test_snapshot_beat", tags)
+
+	assert.Equal(t, map[string]float64{
+		"test_snapshot_gauge;tag1=val1":        42,
+		"test_snapshot_counter":                3,
+		"test_snapshot_sample_sum;tag1=val1":   30,
+		"test_snapshot_sample_count;tag1=val1": 2,
+		"test_snapshot_up":                     0,
+		"test_snapshot_beat_up;tag1=val1":      1,
+	}, d.Snapshot())
+}
+
+func Test_LabelValueNormalizer(t *testing.T) {
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+		LabelValueNormalizer: func(_, value string) string {
+			return strings.ToLower(strings.TrimSpace(value))
+		},
+	})
+	require.NoError(t, err)
+
+	d.IncrCounter("test_normalized_counter", 1, []metrics.Tag{{Name: "Value", Value: "Foo"}})
+	d.IncrCounter("test_normalized_counter", 1, []metrics.Tag{{Name: "Value", Value: " foo"}})
+
+	assert.Equal(t, map[string]float64{
+		"test_normalized_counter;Value=foo": 2,
+	}, d.Snapshot())
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	require.NoError(t, d.DumpToFile(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `test_normalized_counter{Value="foo"} 2`)
+}
+
+func Test_SinkConformance(t *testing.T) {
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+	})
+	require.NoError(t, err)
+	metricstest.SinkConformanceWithReader(t, d, func(hash string) (float64, bool) {
+		val, ok := d.Snapshot()[hash]
+		return val, ok
+	})
+}
+
+func Test_EmitInternalMetrics(t *testing.T) {
+	reg := prom.NewRegistry()
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Name:                "test_internal_sink",
+		Expiration:          time.Minute,
+		Registerer:          reg,
+		EmitInternalMetrics: true,
+	})
+	require.NoError(t, err)
+
+	d.SetGauge("test_internal_gauge", 1, nil)
+	d.SetGauge("test_internal_gauge", 2, []metrics.Tag{{Name: "tag1", Value: "val1"}})
+	d.IncrCounter("test_internal_counter", 1, nil)
+	d.AddSample("test_internal_sample", 1, nil)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "type" {
+					name += ";" + l.GetValue()
+				}
+				if l.GetName() == "sink" {
+					assert.Equal(t, "test_internal_sink", l.GetValue())
+				}
+			}
+			values[name] = m.GetGauge().GetValue()
+		}
+	}
+
+	assert.Equal(t, float64(2), values["prometheus_sink_series_count;gauge"])
+	assert.Equal(t, float64(1), values["prometheus_sink_series_count;summary"])
+	assert.Equal(t, float64(1), values["prometheus_sink_series_count;counter"])
+	assert.Equal(t, float64(0), values["prometheus_sink_series_count;info"])
+	assert.Contains(t, values, "prometheus_sink_collect_duration_seconds")
+	assert.GreaterOrEqual(t, values["prometheus_sink_collect_duration_seconds"], float64(0))
+	assert.Less(t, values["prometheus_sink_collect_duration_seconds"], float64(1))
+
+	// disabled by default
+	d, err = prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+	})
+	require.NoError(t, err)
+	ch := make(chan prom.Metric, 10)
+	d.Collect(ch)
+	close(ch)
+	assert.Empty(t, ch)
+}
+
+func Test_RegisterConstMetricFunc(t *testing.T) {
+	reg := prom.NewRegistry()
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: reg,
+	})
+	require.NoError(t, err)
+
+	size := 10.0
+	desc := prom.NewDesc("test_cache_size", "Size of the cache", []string{"cache"}, nil)
+	d.RegisterConstMetricFunc(desc, prom.GaugeValue, func() (float64, []string) {
+		return size, []string{"users"}
+	})
+
+	scrape := func() string {
+		r, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	assert.Contains(t, scrape(), `test_cache_size{cache="users"} 10`)
+	size = 42
+	assert.Contains(t, scrape(), `test_cache_size{cache="users"} 42`)
+
+	// the wrong number of label values is reported by Gather
+	invalid := prom.NewDesc("test_invalid_size", "Invalid metric", []string{"cache"}, nil)
+	d.RegisterConstMetricFunc(invalid, prom.GaugeValue, func() (float64, []string) {
+		return 1, nil
+	})
+	_, err = reg.Gather()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test_invalid_size")
+}
+
+func Test_DuplicateDefinitions(t *testing.T) {
+	_, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Registerer: prom.NewRegistry(),
+		GaugeDefinitions: []prometheus.GaugeDefinition{
+			{Name: "test_dup_gauge", Help: "first"},
+			{Name: "test.dup.gauge", Help: "second"},
+		},
+	})
+	assert.EqualError(t, err, `duplicate metric definition: gauge "test_dup_gauge" is already declared as gauge`)
+
+	_, err = prometheus.NewSinkFrom(prometheus.Opts{
+		Registerer: prom.NewRegistry(),
+		GaugeDefinitions: []prometheus.GaugeDefinition{
+			{Name: "test_dup", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val1"}}},
+		},
+		CounterDefinitions: []prometheus.CounterDefinition{
+			{Name: "test_dup", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val1"}}},
+		},
+	})
+	assert.EqualError(t, err, `duplicate metric definition: counter "test_dup;tag1=val1" is already declared as gauge`)
+
+	// same name with different labels is allowed
+	_, err = prometheus.NewSinkFrom(prometheus.Opts{
+		Registerer: prom.NewRegistry(),
+		GaugeDefinitions: []prometheus.GaugeDefinition{
+			{Name: "test_dup", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val1"}}},
+			{Name: "test_dup", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val2"}}},
+		},
+	})
+	assert.NoError(t, err)
+}
+
+func Test_InitCounter(t *testing.T) {
+	reg := prom.NewRegistry()
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: reg,
+	})
+	require.NoError(t, err)
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, d)
+	require.NoError(t, err)
+
+	scrape := func() string {
+		r, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	prov.InitCounter("test_errors", metrics.Tag{Name: "code", Value: "500"})
+	assert.Contains(t, scrape(), `test_errors{code="500"} 0`)
+
+	prov.IncrCounter("test_errors", 2, metrics.Tag{Name: "code", Value: "500"})
+	// the existing counter is not reset
+	prov.InitCounter("test_errors", metrics.Tag{Name: "code", Value: "500"})
+	assert.Contains(t, scrape(), `test_errors{code="500"} 2`)
+
+	// the counter is not expired
+	ch := make(chan prom.Metric, 10)
+	d.Collect(ch)
+	close(ch)
+	assert.Len(t, ch, 1)
+}
+
+func Test_ValidateOpts(t *testing.T) {
+	err := prometheus.ValidateOpts(prometheus.Opts{
+		GaugeDefinitions: []prometheus.GaugeDefinition{
+			{Name: "test_valid", Help: "valid"},
+			{Name: "1test_gauge", Help: "invalid name"},
+			{Name: "test_labeled", Help: "labeled", ConstTags: []metrics.Tag{{Name: "bad-tag", Value: "val"}}},
+			{Name: "test_valid", Help: "again"},
+		},
+		SummaryDefinitions: []prometheus.SummaryDefinition{
+			{Name: "test_summary"},
+		},
+		CounterDefinitions: []prometheus.CounterDefinition{
+			{Name: "test_valid", Help: "counter", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val1"}}},
+			{Name: "test_help", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val1"}}},
+		},
+		Help: map[string]string{
+			"test_help": "help from opts",
+		},
+	})
+	assert.EqualError(t, err, `invalid metric definitions: `+
+		`gauge "1test_gauge": invalid name; `+
+		`gauge "test_labeled": invalid tag name "bad-tag"; `+
+		`gauge "test_valid": duplicate definition; `+
+		`summary "test_summary": empty help; `+
+		`counter "test_valid": already declared as gauge`)
+
+	valid := prometheus.Opts{
+		Registerer: prom.NewRegistry(),
+		GaugeDefinitions: []prometheus.GaugeDefinition{
+			{Name: "test.gauge", Help: "gauge", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val1"}}},
+			{Name: "test.gauge", Help: "gauge", ConstTags: []metrics.Tag{{Name: "tag1", Value: "val2"}}},
+		},
+		ValidateDefinitions: true,
+	}
+	assert.NoError(t, prometheus.ValidateOpts(valid))
+	_, err = prometheus.NewSinkFrom(valid)
+	assert.NoError(t, err)
+
+	// the sink is not created with invalid definitions
+	_, err = prometheus.NewSinkFrom(prometheus.Opts{
+		Registerer: prom.NewRegistry(),
+		GaugeDefinitions: []prometheus.GaugeDefinition{
+			{Name: "test_gauge"},
+		},
+		ValidateDefinitions: true,
+	})
+	assert.EqualError(t, err, `invalid metric definitions: gauge "test_gauge": empty help`)
+}
+
+func Test_ObjectivesByPattern(t *testing.T) {
+	_, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Registerer: prom.NewRegistry(),
+		ObjectivesByPattern: []prometheus.ObjectivesPattern{
+			{Pattern: "[", Objectives: map[float64]float64{0.99: 0.001}},
+		},
+	})
+	assert.EqualError(t, err, `invalid objectives pattern: "[": syntax error in pattern`)
+
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+		ObjectivesByPattern: []prometheus.ObjectivesPattern{
+			{Pattern: "slow_*", Objectives: map[float64]float64{0.99: 0.001}},
+			{Pattern: "*", Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01}},
+		},
+	})
+	require.NoError(t, err)
+
+	d.AddSample("slow_path_latency", 1, nil)
+	d.AddSample("fast_path_latency", 1, nil)
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	require.NoError(t, d.DumpToFile(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	body := string(b)
+
+	assert.Contains(t, body, `slow_path_latency{quantile="0.99"} 1`)
+	assert.NotContains(t, body, `slow_path_latency{quantile="0.5"}`)
+	assert.Contains(t, body, `fast_path_latency{quantile="0.5"} 1`)
+	assert.Contains(t, body, `fast_path_latency{quantile="0.9"} 1`)
+	assert.NotContains(t, body, `fast_path_latency{quantile="0.99"}`)
+}
+
+func Test_ShadowHistogram(t *testing.T) {
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration:            time.Minute,
+		Registerer:            prom.NewRegistry(),
+		ShadowHistogramSuffix: "_hist",
+	})
+	require.NoError(t, err)
+
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+	d.AddSample("test_latency", 0.3, tags)
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	require.NoError(t, d.DumpToFile(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	body := string(b)
+
+	assert.Contains(t, body, "# TYPE test_latency summary")
+	assert.Contains(t, body, `test_latency{tag1="val1",quantile="0.5"} 0.3`)
+	assert.Contains(t, body, "# TYPE test_latency_hist histogram")
+	assert.Contains(t, body, `test_latency_hist_bucket{tag1="val1",le="0.25"} 0`)
+	assert.Contains(t, body, `test_latency_hist_bucket{tag1="val1",le="0.5"} 1`)
+
+	assert.Equal(t, map[string]float64{
+		"test_latency_sum;tag1=val1":        0.3,
+		"test_latency_count;tag1=val1":      1,
+		"test_latency_hist_sum;tag1=val1":   0.3,
+		"test_latency_hist_count;tag1=val1": 1,
+	}, d.Snapshot())
+}
+
+func Test_SeriesDescriptors(t *testing.T) {
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Expiration: time.Minute,
+		Registerer: prom.NewRegistry(),
+	})
+	require.NoError(t, err)
+
+	started := time.Now()
+	d.SetGauge("test_gauge", 1, []metrics.Tag{{Name: "host", Value: "h1"}})
+	d.IncrCounter("test_counter", 1, []metrics.Tag{{Name: "method", Value: "get"}})
+	d.IncrCounter("test_counter", 1, []metrics.Tag{{Name: "method", Value: "put"}})
+	d.AddSample("test_sample", 1, nil)
+	d.SetInfo("test_info", []metrics.Tag{{Name: "version", Value: "1.0"}})
+	d.Beat("test", []metrics.Tag{{Name: "source", Value: "db"}})
+
+	series := d.SeriesDescriptors()
+	require.Len(t, series, 6)
+
+	assert.Equal(t, "test_counter", series[0].Name)
+	assert.Equal(t, "counter", series[0].Type)
+	assert.Equal(t, "test_counter", series[1].Name)
+	assert.ElementsMatch(t,
+		[]map[string]string{{"method": "get"}, {"method": "put"}},
+		[]map[string]string{series[0].Labels, series[1].Labels},
+	)
+
+	assert.Equal(t, "test_gauge", series[2].Name)
+	assert.Equal(t, "gauge", series[2].Type)
+	assert.Equal(t, map[string]string{"host": "h1"}, series[2].Labels)
+	assert.False(t, series[2].LastUpdated.Before(started))
+
+	assert.Equal(t, "test_info", series[3].Name)
+	assert.Equal(t, "info", series[3].Type)
+	assert.Equal(t, map[string]string{"version": "1.0"}, series[3].Labels)
+
+	assert.Equal(t, "test_sample", series[4].Name)
+	assert.Equal(t, "summary", series[4].Type)
+	assert.Empty(t, series[4].Labels)
+	assert.Equal(t, "test_up", series[5].Name)
+	assert.Equal(t, "gauge", series[5].Type)
+	assert.Equal(t, map[string]string{"source": "db"}, series[5].Labels)
+	assert.False(t, series[5].LastUpdated.Before(started))
+}
+
+func Test_AppendUnitSuffix(t *testing.T) {
+	descs := []*metrics.Describe{
+		{Type: metrics.TypeTimer, Name: "request_duration", Help: "request duration", Unit: "seconds"},
+		{Type: metrics.TypeGauge, Name: "heap_bytes", Help: "heap size", Unit: "bytes"},
+		{Type: metrics.TypeCounter, Name: "sent_total", Help: "sent bytes", Unit: "bytes"},
+		{Type: metrics.TypeGauge, Name: "queue_size", Help: "queue size"},
+		{Type: metrics.TypeGauge, Name: "cache_limit", Help: "cache limit", Unit: "bytes"},
+		{Type: metrics.TypeGauge, Name: "worker_up", Help: "worker is up", Unit: "ratio"},
+	}
+	cfg := &metrics.Config{FilterDefault: true}
+
+	reg := prom.NewRegistry()
+	d, err := prometheus.NewSinkFrom(prometheus.Opts{
+		Registerer:       reg,
+		AppendUnitSuffix: true,
+		Help:             cfg.Help(descs),
+		Units:            cfg.Units(descs),
+	})
+	require.NoError(t, err)
+	prov, err := metrics.New(cfg, d)
+	require.NoError(t, err)
+
+	prov.MeasureSince("request_duration", time.Now())
+	prov.SetGauge("heap_bytes", 1024)
+	prov.IncrCounter("sent_total", 10)
+	prov.SetGauge("queue_size", 3)
+	d.SetInfo("cache_limit", []metrics.Tag{{Name: "policy", Value: "lru"}})
+	d.Beat("worker", nil)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	var names []string
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	assert.ElementsMatch(t, []string{
+		"request_duration_seconds",
+		"heap_bytes",
+		"sent_bytes_total",
+		"queue_size",
+		"cache_limit_bytes",
+		"worker_up_ratio",
+	}, names)
+}
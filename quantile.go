@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+// DefaultQuantileCompression is the default compression of the quantile sketch,
+// larger values give more accurate quantiles with more memory
+const DefaultQuantileCompression = 100
+
+// quantileSketch is a merging t-digest, that keeps a bounded number of centroids
+// to estimate the quantiles of the samples
+type quantileSketch struct {
+	lock        sync.Mutex
+	compression float64
+	centroids   []centroid // sorted by mean
+	buffer      []centroid
+	count       float64
+	min         float64
+	max         float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+func newQuantileSketch(compression float64) *quantileSketch {
+	if compression <= 0 {
+		compression = DefaultQuantileCompression
+	}
+	return &quantileSketch{
+		compression: compression,
+		buffer:      make([]centroid, 0, 5*int(compression)),
+	}
+}
+
+// add adds the value observed weight times
+func (s *quantileSketch) add(v float64, weight int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count += float64(weight)
+	s.buffer = append(s.buffer, centroid{mean: v, weight: float64(weight)})
+	if len(s.buffer) == cap(s.buffer) {
+		s.compress()
+	}
+}
+
+// compress merges the buffer into the centroids,
+// the size of a centroid is limited by the k1 scale function
+func (s *quantileSketch) compress() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	all := append(s.centroids, s.buffer...)
+	slices.SortFunc(all, func(a, b centroid) int {
+		if a.mean < b.mean {
+			return -1
+		}
+		if a.mean > b.mean {
+			return 1
+		}
+		return 0
+	})
+
+	merged := make([]centroid, 0, len(s.centroids)+1)
+	cur := all[0]
+	sofar := float64(0)
+	kLeft := s.scale(0)
+	for _, next := range all[1:] {
+		proposed := cur.weight + next.weight
+		if s.scale((sofar+proposed)/s.count)-kLeft <= 1 {
+			cur.mean += (next.mean - cur.mean) * next.weight / proposed
+			cur.weight = proposed
+			continue
+		}
+		merged = append(merged, cur)
+		sofar += cur.weight
+		kLeft = s.scale(sofar / s.count)
+		cur = next
+	}
+	s.centroids = append(merged, cur)
+	s.buffer = s.buffer[:0]
+}
+
+// scale is the k1 scale function of t-digest, a centroid spans up to 1 unit of k,
+// so the number of centroids is bounded by the compression
+func (s *quantileSketch) scale(q float64) float64 {
+	return s.compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+}
+
+// quantile returns the estimated value at the quantile q in [0, 1],
+// or NaN if there are no values
+func (s *quantileSketch) quantile(q float64) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.count == 0 {
+		return math.NaN()
+	}
+	s.compress()
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+
+	// interpolate between the centers of the centroids
+	target := q * s.count
+	prevCenter, prevMean := float64(0), s.min
+	sofar := float64(0)
+	for _, c := range s.centroids {
+		center := sofar + c.weight/2
+		if target < center {
+			return prevMean + (c.mean-prevMean)*(target-prevCenter)/(center-prevCenter)
+		}
+		prevCenter, prevMean = center, c.mean
+		sofar += c.weight
+	}
+	if s.count == prevCenter {
+		return s.max
+	}
+	return prevMean + (s.max-prevMean)*(target-prevCenter)/(s.count-prevCenter)
+}
@@ -0,0 +1,60 @@
+package metrics
+
+// Route pairs the predicate with the sink
+type Route struct {
+	// Match returns true if the metric should be sent to the Sink,
+	// if nil, then all metrics are sent
+	Match func(key string, tags []Tag) bool
+	Sink  Sink
+}
+
+// RoutingSink sends the values to every sink with the matching route
+type RoutingSink []Route
+
+// NewRoutingSink creates routing sink
+func NewRoutingSink(routes []Route) RoutingSink {
+	return RoutingSink(routes)
+}
+
+// MatchTag returns the predicate for Route that matches the metrics with the tag
+func MatchTag(name, value string) func(key string, tags []Tag) bool {
+	return func(_ string, tags []Tag) bool {
+		for _, t := range tags {
+			if t.Name == name && t.Value == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SetGauge should retain the last value it is set to
+func (rs RoutingSink) SetGauge(key string, val float64, tags []Tag) {
+	for _, r := range rs {
+		if r.matches(key, tags) {
+			r.Sink.SetGauge(key, val, tags)
+		}
+	}
+}
+
+// IncrCounter should accumulate values
+func (rs RoutingSink) IncrCounter(key string, val float64, tags []Tag) {
+	for _, r := range rs {
+		if r.matches(key, tags) {
+			r.Sink.IncrCounter(key, val, tags)
+		}
+	}
+}
+
+// AddSample is for timing information, where quantiles are used
+func (rs RoutingSink) AddSample(key string, val float64, tags []Tag) {
+	for _, r := range rs {
+		if r.matches(key, tags) {
+			r.Sink.AddSample(key, val, tags)
+		}
+	}
+}
+
+func (r *Route) matches(key string, tags []Tag) bool {
+	return r.Match == nil || r.Match(key, tags)
+}
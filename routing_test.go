@@ -0,0 +1,41 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+)
+
+func Test_RoutingSink(t *testing.T) {
+	critical := metricstest.NewOrderedRecorder()
+	all := metricstest.NewOrderedRecorder()
+	auth := metricstest.NewOrderedRecorder()
+
+	rs := metrics.NewRoutingSink([]metrics.Route{
+		{Match: metrics.MatchTag("tier", "critical"), Sink: critical},
+		{Sink: all},
+		{
+			Match: func(key string, _ []metrics.Tag) bool { return strings.HasPrefix(key, "auth_") },
+			Sink:  auth,
+		},
+	})
+
+	tags := []metrics.Tag{{Name: "tier", Value: "critical"}}
+	rs.IncrCounter("auth_failures", 1, tags)
+	rs.SetGauge("queue_depth", 2, nil)
+	rs.AddSample("latency", 3, []metrics.Tag{{Name: "tier", Value: "batch"}})
+
+	critical.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "auth_failures", Value: 1, Tags: tags},
+	)
+	all.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "auth_failures", Value: 1, Tags: tags},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "queue_depth", Value: 2},
+		metricstest.RecordedCall{Type: metrics.TypeSample, Key: "latency", Value: 3, Tags: []metrics.Tag{{Name: "tier", Value: "batch"}}},
+	)
+	auth.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "auth_failures", Value: 1, Tags: tags},
+	)
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/effective-security/xlog"
+)
+
+// FanoutErrorsMetric is the counter emitted to the meta sink of SafeFanoutSink
+// on each failed emission, labeled by the sink name
+const FanoutErrorsMetric = "metrics_fanout_errors_total"
+
+// NamedSink is a sink with the name used in the `sink` label of FanoutErrorsMetric
+type NamedSink struct {
+	Name string
+	Sink Sink
+}
+
+// SafeFanoutSink sends the values to multiple sinks, as FanoutSink does,
+// but recovers a panic of a sink, so a failing sink does not stop the emission to the others.
+type SafeFanoutSink struct {
+	sinks  []NamedSink
+	meta   Sink
+	errors atomic.Uint64
+}
+
+// NewSafeFanoutSink creates fan-out sink that recovers the failures of the sinks.
+// If meta is not nil, then `metrics_fanout_errors_total{sink="<name>"}` is emitted to it
+// on each failure. The sinks without a name are named by the index.
+func NewSafeFanoutSink(meta Sink, sinks ...NamedSink) *SafeFanoutSink {
+	named := make([]NamedSink, len(sinks))
+	for i, s := range sinks {
+		if s.Name == "" {
+			s.Name = strconv.Itoa(i)
+		}
+		named[i] = s
+	}
+	return &SafeFanoutSink{
+		sinks: named,
+		meta:  meta,
+	}
+}
+
+// SetGauge should retain the last value it is set to
+func (fh *SafeFanoutSink) SetGauge(key string, val float64, tags []Tag) {
+	fh.emit(func(s Sink) {
+		s.SetGauge(key, val, tags)
+	})
+}
+
+// IncrCounter should accumulate values
+func (fh *SafeFanoutSink) IncrCounter(key string, val float64, tags []Tag) {
+	fh.emit(func(s Sink) {
+		s.IncrCounter(key, val, tags)
+	})
+}
+
+// AddSample is for timing information, where quantiles are used
+func (fh *SafeFanoutSink) AddSample(key string, val float64, tags []Tag) {
+	fh.emit(func(s Sink) {
+		s.AddSample(key, val, tags)
+	})
+}
+
+// Errors returns the number of the failed emissions
+func (fh *SafeFanoutSink) Errors() uint64 {
+	return fh.errors.Load()
+}
+
+// emit calls fn for each sink
+func (fh *SafeFanoutSink) emit(fn func(Sink)) {
+	for i := range fh.sinks {
+		fh.call(&fh.sinks[i], fn)
+	}
+}
+
+// call calls fn for the sink, and reports the failure if it panics
+func (fh *SafeFanoutSink) call(s *NamedSink, fn func(Sink)) {
+	defer func() {
+		if r := recover(); r != nil {
+			fh.errors.Add(1)
+			logger.KV(xlog.ERROR, "reason", "sink_failed", "sink", s.Name, "err", r)
+			if fh.meta != nil {
+				fh.meta.IncrCounter(FanoutErrorsMetric, 1, []Tag{{Name: "sink", Value: s.Name}})
+			}
+		}
+	}()
+	fn(s.Sink)
+}
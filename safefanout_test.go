@@ -0,0 +1,47 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// panicSink panics on each emission
+type panicSink struct {
+	metrics.BlackholeSink
+}
+
+func (*panicSink) IncrCounter(key string, val float64, tags []metrics.Tag) {
+	panic("broken sink")
+}
+
+func Test_SafeFanoutSink(t *testing.T) {
+	meta := metricstest.NewOrderedRecorder()
+	rec := metricstest.NewOrderedRecorder()
+	fs := metrics.NewSafeFanoutSink(meta,
+		metrics.NamedSink{Name: "broken", Sink: &panicSink{}},
+		metrics.NamedSink{Sink: rec},
+		metrics.NamedSink{Sink: &panicSink{}},
+	)
+
+	fs.IncrCounter("test_counter", 1, nil)
+	fs.IncrCounter("test_counter", 2, nil)
+	fs.SetGauge("test_gauge", 3, nil)
+
+	// the healthy sink receives all emissions
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "test_counter", Value: 1},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "test_counter", Value: 2},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "test_gauge", Value: 3},
+	)
+	meta.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: metrics.FanoutErrorsMetric, Value: 1, Tags: []metrics.Tag{{Name: "sink", Value: "broken"}}},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: metrics.FanoutErrorsMetric, Value: 1, Tags: []metrics.Tag{{Name: "sink", Value: "2"}}},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: metrics.FanoutErrorsMetric, Value: 1, Tags: []metrics.Tag{{Name: "sink", Value: "broken"}}},
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: metrics.FanoutErrorsMetric, Value: 1, Tags: []metrics.Tag{{Name: "sink", Value: "2"}}},
+	)
+	assert.Len(t, meta.Calls(), 4)
+	assert.Equal(t, uint64(4), fs.Errors())
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxSampleGaugeSeries is the max number of the series aggregated by SampleAsGaugeSink,
+// over the limit the samples of the new series are not aggregated
+const maxSampleGaugeSeries = 10000
+
+// SampleAsGaugeSink wraps a Sink and translates AddSample into gauges.
+// It is used for backends that prefer gauges over summaries:
+// each sample updates `<key>_min`, `<key>_max` and `<key>_mean` gauges,
+// aggregated per key and tags over the flush interval.
+type SampleAsGaugeSink struct {
+	inner    Sink
+	interval time.Duration
+
+	lock    sync.Mutex
+	samples map[string]*sampleWindow
+}
+
+type sampleWindow struct {
+	start time.Time
+	agg   AggregateSample
+}
+
+// NewSampleAsGaugeSink creates a sink that emits samples as gauges to inner sink.
+// The min/max/mean values are reset after each interval, and on Flush.
+func NewSampleAsGaugeSink(inner Sink, interval time.Duration) *SampleAsGaugeSink {
+	return &SampleAsGaugeSink{
+		inner:    inner,
+		interval: interval,
+		samples:  make(map[string]*sampleWindow),
+	}
+}
+
+// SetGauge should retain the last value it is set to
+func (s *SampleAsGaugeSink) SetGauge(key string, val float64, tags []Tag) {
+	s.inner.SetGauge(key, val, tags)
+}
+
+// IncrCounter should accumulate values
+func (s *SampleAsGaugeSink) IncrCounter(key string, val float64, tags []Tag) {
+	s.inner.IncrCounter(key, val, tags)
+}
+
+// AddSample is translated into `_min`, `_max` and `_mean` gauges
+func (s *SampleAsGaugeSink) AddSample(key string, val float64, tags []Tag) {
+	_, hash := FlattenKey(key, tags)
+	now := time.Now()
+
+	s.lock.Lock()
+	w, ok := s.samples[hash]
+	if !ok || s.expired(w, now) {
+		w = &sampleWindow{start: now}
+		if ok || len(s.samples) < maxSampleGaugeSeries || s.sweep(now) {
+			s.samples[hash] = w
+		}
+	}
+	w.agg.Ingest(val, 1)
+	minVal, maxVal, mean := w.agg.Min, w.agg.Max, w.agg.Mean()
+	s.lock.Unlock()
+
+	s.inner.SetGauge(key+"_min", minVal, tags)
+	s.inner.SetGauge(key+"_max", maxVal, tags)
+	s.inner.SetGauge(key+"_mean", mean, tags)
+}
+
+// Flush resets the aggregated samples, and flushes the inner sink if it is FlushableSink
+func (s *SampleAsGaugeSink) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	s.samples = make(map[string]*sampleWindow)
+	s.lock.Unlock()
+
+	if fs, ok := s.inner.(FlushableSink); ok {
+		return fs.Flush(ctx)
+	}
+	return nil
+}
+
+// expired returns true if the interval of the window is over
+func (s *SampleAsGaugeSink) expired(w *sampleWindow, now time.Time) bool {
+	return s.interval > 0 && now.Sub(w.start) >= s.interval
+}
+
+// sweep removes the expired windows, and returns true if there is room for a new one.
+// It must be called under the lock.
+func (s *SampleAsGaugeSink) sweep(now time.Time) bool {
+	for hash, w := range s.samples {
+		if s.expired(w, now) {
+			delete(s.samples, hash)
+		}
+	}
+	return len(s.samples) < maxSampleGaugeSeries
+}
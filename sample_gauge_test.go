@@ -0,0 +1,82 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SampleAsGaugeSink(t *testing.T) {
+	mocked := &mockedSink{t: t}
+	tags := []metrics.Tag{{Name: "tag1", Value: "val1"}}
+
+	mocked.On("SetGauge", "test_sample_min", float64(1), tags).Times(2)
+	mocked.On("SetGauge", "test_sample_max", float64(1), tags).Times(1)
+	mocked.On("SetGauge", "test_sample_mean", float64(1), tags).Times(1)
+	mocked.On("SetGauge", "test_sample_max", float64(3), tags).Times(1)
+	mocked.On("SetGauge", "test_sample_mean", float64(2), tags).Times(1)
+	mocked.On("SetGauge", "test_gauge", float64(5), tags).Times(1)
+	mocked.On("IncrCounter", "test_counter", float64(1), tags).Times(1)
+
+	s := metrics.NewSampleAsGaugeSink(mocked, time.Minute)
+	s.AddSample("test_sample", 1, tags)
+	s.AddSample("test_sample", 3, tags)
+	s.SetGauge("test_gauge", 5, tags)
+	s.IncrCounter("test_counter", 1, tags)
+
+	mocked.AssertExpectations(t)
+	mocked.AssertNotCalled(t, "AddSample", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_SampleAsGaugeSink_Interval(t *testing.T) {
+	mocked := &mockedSink{t: t}
+
+	mocked.On("SetGauge", "test_sample_min", float64(5), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_max", float64(5), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_mean", float64(5), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_min", float64(1), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_max", float64(1), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_mean", float64(1), []metrics.Tag(nil)).Times(1)
+
+	s := metrics.NewSampleAsGaugeSink(mocked, 10*time.Millisecond)
+	s.AddSample("test_sample", 5, nil)
+	time.Sleep(20 * time.Millisecond)
+	// new interval, the previous values are discarded
+	s.AddSample("test_sample", 1, nil)
+
+	mocked.AssertExpectations(t)
+}
+
+func Test_SampleAsGaugeSink_Flush(t *testing.T) {
+	mocked := &mockedSink{t: t}
+
+	mocked.On("SetGauge", "test_sample_min", float64(5), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_max", float64(5), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_mean", float64(5), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_min", float64(1), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_max", float64(1), []metrics.Tag(nil)).Times(1)
+	mocked.On("SetGauge", "test_sample_mean", float64(1), []metrics.Tag(nil)).Times(1)
+
+	s := metrics.NewSampleAsGaugeSink(mocked, time.Minute)
+	s.AddSample("test_sample", 5, nil)
+	require.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, 0, metrics.SampleGaugeSeries(s))
+	// the previous values are discarded on flush
+	s.AddSample("test_sample", 1, nil)
+
+	mocked.AssertExpectations(t)
+}
+
+func Test_SampleAsGaugeSink_MaxSeries(t *testing.T) {
+	s := metrics.NewSampleAsGaugeSink(&metrics.BlackholeSink{}, 0)
+	for i := 0; i < 10100; i++ {
+		s.AddSample(fmt.Sprintf("test_sample_%d", i), 1, nil)
+	}
+	assert.Equal(t, 10000, metrics.SampleGaugeSeries(s))
+}
@@ -1,13 +1,14 @@
 package metrics
 
 import (
+	"context"
 	"time"
 )
 
 // Tag is used to add dimentions to metrics
 type Tag struct {
-	Name  string
-	Value string
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
 }
 
 // The Sink interface is used to transmit metrics information
@@ -21,6 +22,70 @@ type Sink interface {
 	AddSample(key string, val float64, tags []Tag)
 }
 
+// ContextSink is an optional interface for sinks that can observe
+// the request context, for example to support cancellation in network sinks.
+// It is used when metrics are emitted via Metrics.WithContext
+type ContextSink interface {
+	// SetGaugeCtx should retain the last value it is set to
+	SetGaugeCtx(ctx context.Context, key string, val float64, tags []Tag)
+	// IncrCounterCtx should accumulate values
+	IncrCounterCtx(ctx context.Context, key string, val float64, tags []Tag)
+	// AddSampleCtx is for timing information, where quantiles are used
+	AddSampleCtx(ctx context.Context, key string, val float64, tags []Tag)
+}
+
+// GaugeDeltaSink is an optional interface for sinks
+// that support relative gauge updates natively
+type GaugeDeltaSink interface {
+	// IncrGauge should adjust the gauge value by delta
+	IncrGauge(key string, delta float64, tags []Tag)
+}
+
+// FlushableSink is a Sink that buffers metrics
+// and sends them to an external system on Flush
+type FlushableSink interface {
+	Sink
+	// Flush sends the buffered metrics
+	Flush(ctx context.Context) error
+}
+
+// WeightedSink is an optional interface for sinks
+// that support weighted samples natively
+type WeightedSink interface {
+	// AddSampleN should add the sample observed n times
+	AddSampleN(key string, val float64, n int, tags []Tag)
+}
+
+// HealthChecker is an optional interface for network sinks,
+// to check if the backend is reachable, for example in readiness probes
+type HealthChecker interface {
+	// HealthCheck returns an error if the backend is not reachable
+	HealthCheck(ctx context.Context) error
+}
+
+// TimestampedSink is an optional interface for sinks
+// that support explicit timestamps, for example to backfill historical values
+type TimestampedSink interface {
+	// SetGaugeAt should retain the value with the provided timestamp
+	SetGaugeAt(key string, val float64, ts time.Time, tags []Tag)
+}
+
+// CounterInitSink is an optional interface for sinks
+// that support pre-declaration of counters, for example Prometheus
+type CounterInitSink interface {
+	// InitCounter should register the counter at 0, if it does not exist
+	InitCounter(key string, tags []Tag)
+}
+
+// CapabilitySink is an optional interface for sinks
+// that support only some of the metric types,
+// the metrics of unsupported types are not emitted to the sink
+type CapabilitySink interface {
+	// Supports returns true if the sink supports the metric type,
+	// one of TypeCounter, TypeSample or TypeGauge
+	Supports(typ string) bool
+}
+
 // Provider basics
 type Provider interface {
 	SetGauge(key string, val float64, tags ...Tag)
@@ -29,6 +94,19 @@ type Provider interface {
 	MeasureSince(key string, start time.Time, tags ...Tag)
 }
 
+var (
+	_ Sink = (*BlackholeSink)(nil)
+	_ Sink = FanoutSink(nil)
+	_ Sink = (*InmemSink)(nil)
+	_ Sink = (*SampleAsGaugeSink)(nil)
+
+	_ FlushableSink   = (*FallbackSink)(nil)
+	_ FlushableSink   = (*SampleAsGaugeSink)(nil)
+	_ HealthChecker   = FanoutSink(nil)
+	_ CounterInitSink = FanoutSink(nil)
+	_ WeightedSink    = (*InmemSink)(nil)
+)
+
 // BlackholeSink is used to just blackhole messages
 type BlackholeSink struct{}
 
@@ -69,3 +147,24 @@ func (fh FanoutSink) AddSample(key string, val float64, tags []Tag) {
 		s.AddSample(key, val, tags)
 	}
 }
+
+// InitCounter registers the counter in the sinks implementing CounterInitSink
+func (fh FanoutSink) InitCounter(key string, tags []Tag) {
+	for _, s := range fh {
+		if is, ok := s.(CounterInitSink); ok {
+			is.InitCounter(key, tags)
+		}
+	}
+}
+
+// HealthCheck returns the first error of the sinks implementing HealthChecker
+func (fh FanoutSink) HealthCheck(ctx context.Context) error {
+	for _, s := range fh {
+		if hc, ok := s.(HealthChecker); ok {
+			if err := hc.HealthCheck(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,8 +3,14 @@ package metrics
 import (
 	"fmt"
 	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
+	"unique"
 
 	"github.com/effective-security/xlog"
 )
@@ -13,29 +19,134 @@ var logger = xlog.NewPackageLogger("github.com/effective-security/metrics", "met
 
 // Config is used to configure metrics settings
 type Config struct {
-	ServiceName          string        // Prefixed with keys to separate services
-	HostName             string        // Hostname to use. If not provided and EnableHostname, it will be os.Hostname
-	EnableHostname       bool          // Enable prefixing gauge values with hostname
-	EnableHostnameLabel  bool          // Enable adding hostname to labels
-	EnableServiceLabel   bool          // Enable adding service to labels
-	EnableRuntimeMetrics bool          // Enables profiling of runtime metrics (GC, Goroutines, Memory)
-	EnableTypePrefix     bool          // Prefixes key with a type ("counter", "gauge", "sample")
-	TimerGranularity     time.Duration // Granularity of timers.
-	ProfileInterval      time.Duration // Interval to profile runtime metrics
-	GlobalTags           []Tag         // Tags to add to every metric
-	GlobalPrefix         string        // Prefix to add to every metric
-
-	AllowedPrefixes []string // A list of the first metric prefixes to allow
-	BlockedPrefixes []string // A list of the first metric prefixes to block
-	FilterDefault   bool     // Whether to allow metrics by default
+	ServiceName          string        `json:"service_name,omitempty" yaml:"service_name,omitempty"`                     // Prefixed with keys to separate services
+	HostName             string        `json:"host_name,omitempty" yaml:"host_name,omitempty"`                           // Hostname to use. If not provided and EnableHostname, it will be os.Hostname
+	EnableHostname       bool          `json:"enable_hostname,omitempty" yaml:"enable_hostname,omitempty"`               // Enable prefixing gauge values with hostname
+	EnableHostnameLabel  bool          `json:"enable_hostname_label,omitempty" yaml:"enable_hostname_label,omitempty"`   // Enable adding hostname to labels
+	EnableServiceLabel   bool          `json:"enable_service_label,omitempty" yaml:"enable_service_label,omitempty"`     // Enable adding service to labels
+	EnableRuntimeMetrics bool          `json:"enable_runtime_metrics,omitempty" yaml:"enable_runtime_metrics,omitempty"` // Enables profiling of runtime metrics (GC, Goroutines, Memory)
+	EnableUptimeMetric   bool          `json:"enable_uptime_metric,omitempty" yaml:"enable_uptime_metric,omitempty"`     // Enables uptime and process start time metrics, with EnableRuntimeMetrics
+	EnableTypePrefix     bool          `json:"enable_type_prefix,omitempty" yaml:"enable_type_prefix,omitempty"`         // Prefixes key with a type ("counter", "gauge", "sample"), see TypePrefixTypes
+	EnableTypeLabel      bool          `json:"enable_type_label,omitempty" yaml:"enable_type_label,omitempty"`           // Enable adding type to labels, takes precedence over EnableTypePrefix
+	TimerGranularity     time.Duration `json:"timer_granularity,omitempty" yaml:"timer_granularity,omitempty"`           // Granularity of timers.
+	ProfileInterval      time.Duration `json:"profile_interval,omitempty" yaml:"profile_interval,omitempty"`             // Interval to profile runtime metrics
+	MaxGCPauseSamples    int           `json:"max_gc_pause_samples,omitempty" yaml:"max_gc_pause_samples,omitempty"`     // Maximum number of the most recent GC pause samples to emit per interval, up to 256
+	GlobalTags           []Tag         `json:"global_tags,omitempty" yaml:"global_tags,omitempty"`                       // Tags to add to every metric
+	GlobalPrefix         string        `json:"global_prefix,omitempty" yaml:"global_prefix,omitempty"`                   // Prefix to add to every metric
+	MaxTagValueLength    int           `json:"max_tag_value_length,omitempty" yaml:"max_tag_value_length,omitempty"`     // Maximum length in bytes of a tag value, longer values are truncated with "..." suffix. 0 means no limit
+	DropLongTagValues    bool          `json:"drop_long_tag_values,omitempty" yaml:"drop_long_tag_values,omitempty"`     // Drop metrics with tag values longer than MaxTagValueLength, instead of truncating
+	DropEmptyTags        bool          `json:"drop_empty_tags,omitempty" yaml:"drop_empty_tags,omitempty"`               // Remove tags with empty name or value
+	EmitInternalMetrics  bool          `json:"emit_internal_metrics,omitempty" yaml:"emit_internal_metrics,omitempty"`   // Emits metrics_emitted_total and metrics_filtered_total counters each ProfileInterval
+	InternTags           bool          `json:"intern_tags,omitempty" yaml:"intern_tags,omitempty"`                       // Canonicalize tag names and values built per call, so the tags retained by sinks share the backing strings
+	EmitRawEMA           bool          `json:"emit_raw_ema,omitempty" yaml:"emit_raw_ema,omitempty"`                     // Emits the raw value of SetGaugeEMA as <key>_raw gauge
+	MaxEMASeries         int           `json:"max_ema_series,omitempty" yaml:"max_ema_series,omitempty"`                 // Maximum number of series smoothed by SetGaugeEMA, by default 1000
+	MaxChangedSeries     int           `json:"max_changed_series,omitempty" yaml:"max_changed_series,omitempty"`         // Maximum number of series tracked by SetGaugeIfChanged, by default 1000
+	MaxIncrGaugeSeries   int           `json:"max_incr_gauge_series,omitempty" yaml:"max_incr_gauge_series,omitempty"`   // Maximum number of series tracked by IncrGauge for the sinks without GaugeDeltaSink, by default 1000, the new series over the limit are dropped
+
+	// NaNGaugeBehavior specifies the handling of NaN gauge values,
+	// by default the emission is dropped
+	NaNGaugeBehavior NaNGaugeBehavior `json:"nan_gauge_behavior,omitempty" yaml:"nan_gauge_behavior,omitempty"`
+
+	// NameCase specifies the normalization of the metric names,
+	// applied before Aliases and prefixes, by default the names are used as is
+	NameCase NameCase `json:"name_case,omitempty" yaml:"name_case,omitempty"`
+
+	// TypePrefixTypes is a list of the metric types to prefix with EnableTypePrefix,
+	// for example counter and gauge. If empty, all types are prefixed.
+	// The timers are prefixed with "sample", unless "timer" is in the list.
+	TypePrefixTypes []string `json:"type_prefix_types,omitempty" yaml:"type_prefix_types,omitempty"`
+
+	// DisabledRuntimeMetrics is a list of the runtime metric names to not emit,
+	// for example runtime_malloc_count
+	DisabledRuntimeMetrics []string `json:"disabled_runtime_metrics,omitempty" yaml:"disabled_runtime_metrics,omitempty"`
+
+	AllowedPrefixes []string `json:"allowed_prefixes,omitempty" yaml:"allowed_prefixes,omitempty"` // A list of the first metric prefixes to allow
+	BlockedPrefixes []string `json:"blocked_prefixes,omitempty" yaml:"blocked_prefixes,omitempty"` // A list of the first metric prefixes to block
+	FilterDefault   bool     `json:"filter_default,omitempty" yaml:"filter_default,omitempty"`     // Whether to allow metrics by default
+
+	// MetricLabels is a map of metric name to the list of allowed tag names.
+	// Tags with names not in the list are dropped. Metrics not in the map are not filtered.
+	MetricLabels map[string][]string `json:"metric_labels,omitempty" yaml:"metric_labels,omitempty"`
+
+	// Aliases is a map of metric name to the name to emit instead,
+	// to roll out renames. The settings keyed by metric name,
+	// like MetricLabels and UnprefixedMetrics, use the emitted name.
+	Aliases map[string]string `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+
+	// UnprefixedMetrics is a list of metric names that are emitted as is,
+	// without hostname, type, service and global prefixes.
+	// It is used for standardized metrics shared across services.
+	UnprefixedMetrics []string `json:"unprefixed_metrics,omitempty" yaml:"unprefixed_metrics,omitempty"`
 }
 
+// NaNGaugeBehavior specifies the handling of NaN gauge values
+type NaNGaugeBehavior int
+
+const (
+	// NaNGaugeDrop drops the emission, the default
+	NaNGaugeDrop NaNGaugeBehavior = iota
+	// NaNGaugeZero emits 0 instead
+	NaNGaugeZero
+	// NaNGaugePass emits NaN to the sink
+	NaNGaugePass
+)
+
+// NameCase specifies the normalization of the metric names
+type NameCase int
+
+const (
+	// NameCaseAsIs uses the names as is, the default
+	NameCaseAsIs NameCase = iota
+	// NameCaseSnake converts camelCase and PascalCase names to snake_case
+	NameCaseSnake
+	// NameCaseLower converts the names to lower case
+	NameCaseLower
+)
+
 // Metrics represents an instance of a metrics sink that can
 // be used to emit
 type Metrics struct {
 	Config
 	lastNumGC uint32
-	sink      Sink
+	sink      atomic.Value // sinkHolder
+	started   time.Time
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+	// readMemStats reads the runtime memory stats, it is replaced in tests
+	readMemStats func(*runtime.MemStats)
+	// disabled is set by SetEnabled(false) to stop the emission
+	disabled atomic.Bool
+	// emitted and filtered are the number of allowed and blocked metrics
+	// since the last emission, with EmitInternalMetrics
+	emitted  atomic.Uint64
+	filtered atomic.Uint64
+	// droppedLabels is the number of tags dropped by MetricLabels
+	droppedLabels atomic.Uint64
+
+	// filter is the current prefix filter, replaced by UpdateFilter
+	filter atomic.Pointer[prefixFilter]
+	// filterLock serializes the filter updates
+	filterLock sync.Mutex
+
+	// gauges keeps the current values for IncrGauge,
+	// if the sink does not implement GaugeDeltaSink
+	gauges    map[string]float64
+	gaugeLock sync.Mutex
+	// droppedGauges is the number of IncrGauge emissions over MaxIncrGaugeSeries
+	droppedGauges atomic.Uint64
+
+	// emas keeps the moving averages for SetGaugeEMA
+	emas    map[string]float64
+	emaLock sync.Mutex
+
+	// lastGauges keeps the last emitted values for SetGaugeIfChanged
+	lastGauges     map[string]float64
+	lastGaugesLock sync.Mutex
+
+	// collectors are called each ProfileInterval
+	collectors     []func(Provider)
+	collectorsLock sync.RWMutex
+	collectOnce    sync.Once
 }
 
 // Shared global metrics instance
@@ -43,7 +154,9 @@ var globalMetrics atomic.Value // *Metrics
 
 func init() {
 	// Initialize to a blackhole sink to avoid errors
-	globalMetrics.Store(&Metrics{sink: &BlackholeSink{}})
+	m := &Metrics{}
+	m.SetSink(&BlackholeSink{})
+	globalMetrics.Store(m)
 }
 
 // DefaultConfig provides a sane default configuration
@@ -66,9 +179,13 @@ func DefaultConfig(serviceName string) *Config {
 
 // New is used to create a new instance of Metrics
 func New(conf *Config, sink Sink) (*Metrics, error) {
-	met := &Metrics{}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	met := &Metrics{now: time.Now, readMemStats: runtime.ReadMemStats}
+	met.started = met.now()
 	met.Config = *conf
-	met.sink = sink
+	met.SetSink(sink)
 	met.UpdateFilter(conf.AllowedPrefixes, conf.BlockedPrefixes)
 
 	if met.Config.TimerGranularity == 0 {
@@ -79,8 +196,8 @@ func New(conf *Config, sink Sink) (*Metrics, error) {
 	}
 
 	// Start the runtime collector
-	if conf.EnableRuntimeMetrics {
-		go met.collectStats()
+	if conf.EnableRuntimeMetrics || conf.EmitInternalMetrics {
+		met.startCollector()
 	}
 	return met, nil
 }
@@ -97,6 +214,11 @@ func NewGlobal(conf *Config, sink Sink) (*Metrics, error) {
 
 // Proxy all the methods to the globalMetrics instance
 
+// SetGlobalEnabled enables or disables the emission of the global metrics
+func SetGlobalEnabled(enabled bool) {
+	globalMetrics.Load().(*Metrics).SetEnabled(enabled)
+}
+
 // SetGauge should retain the last value it is set to
 func SetGauge(key string, val float64, tags ...Tag) {
 	globalMetrics.Load().(*Metrics).SetGauge(key, val, tags...)
@@ -107,6 +229,31 @@ func IncrCounter(key string, val float64, tags ...Tag) {
 	globalMetrics.Load().(*Metrics).IncrCounter(key, val, tags...)
 }
 
+// InitCounter registers the counter at 0, if the sink supports it
+func InitCounter(key string, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).InitCounter(key, tags...)
+}
+
+// SetGaugeClamped sets the gauge to the value clamped into [min, max]
+func SetGaugeClamped(key string, val, min, max float64, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).SetGaugeClamped(key, val, min, max, tags...)
+}
+
+// SetGaugeEMA sets the gauge to the exponential moving average of the values
+func SetGaugeEMA(key string, val, alpha float64, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).SetGaugeEMA(key, val, alpha, tags...)
+}
+
+// SetGaugeIfChanged sets the gauge only if the value differs from the last emitted
+func SetGaugeIfChanged(key string, val float64, tags ...Tag) bool {
+	return globalMetrics.Load().(*Metrics).SetGaugeIfChanged(key, val, tags...)
+}
+
+// SetGaugeAt sets the gauge with the provided timestamp
+func SetGaugeAt(key string, val float64, ts time.Time, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).SetGaugeAt(key, val, ts, tags...)
+}
+
 // AddSample is for timing information, where quantiles are used
 func AddSample(key string, val float64, tags ...Tag) {
 	globalMetrics.Load().(*Metrics).AddSample(key, val, tags...)
@@ -117,6 +264,31 @@ func MeasureSince(key string, start time.Time, tags ...Tag) {
 	globalMetrics.Load().(*Metrics).MeasureSince(key, start, tags...)
 }
 
+// AddSampleN adds the sample observed n times
+func AddSampleN(key string, val float64, n int, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).AddSampleN(key, val, n, tags...)
+}
+
+// IncrGauge adjusts the gauge by delta
+func IncrGauge(key string, delta float64, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).IncrGauge(key, delta, tags...)
+}
+
+// IncrRatio increments `<base>_total` and `<base>_errors_total` counters
+func IncrRatio(base string, success bool, tags ...Tag) {
+	globalMetrics.Load().(*Metrics).IncrRatio(base, success, tags...)
+}
+
+// TimeBlock returns a function to emit `<key>_duration` sample and `<key>_total` counter
+func TimeBlock(key string, tags ...Tag) func() {
+	return globalMetrics.Load().(*Metrics).TimeBlock(key, tags...)
+}
+
+// WouldEmit returns the filter decision and the final metrics name and tags
+func WouldEmit(typ string, key string, tags ...Tag) (bool, string, []Tag) {
+	return globalMetrics.Load().(*Metrics).WouldEmit(typ, key, tags...)
+}
+
 // UpdateFilter updates filters
 func UpdateFilter(allow, block []string) {
 	globalMetrics.Load().(*Metrics).UpdateFilter(allow, block)
@@ -124,48 +296,286 @@ func UpdateFilter(allow, block []string) {
 
 // Prepare returns final metrics name and tags to emit
 func (m *Config) Prepare(typ string, key string, tags ...Tag) (bool, string, []Tag) {
+	return m.prepare(typ, key, m.prefixFilter(), nil, tags)
+}
+
+// Prepare returns final metrics name and tags to emit,
+// and counts the dropped labels, and the allowed and blocked metrics with EmitInternalMetrics
+func (m *Metrics) Prepare(typ string, key string, tags ...Tag) (bool, string, []Tag) {
+	allowed, key, tags := m.Config.prepare(typ, key, m.currentFilter(), &m.droppedLabels, tags)
+	if m.EmitInternalMetrics {
+		if allowed {
+			m.emitted.Add(1)
+		} else {
+			m.filtered.Add(1)
+		}
+	}
+	return allowed, key, tags
+}
+
+// WouldEmit returns the filter decision and the final metrics name and tags,
+// as Prepare does, but without updating the internal counters.
+// It is used to troubleshoot the filters configuration.
+func (m *Config) WouldEmit(typ string, key string, tags ...Tag) (allowed bool, finalKey string, finalTags []Tag) {
+	return m.prepare(typ, key, m.prefixFilter(), nil, tags)
+}
+
+// WouldEmit returns the filter decision and the final metrics name and tags,
+// as Prepare does with the current filter, but without updating the internal counters.
+func (m *Metrics) WouldEmit(typ string, key string, tags ...Tag) (allowed bool, finalKey string, finalTags []Tag) {
+	return m.Config.prepare(typ, key, m.currentFilter(), nil, tags)
+}
+
+// prepare implements Prepare with the prefix filter,
+// the tags dropped by MetricLabels are counted in dropped, if not nil
+func (m *Config) prepare(typ string, key string, filter *prefixFilter, dropped *atomic.Uint64, tags []Tag) (bool, string, []Tag) {
+	switch m.NameCase {
+	case NameCaseSnake:
+		key = snakeCase(key)
+	case NameCaseLower:
+		key = strings.ToLower(key)
+	}
+	if alias, ok := m.Aliases[key]; ok {
+		key = alias
+	}
+	if allowed, ok := m.MetricLabels[key]; ok && len(tags) > 0 {
+		tags = allowedLabels(allowed, tags, dropped)
+	}
 	if len(m.GlobalTags) > 0 {
 		tags = append(tags, m.GlobalTags...)
 	}
+	prefixed := !slices.Contains(m.UnprefixedMetrics, key)
 	if m.HostName != "" {
 		if m.EnableHostnameLabel {
 			tags = append(tags, Tag{"host", m.HostName})
-		} else if m.EnableHostname {
+		} else if m.EnableHostname && prefixed {
 			key = m.HostName + "_" + key
 		}
 	}
-	if m.EnableTypePrefix {
-		key = typ + "_" + key
+	if m.EnableTypeLabel {
+		tags = append(tags, Tag{"type", typ})
+	} else if m.EnableTypePrefix && prefixed {
+		prefixType := typ
+		if typ == TypeTimer && !slices.Contains(m.TypePrefixTypes, TypeTimer) {
+			// timers are prefixed as samples, unless "timer" is listed
+			prefixType = TypeSample
+		}
+		if len(m.TypePrefixTypes) == 0 || slices.Contains(m.TypePrefixTypes, prefixType) {
+			key = prefixType + "_" + key
+		}
 	}
 	if m.ServiceName != "" {
 		if m.EnableServiceLabel {
 			tags = append(tags, Tag{"service", m.ServiceName})
-		} else {
+		} else if prefixed {
 			key = m.ServiceName + "_" + key
 		}
 	}
-	if m.GlobalPrefix != "" {
+	if m.GlobalPrefix != "" && prefixed {
 		key = m.GlobalPrefix + "_" + key
 	}
+	if m.DropEmptyTags {
+		tags = dropEmptyTags(tags)
+	}
+	if m.InternTags {
+		tags = internTags(tags)
+	}
+	if m.MaxTagValueLength > 0 {
+		var ok bool
+		if tags, ok = m.limitTagValues(tags); !ok {
+			return false, key, tags
+		}
+	}
+	return filter.allow(key, m.FilterDefault), key, tags
+}
+
+// allowedLabels returns tags with the allowed names only,
+// and counts the dropped tags if dropped is not nil.
+// The provided slice is not modified.
+func allowedLabels(allowed []string, tags []Tag, dropped *atomic.Uint64) []Tag {
+	filtered := make([]Tag, 0, len(tags))
+	for _, t := range tags {
+		if slices.Contains(allowed, t.Name) {
+			filtered = append(filtered, t)
+		} else if dropped != nil {
+			dropped.Add(1)
+		}
+	}
+	return filtered
+}
+
+// DroppedLabels returns the number of tags dropped by MetricLabels
+func (m *Metrics) DroppedLabels() uint64 {
+	return m.droppedLabels.Load()
+}
+
+// snakeCase converts camelCase and PascalCase name to snake_case,
+// the acronyms are kept together: HTTPRequests is converted to http_requests
+func snakeCase(s string) string {
+	if !strings.ContainsFunc(s, isUpper) {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s) + 4)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isUpper(rune(c)) {
+			sb.WriteByte(c)
+			continue
+		}
+		if i > 0 && s[i-1] != '_' {
+			prev := rune(s[i-1])
+			nextLower := i+1 < len(s) && s[i+1] >= 'a' && s[i+1] <= 'z'
+			if !isUpper(prev) || nextLower {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteByte(c + 'a' - 'A')
+	}
+	return sb.String()
+}
 
-	return m.AllowMetric(key), key, tags
+func isUpper(r rune) bool {
+	return r >= 'A' && r <= 'Z'
+}
+
+// dropEmptyTags returns tags without empty names or values.
+// The provided slice is not modified.
+func dropEmptyTags(tags []Tag) []Tag {
+	idx := slices.IndexFunc(tags, isEmptyTag)
+	if idx < 0 {
+		return tags
+	}
+	filtered := slices.Clone(tags[:idx])
+	for _, t := range tags[idx+1:] {
+		if !isEmptyTag(t) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// internTags returns a copy of the tags with the canonical names and values.
+// The canonical strings are kept by the unique package,
+// and released when no longer referenced.
+func internTags(tags []Tag) []Tag {
+	interned := make([]Tag, len(tags))
+	for i, t := range tags {
+		interned[i] = Tag{
+			Name:  unique.Make(t.Name).Value(),
+			Value: unique.Make(t.Value).Value(),
+		}
+	}
+	return interned
+}
+
+func isEmptyTag(t Tag) bool {
+	return t.Name == "" || t.Value == ""
+}
+
+// truncatedSuffix is appended to the truncated tag values
+const truncatedSuffix = "..."
+
+// truncateTagValue truncates v on a rune boundary to n bytes,
+// including truncatedSuffix if it fits
+func truncateTagValue(v string, n int) string {
+	suffix := truncatedSuffix
+	if n <= len(suffix) {
+		suffix = ""
+	}
+	cut := n - len(suffix)
+	for cut > 0 && !utf8.RuneStart(v[cut]) {
+		cut--
+	}
+	return v[:cut] + suffix
+}
+
+// limitTagValues truncates tag values longer than MaxTagValueLength,
+// and returns false if the metric must be dropped.
+// The provided slice is not modified, a copy is returned if truncated.
+func (m *Config) limitTagValues(tags []Tag) ([]Tag, bool) {
+	copied := false
+	for i, t := range tags {
+		if len(t.Value) <= m.MaxTagValueLength {
+			continue
+		}
+		if m.DropLongTagValues {
+			return tags, false
+		}
+		if !copied {
+			tags = append([]Tag(nil), tags...)
+			copied = true
+		}
+		tags[i].Value = truncateTagValue(t.Value, m.MaxTagValueLength)
+	}
+	return tags, true
 }
 
 // AllowMetric returns whether the metric should be allowed based on configured prefix filters
 // Also return the applicable tags
 func (m *Config) AllowMetric(key string) bool {
-	if len(m.BlockedPrefixes) > 0 {
-		if StringStartsWithOneOf(key, m.BlockedPrefixes) {
+	return m.prefixFilter().allow(key, m.FilterDefault)
+}
+
+// AllowMetric returns whether the metric should be allowed based on the current prefix filter
+func (m *Metrics) AllowMetric(key string) bool {
+	return m.currentFilter().allow(key, m.FilterDefault)
+}
+
+// prefixFilter is the allowed and blocked prefixes of the metrics
+type prefixFilter struct {
+	allowed []string
+	blocked []string
+}
+
+// prefixFilter returns the prefix filter of the config
+func (m *Config) prefixFilter() *prefixFilter {
+	return &prefixFilter{allowed: m.AllowedPrefixes, blocked: m.BlockedPrefixes}
+}
+
+// currentFilter returns the prefix filter set by UpdateFilter
+func (m *Metrics) currentFilter() *prefixFilter {
+	if f := m.filter.Load(); f != nil {
+		return f
+	}
+	return m.Config.prefixFilter()
+}
+
+// allow returns whether the metric should be allowed by the prefixes
+func (f *prefixFilter) allow(key string, filterDefault bool) bool {
+	if len(f.blocked) > 0 {
+		if StringStartsWithOneOf(key, f.blocked) {
 			return false
 		}
 	}
-	if len(m.AllowedPrefixes) > 0 {
-		if !StringStartsWithOneOf(key, m.AllowedPrefixes) {
+	if len(f.allowed) > 0 {
+		if !StringStartsWithOneOf(key, f.allowed) {
 			return true
 		}
 	}
 
-	return m.FilterDefault
+	return filterDefault
+}
+
+// MergeFilters adds the allowed and blocked prefixes of other config,
+// the prefixes are not duplicated
+func (m *Config) MergeFilters(other *Config) {
+	if other == nil {
+		return
+	}
+	m.AllowedPrefixes = unionStrings(m.AllowedPrefixes, other.AllowedPrefixes)
+	m.BlockedPrefixes = unionStrings(m.BlockedPrefixes, other.BlockedPrefixes)
+}
+
+// unionStrings returns the unique values of both slices, in order
+func unionStrings(a, b []string) []string {
+	var res []string
+	for _, s := range slices.Concat(a, b) {
+		if !slices.Contains(res, s) {
+			res = append(res, s)
+		}
+	}
+	return res
 }
 
 // Define metrics type const
@@ -173,16 +583,22 @@ const (
 	TypeCounter = "counter"
 	TypeSample  = "sample"
 	TypeGauge   = "gauge"
+	// TypeTimer is a sample of the duration emitted by MeasureSince,
+	// the type is used for the label, and the sinks receive it as a sample.
+	// The prefix of the timers is "sample", unless TypePrefixTypes lists "timer".
+	TypeTimer = "timer"
 )
 
 // Describe provides metric description
 type Describe struct {
-	// Type of the metric: counter|gauge|summary
+	// Type of the metric: counter|gauge|sample|timer
 	Type string
 	// Name is the metric name
 	Name string
 	// Help provides description
 	Help string
+	// Unit of the metric, for example "seconds" or "bytes"
+	Unit string
 	// RequiredTags is a list of metric tags
 	RequiredTags []string
 }
@@ -234,13 +650,68 @@ func (d *Describe) MeasureSince(start time.Time, tags ...string) {
 	MeasureSince(d.Name, start, d.Tags(tags...)...)
 }
 
+// IncrRatio increments `<name>_total` and `<name>_errors_total` counters
+func (d *Describe) IncrRatio(success bool, tags ...string) {
+	IncrRatio(d.Name, success, d.Tags(tags...)...)
+}
+
+// BindTo returns the description bound to the provider,
+// to emit metrics through the provider instead of the global one.
+func (d *Describe) BindTo(p Provider) BoundDescribe {
+	return BoundDescribe{Describe: d, Provider: p}
+}
+
+// BoundDescribe provides metric description bound to a Provider
+type BoundDescribe struct {
+	*Describe
+	Provider Provider
+}
+
+// SetGauge should retain the last value it is set to
+func (b BoundDescribe) SetGauge(val float64, tags ...string) {
+	b.Provider.SetGauge(b.Name, val, b.Tags(tags...)...)
+}
+
+// IncrCounter should accumulate values
+func (b BoundDescribe) IncrCounter(val float64, tags ...string) {
+	b.Provider.IncrCounter(b.Name, val, b.Tags(tags...)...)
+}
+
+// AddSample is for timing information, where quantiles are used
+func (b BoundDescribe) AddSample(val float64, tags ...string) {
+	b.Provider.AddSample(b.Name, val, b.Tags(tags...)...)
+}
+
+// MeasureSince emits sample
+func (b BoundDescribe) MeasureSince(start time.Time, tags ...string) {
+	b.Provider.MeasureSince(b.Name, start, b.Tags(tags...)...)
+}
+
+// IncrRatio increments `<name>_total` and `<name>_errors_total` counters
+func (b BoundDescribe) IncrRatio(success bool, tags ...string) {
+	t := b.Tags(tags...)
+	b.Provider.IncrCounter(b.Name+"_total", 1, t...)
+	if !success {
+		b.Provider.IncrCounter(b.Name+"_errors_total", 1, t...)
+	}
+}
+
 // Help returns prepared help for described metrics
 func (m *Config) Help(providers ...[]*Describe) map[string]string {
+	return m.help(m.prefixFilter(), providers)
+}
+
+// Help returns prepared help for described metrics, with the current filter
+func (m *Metrics) Help(providers ...[]*Describe) map[string]string {
+	return m.Config.help(m.currentFilter(), providers)
+}
+
+func (m *Config) help(filter *prefixFilter, providers [][]*Describe) map[string]string {
 	h := make(map[string]string)
 
 	for _, descs := range providers {
 		for _, d := range descs {
-			allowed, key, _ := m.Prepare(d.Type, d.Name)
+			allowed, key, _ := m.prepare(d.Type, d.Name, filter, nil, nil)
 			if allowed {
 				h[key] = d.Help
 			}
@@ -248,3 +719,30 @@ func (m *Config) Help(providers ...[]*Describe) map[string]string {
 	}
 	return h
 }
+
+// Units returns prepared units for described metrics, that have Unit
+func (m *Config) Units(providers ...[]*Describe) map[string]string {
+	return m.units(m.prefixFilter(), providers)
+}
+
+// Units returns prepared units for described metrics, that have Unit, with the current filter
+func (m *Metrics) Units(providers ...[]*Describe) map[string]string {
+	return m.Config.units(m.currentFilter(), providers)
+}
+
+func (m *Config) units(filter *prefixFilter, providers [][]*Describe) map[string]string {
+	u := make(map[string]string)
+
+	for _, descs := range providers {
+		for _, d := range descs {
+			if d.Unit == "" {
+				continue
+			}
+			allowed, key, _ := m.prepare(d.Type, d.Name, filter, nil, nil)
+			if allowed {
+				u[key] = d.Unit
+			}
+		}
+	}
+	return u
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/effective-security/xlog"
+)
+
+// StrictOpts is used to configure the StrictSink
+type StrictOpts struct {
+	// Prefix is removed from the keys before the lookup,
+	// for example the ServiceName and GlobalPrefix added by Prepare: "es_svc_"
+	Prefix string
+	// AllowedTags is a list of the tags allowed in addition to RequiredTags,
+	// for example the GlobalTags, host or service
+	AllowedTags []string
+	// Panic specifies to panic on the undeclared metrics, to be used in development
+	Panic bool
+}
+
+// StrictSink drops the metrics that are not declared in the Describe list,
+// or emitted with the tags that do not match RequiredTags
+type StrictSink struct {
+	inner   Sink
+	opts    StrictOpts
+	descs   map[string]*Describe
+	dropped atomic.Uint64
+}
+
+// NewStrictSink returns a sink that forwards to inner only the declared metrics
+func NewStrictSink(inner Sink, descs []*Describe, opts StrictOpts) *StrictSink {
+	s := &StrictSink{
+		inner: inner,
+		opts:  opts,
+		descs: make(map[string]*Describe, len(descs)),
+	}
+	for _, d := range descs {
+		s.descs[d.Name] = d
+	}
+	return s
+}
+
+// SetGauge should retain the last value it is set to
+func (s *StrictSink) SetGauge(key string, val float64, tags []Tag) {
+	if s.allowed(key, tags) {
+		s.inner.SetGauge(key, val, tags)
+	}
+}
+
+// IncrCounter should accumulate values
+func (s *StrictSink) IncrCounter(key string, val float64, tags []Tag) {
+	if s.allowed(key, tags) {
+		s.inner.IncrCounter(key, val, tags)
+	}
+}
+
+// AddSample is for timing information, where quantiles are used
+func (s *StrictSink) AddSample(key string, val float64, tags []Tag) {
+	if s.allowed(key, tags) {
+		s.inner.AddSample(key, val, tags)
+	}
+}
+
+// Dropped returns the number of the dropped emissions
+func (s *StrictSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// allowed returns true if the metric is declared, and the tags match RequiredTags
+func (s *StrictSink) allowed(key string, tags []Tag) bool {
+	name := strings.TrimPrefix(key, s.opts.Prefix)
+	d, ok := s.descs[name]
+	if !ok {
+		s.violation("undeclared_metric", key, "")
+		return false
+	}
+	for _, required := range d.RequiredTags {
+		if !slices.ContainsFunc(tags, func(t Tag) bool { return t.Name == required }) {
+			s.violation("missing_tag", key, required)
+			return false
+		}
+	}
+	for _, t := range tags {
+		if !slices.Contains(d.RequiredTags, t.Name) && !slices.Contains(s.opts.AllowedTags, t.Name) {
+			s.violation("undeclared_tag", key, t.Name)
+			return false
+		}
+	}
+	return true
+}
+
+func (s *StrictSink) violation(reason, key, tag string) {
+	if s.opts.Panic {
+		panic(fmt.Sprintf("strict metrics: %s: metric=%s tag=%s", reason, key, tag))
+	}
+	s.dropped.Add(1)
+	logger.KV(xlog.WARNING, "reason", reason, "metric", key, "tag", tag)
+}
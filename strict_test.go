@@ -0,0 +1,54 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StrictSink(t *testing.T) {
+	descs := []*metrics.Describe{
+		{Type: metrics.TypeCounter, Name: "http_requests", RequiredTags: []string{"method"}},
+		{Type: metrics.TypeGauge, Name: "connections"},
+	}
+	rec := metricstest.NewOrderedRecorder()
+	strict := metrics.NewStrictSink(rec, descs, metrics.StrictOpts{
+		Prefix:      "es_",
+		AllowedTags: []string{"service"},
+	})
+	prov, err := metrics.New(&metrics.Config{
+		FilterDefault: true,
+		ServiceName:   "es",
+	}, strict)
+	require.NoError(t, err)
+
+	prov.IncrCounter("http_requests", 1, metrics.Tag{Name: "method", Value: "get"})
+	prov.SetGauge("connections", 2)
+	// undeclared metric
+	prov.SetGauge("ad_hoc", 3)
+	// missing required tag
+	prov.IncrCounter("http_requests", 1)
+	// undeclared tag
+	prov.IncrCounter("http_requests", 1, metrics.Tag{Name: "method", Value: "get"}, metrics.Tag{Name: "user", Value: "u1"})
+	// allowed tag
+	prov.SetGauge("connections", 4, metrics.Tag{Name: "service", Value: "es"})
+
+	rec.AssertSequence(t,
+		metricstest.RecordedCall{Type: metrics.TypeCounter, Key: "es_http_requests", Value: 1},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "es_connections", Value: 2},
+		metricstest.RecordedCall{Type: metrics.TypeGauge, Key: "es_connections", Value: 4},
+	)
+	assert.Len(t, rec.Calls(), 3)
+	assert.Equal(t, uint64(3), strict.Dropped())
+
+	dev := metrics.NewStrictSink(rec, descs, metrics.StrictOpts{Panic: true})
+	assert.Panics(t, func() {
+		dev.SetGauge("ad_hoc", 1, nil)
+	})
+	assert.NotPanics(t, func() {
+		dev.SetGauge("connections", 1, nil)
+	})
+}
@@ -0,0 +1,70 @@
+// Package syslogsink provides a metrics.Sink that writes the metrics
+// as text lines to syslog or any other writer, for example stderr collected by journald.
+package syslogsink
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/effective-security/metrics"
+)
+
+var _ metrics.Sink = (*Sink)(nil)
+
+// Sink writes each metric as a line in the following format:
+// `<type> <key> <value> [<tag>=<value> ...]`
+type Sink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterSink returns a Sink that writes the metrics to w,
+// for example os.Stderr to be collected by journald
+func NewWriterSink(w io.Writer) *Sink {
+	return &Sink{w: w}
+}
+
+// SetGauge should retain the last value it is set to
+func (s *Sink) SetGauge(key string, val float64, tags []metrics.Tag) {
+	s.write(metrics.TypeGauge, key, val, tags)
+}
+
+// IncrCounter should accumulate values
+func (s *Sink) IncrCounter(key string, val float64, tags []metrics.Tag) {
+	s.write(metrics.TypeCounter, key, val, tags)
+}
+
+// AddSample is for timing information, where quantiles are used
+func (s *Sink) AddSample(key string, val float64, tags []metrics.Tag) {
+	s.write(metrics.TypeSample, key, val, tags)
+}
+
+func (s *Sink) write(typ, key string, val float64, tags []metrics.Tag) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, _ = io.WriteString(s.w, formatLine(typ, key, val, tags))
+}
+
+// formatLine returns the metric line, the tag values with spaces are quoted
+func formatLine(typ, key string, val float64, tags []metrics.Tag) string {
+	var b strings.Builder
+	b.WriteString(typ)
+	b.WriteString(" ")
+	b.WriteString(key)
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatFloat(val, 'f', -1, 64))
+	for _, t := range tags {
+		b.WriteString(" ")
+		b.WriteString(t.Name)
+		b.WriteString("=")
+		if strings.ContainsAny(t.Value, " \"") {
+			b.WriteString(strconv.Quote(t.Value))
+		} else {
+			b.WriteString(t.Value)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
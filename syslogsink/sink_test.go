@@ -0,0 +1,33 @@
+package syslogsink_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/effective-security/metrics/syslogsink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Sink(t *testing.T) {
+	var w strings.Builder
+	s := syslogsink.NewWriterSink(&w)
+
+	tags := []metrics.Tag{{Name: "method", Value: "get"}, {Name: "agent", Value: "go client"}}
+	s.SetGauge("test_gauge", 1.5, nil)
+	s.IncrCounter("test_counter", 2, tags)
+	s.AddSample("test_sample", 0.25, tags[:1])
+
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "gauge test_gauge 1.5", lines[0])
+	assert.Equal(t, `counter test_counter 2 method=get agent="go client"`, lines[1])
+	assert.Equal(t, "sample test_sample 0.25 method=get", lines[2])
+}
+
+func TestSinkConformance(t *testing.T) {
+	var w strings.Builder
+	metricstest.SinkConformance(t, syslogsink.NewWriterSink(&w))
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+
+package syslogsink
+
+import (
+	"log/syslog"
+
+	"github.com/pkg/errors"
+)
+
+// NewSink returns a Sink that writes the metrics to the system log
+// with the tag, priority and facility, for example syslog.LOG_INFO|syslog.LOG_LOCAL0
+func NewSink(tag string, priority syslog.Priority) (*Sink, error) {
+	w, err := syslog.New(priority, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+	return NewWriterSink(w), nil
+}
@@ -0,0 +1,112 @@
+// Package textfile provides a metrics.Sink that periodically writes the metrics
+// in Prometheus text format to a file, for the node_exporter textfile collector.
+package textfile
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/prometheus"
+	"github.com/effective-security/xlog"
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var logger = xlog.NewPackageLogger("github.com/effective-security/metrics", "textfile")
+
+// DefaultInterval is the default interval to write the file
+const DefaultInterval = 15 * time.Second
+
+var (
+	_ metrics.Sink          = (*Sink)(nil)
+	_ metrics.FlushableSink = (*Sink)(nil)
+)
+
+// Config is used to configure the Sink
+type Config struct {
+	// Path of the file, for example /var/lib/node_exporter/textfile/app.prom
+	Path string
+	// Interval to write the file, by default DefaultInterval
+	Interval time.Duration
+	// FileMode of the file, by default prometheus.DefaultDumpFileMode,
+	// the file must be readable by node_exporter
+	FileMode os.FileMode
+}
+
+// Sink aggregates the metrics in the Prometheus sink,
+// and writes them to the file atomically on each interval
+type Sink struct {
+	*prometheus.Sink
+
+	path     string
+	mode     os.FileMode
+	stopChan chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewSink creates the Sink and starts writing the file
+func NewSink(cfg Config) (*Sink, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("textfile: path is required")
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	mode := cfg.FileMode
+	if mode == 0 {
+		mode = prometheus.DefaultDumpFileMode
+	}
+
+	opts := prometheus.DefaultPrometheusOpts
+	opts.Name = "textfile_sink"
+	opts.Registerer = prom.NewRegistry()
+	promSink, err := prometheus.NewSinkFrom(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		Sink:     promSink,
+		path:     cfg.Path,
+		mode:     mode,
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+func (s *Sink) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.DumpToFileMode(s.path, s.mode); err != nil {
+				logger.KV(xlog.ERROR, "reason", "write", "path", s.path, "err", err)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// Flush writes the current metrics to the file
+func (s *Sink) Flush(_ context.Context) error {
+	return s.DumpToFileMode(s.path, s.mode)
+}
+
+// Close stops the periodic writes, and writes the file one last time
+func (s *Sink) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+	<-s.done
+	return s.DumpToFileMode(s.path, s.mode)
+}
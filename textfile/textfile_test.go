@@ -0,0 +1,110 @@
+package textfile_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/effective-security/metrics"
+	"github.com/effective-security/metrics/metricstest"
+	"github.com/effective-security/metrics/textfile"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Sink(t *testing.T) {
+	_, err := textfile.NewSink(textfile.Config{})
+	assert.EqualError(t, err, "textfile: path is required")
+
+	path := filepath.Join(t.TempDir(), "app.prom")
+	s, err := textfile.NewSink(textfile.Config{
+		Path:     path,
+		Interval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	prov, err := metrics.New(&metrics.Config{FilterDefault: true}, s)
+	require.NoError(t, err)
+
+	gaugeValue := func() float64 {
+		f, err := os.Open(path)
+		if err != nil {
+			return -1
+		}
+		defer f.Close()
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(f)
+		require.NoError(t, err)
+		mf, ok := families["test_gauge"]
+		if !ok {
+			return -1
+		}
+		return mf.GetMetric()[0].GetGauge().GetValue()
+	}
+
+	prov.SetGauge("test_gauge", 1, metrics.Tag{Name: "tag1", Value: "val1"})
+	prov.IncrCounter("test_counter", 2)
+	require.Eventually(t, func() bool {
+		return gaugeValue() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the file is updated on the next interval
+	prov.SetGauge("test_gauge", 5, metrics.Tag{Name: "tag1", Value: "val1"})
+	require.Eventually(t, func() bool {
+		return gaugeValue() == 5
+	}, time.Second, 10*time.Millisecond)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `test_gauge{tag1="val1"} 5`)
+	assert.Contains(t, string(b), "test_counter 2")
+
+	// the file is readable by node_exporter
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	prov.SetGauge("test_gauge", 7, metrics.Tag{Name: "tag1", Value: "val1"})
+	require.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, float64(7), gaugeValue())
+
+	prov.SetGauge("test_gauge", 9, metrics.Tag{Name: "tag1", Value: "val1"})
+	require.NoError(t, s.Close())
+	assert.Equal(t, float64(9), gaugeValue())
+	require.NoError(t, s.Close())
+}
+
+func Test_SinkConformance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.prom")
+	s, err := textfile.NewSink(textfile.Config{Path: path})
+	require.NoError(t, err)
+	defer s.Close()
+
+	metricstest.SinkConformanceWithReader(t, s, func(hash string) (float64, bool) {
+		val, ok := s.Snapshot()[hash]
+		return val, ok
+	})
+
+	require.NoError(t, s.Flush(context.Background()))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `conformance_counter_tags{tag1="val1",tag2="val2"} 1003.5`)
+}
+
+func Test_SinkFileMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.prom")
+	s, err := textfile.NewSink(textfile.Config{
+		Path:     path,
+		Interval: time.Hour,
+		FileMode: 0640,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+}